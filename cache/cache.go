@@ -50,6 +50,9 @@ type item[T any] struct {
 	object T
 	// expiresAt is the item's expiration time.
 	expiresAt time.Time
+	// deleted indicates whether the item was deleted, as opposed to
+	// having expired.
+	deleted bool
 }
 
 type cache[T any] struct {
@@ -61,7 +64,11 @@ type cache[T any] struct {
 	// It is initially true, and set to false when the items are not sorted.
 	sorted bool
 	// capacity is the maximum number of index the cache can hold.
-	capacity   int
+	capacity int
+	// retention is how long expired items are kept before the cleanup.
+	retention time.Duration
+	// clock tells the current time.
+	clock      Clock
 	metrics    *cacheMetrics
 	labelsFunc GetLvsFunc[T]
 	janitor    *janitor[T]
@@ -84,6 +91,8 @@ func New[T any](capacity int, keyFunc KeyFunc[T], opts ...Options[T]) (*Cache[T]
 		items:      make([]*item[T], 0, capacity),
 		sorted:     true,
 		capacity:   capacity,
+		retention:  opt.retention,
+		clock:      opt.clock,
 		labelsFunc: opt.labelsFunc,
 		janitor: &janitor[T]{
 			interval: opt.interval,
@@ -115,6 +124,9 @@ func makeOptions[T any](opts ...Options[T]) (*storeOptions[T], error) {
 	if opt.interval <= 0 {
 		opt.interval = defaultInterval
 	}
+	if opt.clock == nil {
+		opt.clock = realClock{}
+	}
 	return &opt, nil
 }
 
@@ -131,7 +143,9 @@ func (c *Cache[T]) Close() error {
 }
 
 // Set an item in the cache, existing index will be overwritten.
-// If the cache is full, Add will return an error.
+// If the cache is full, the expired and deleted items are removed first,
+// including the ones retained by WithExpiredRetention. If it is still
+// full, Set returns ErrCacheFull.
 func (c *Cache[T]) Set(object T) error {
 	key, err := c.keyFunc(object)
 	if err != nil {
@@ -153,6 +167,9 @@ func (c *Cache[T]) Set(object T) error {
 		return nil
 	}
 
+	if c.capacity > 0 && len(c.index) >= c.capacity {
+		c.evictExpired(c.clock.Now())
+	}
 	if c.capacity > 0 && len(c.index) < c.capacity {
 		c.set(key, object)
 		c.mu.Unlock()
@@ -169,7 +186,7 @@ func (c *cache[T]) set(key string, object T) {
 	item := item[T]{
 		key:       key,
 		object:    object,
-		expiresAt: time.Now().Add(noExpiration),
+		expiresAt: c.clock.Now().Add(noExpiration),
 	}
 
 	if _, found := c.index[key]; found {
@@ -181,6 +198,22 @@ func (c *cache[T]) set(key string, object T) {
 	c.items = append(c.items, &item)
 }
 
+// evictExpired removes the items expired before t or deleted, without
+// waiting for the cleanup. It must be called with the lock held.
+func (c *cache[T]) evictExpired(t time.Time) {
+	for key, item := range c.index {
+		if item.deleted || item.expiresAt.Compare(t) < 0 {
+			delete(c.index, key)
+			recordEviction(c.metrics)
+			recordDecrement(c.metrics)
+		}
+	}
+	c.items = slices.DeleteFunc(c.items, func(item *item[T]) bool {
+		_, found := c.index[item.key]
+		return !found
+	})
+}
+
 // Get an item from the cache. Returns the item or nil, and a bool indicating
 // whether the key was found.
 func (c *Cache[T]) Get(object T) (item T, exists bool, err error) {
@@ -241,7 +274,7 @@ func (c *cache[T]) get(key string) (T, bool, error) {
 		return res, false, nil
 	}
 	if !item.expiresAt.IsZero() {
-		if item.expiresAt.Compare(time.Now()) < 0 {
+		if item.expiresAt.Compare(c.clock.Now()) < 0 {
 			c.mu.RUnlock()
 			recordRequest(c.metrics, StatusSuccess)
 			return res, false, nil
@@ -252,6 +285,53 @@ func (c *cache[T]) get(key string) (T, bool, error) {
 	return item.object, true, nil
 }
 
+// PeekByKey returns the object for the given key and its expiration time,
+// including when the object has expired but has not been removed by the
+// cleanup yet, see WithExpiredRetention. Deleted objects are not returned.
+// Unlike GetByKey, it does not record a cache hit or miss.
+func (c *Cache[T]) PeekByKey(key string) (item T, expiresAt time.Time, exists bool, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		recordRequest(c.metrics, StatusFailure)
+		return item, expiresAt, false, ErrCacheClosed
+	}
+	recordRequest(c.metrics, StatusSuccess)
+	i, found := c.index[key]
+	if !found || i.deleted {
+		return item, expiresAt, false, nil
+	}
+	return i.object, i.expiresAt, true, nil
+}
+
+// DeleteIfExpired removes the object stored under key if it expired
+// before t or was deleted, and reports whether it did. Unlike Delete, the
+// object is removed right away instead of at the next cleanup. The check
+// and the removal are atomic, so an object set again concurrently is kept.
+func (c *Cache[T]) DeleteIfExpired(key string, t time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		recordRequest(c.metrics, StatusFailure)
+		return false, ErrCacheClosed
+	}
+	recordRequest(c.metrics, StatusSuccess)
+	i, found := c.index[key]
+	if !found {
+		return false, nil
+	}
+	if !i.deleted && (i.expiresAt.IsZero() || i.expiresAt.Compare(t) >= 0) {
+		return false, nil
+	}
+	delete(c.index, key)
+	if k := slices.Index(c.items, i); k >= 0 {
+		c.items = slices.Delete(c.items, k, k+1)
+	}
+	recordEviction(c.metrics)
+	recordDecrement(c.metrics)
+	return true, nil
+}
+
 // Delete an item from the cache. Does nothing if the key is not in the cache.
 // It actually sets the item expiration to `now“, so that it will be deleted at
 // the cleanup.
@@ -270,7 +350,8 @@ func (c *Cache[T]) Delete(object T) error {
 	if item, ok := c.index[key]; ok {
 		// set the item expiration to now
 		// so that it will be removed by the janitor
-		item.expiresAt = time.Now()
+		item.expiresAt = c.clock.Now()
+		item.deleted = true
 	}
 	c.mu.Unlock()
 	recordRequest(c.metrics, StatusSuccess)
@@ -375,7 +456,7 @@ func (c *Cache[T]) HasExpired(object T) (bool, error) {
 		return true, nil
 	}
 
-	if item.expiresAt.Compare(time.Now()) < 0 {
+	if item.expiresAt.Compare(c.clock.Now()) < 0 {
 		c.mu.RUnlock()
 		recordRequest(c.metrics, StatusSuccess)
 		return true, nil
@@ -414,6 +495,11 @@ func (c *Cache[T]) SetExpiration(object T, expiration time.Time) error {
 	return nil
 }
 
+// Clock returns the clock telling the cache the current time.
+func (c *Cache[T]) Clock() Clock {
+	return c.clock
+}
+
 // GetExpiration returns the expiration for the given key.
 // Returns zero if the key is not in the cache or the item
 // has already expired.
@@ -436,7 +522,7 @@ func (c *Cache[T]) GetExpiration(object T) (time.Time, error) {
 		return time.Time{}, ErrNotFound
 	}
 	if !item.expiresAt.IsZero() {
-		if item.expiresAt.Compare(time.Now()) < 0 {
+		if item.expiresAt.Compare(c.clock.Now()) < 0 {
 			c.mu.RUnlock()
 			recordRequest(c.metrics, StatusSuccess)
 			return time.Time{}, nil
@@ -464,7 +550,7 @@ func (c *cache[T]) deleteExpired() {
 		c.sorted = true
 	}
 
-	t := time.Now()
+	t := c.clock.Now().Add(-c.retention)
 	index := sort.Search(len(c.items), func(i int) bool {
 		// smallest index with an expiration greater than t
 		return c.items[i].expiresAt.Compare(t) > 0
@@ -473,6 +473,191 @@ func Test_Cache_deleteExpired(t *testing.T) {
 	}
 }
 
+func Test_Cache_PeekByKey(t *testing.T) {
+	g := NewWithT(t)
+	cache, err := New[StoreObject[string]](5, StoreObjectKeyFunc,
+		WithCleanupInterval[StoreObject[string]](1*time.Hour),
+		WithExpiredRetention[StoreObject[string]](1*time.Minute))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	expired := StoreObject[string]{Object: "expired-token", Key: "expired"}
+	deleted := StoreObject[string]{Object: "deleted-token", Key: "deleted"}
+	old := StoreObject[string]{Object: "old-token", Key: "old"}
+	for _, obj := range []StoreObject[string]{expired, deleted, old} {
+		g.Expect(cache.Set(obj)).To(Succeed())
+	}
+	expiresAt := time.Now().Add(-1 * time.Second)
+	g.Expect(cache.SetExpiration(expired, expiresAt)).To(Succeed())
+	g.Expect(cache.SetExpiration(old, time.Now().Add(-1*time.Hour))).To(Succeed())
+	g.Expect(cache.Delete(deleted)).To(Succeed())
+	cache.deleteExpired()
+
+	_, found, err := cache.GetByKey("expired")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(found).To(BeFalse())
+
+	// the expired item is retained
+	item, itemExpiresAt, found, err := cache.PeekByKey("expired")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(found).To(BeTrue())
+	g.Expect(item).To(Equal(expired))
+	g.Expect(itemExpiresAt).To(Equal(expiresAt))
+
+	// the deleted item is not returned
+	_, _, found, err = cache.PeekByKey("deleted")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(found).To(BeFalse())
+
+	// the item expired before the retention was removed
+	_, _, found, err = cache.PeekByKey("old")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(found).To(BeFalse())
+
+	_, _, found, err = cache.PeekByKey("missing")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(found).To(BeFalse())
+
+	_, err = New[StoreObject[string]](5, StoreObjectKeyFunc,
+		WithExpiredRetention[StoreObject[string]](-1*time.Minute))
+	g.Expect(err).To(HaveOccurred())
+}
+
+func Test_Cache_SetFullWithExpiredRetention(t *testing.T) {
+	g := NewWithT(t)
+	cache, err := New[StoreObject[string]](2, StoreObjectKeyFunc,
+		WithCleanupInterval[StoreObject[string]](1*time.Hour),
+		WithExpiredRetention[StoreObject[string]](1*time.Hour))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	expired := StoreObject[string]{Object: "expired-token", Key: "expired"}
+	valid := StoreObject[string]{Object: "valid-token", Key: "valid"}
+	for _, obj := range []StoreObject[string]{expired, valid} {
+		g.Expect(cache.Set(obj)).To(Succeed())
+	}
+	g.Expect(cache.SetExpiration(expired, time.Now().Add(-1*time.Second))).To(Succeed())
+	cache.deleteExpired()
+
+	// the retained item is removed to make room
+	g.Expect(cache.Set(StoreObject[string]{Object: "a", Key: "a"})).To(Succeed())
+	_, _, found, err := cache.PeekByKey("expired")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(found).To(BeFalse())
+
+	// so is the deleted one
+	g.Expect(cache.Delete(valid)).To(Succeed())
+	g.Expect(cache.Set(StoreObject[string]{Object: "b", Key: "b"})).To(Succeed())
+	keys, err := cache.ListKeys()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(keys).To(ConsistOf("a", "b"))
+	g.Expect(cache.items).To(HaveLen(2))
+
+	// the items which have not expired are kept
+	g.Expect(cache.Set(StoreObject[string]{Object: "c", Key: "c"})).To(MatchError(ErrCacheFull))
+}
+
+func Test_Cache_DeleteIfExpired(t *testing.T) {
+	g := NewWithT(t)
+	cache, err := New[StoreObject[string]](3, StoreObjectKeyFunc,
+		WithCleanupInterval[StoreObject[string]](1*time.Hour))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	now := time.Now()
+	expired := StoreObject[string]{Object: "expired-token", Key: "expired"}
+	valid := StoreObject[string]{Object: "valid-token", Key: "valid"}
+	deleted := StoreObject[string]{Object: "deleted-token", Key: "deleted"}
+	for _, obj := range []StoreObject[string]{expired, valid, deleted} {
+		g.Expect(cache.Set(obj)).To(Succeed())
+	}
+	g.Expect(cache.SetExpiration(expired, now.Add(-1*time.Second))).To(Succeed())
+	g.Expect(cache.SetExpiration(valid, now.Add(1*time.Hour))).To(Succeed())
+	g.Expect(cache.Delete(deleted)).To(Succeed())
+
+	for key, want := range map[string]bool{"expired": true, "valid": false, "deleted": true, "missing": false} {
+		removed, err := cache.DeleteIfExpired(key, now)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(removed).To(Equal(want), "unexpected removal of %s", key)
+	}
+	keys, err := cache.ListKeys()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(keys).To(ConsistOf("valid"))
+	g.Expect(cache.items).To(HaveLen(1))
+
+	// the space is reclaimed without waiting for the cleanup
+	g.Expect(cache.Set(StoreObject[string]{Object: "a", Key: "a"})).To(Succeed())
+	g.Expect(cache.Set(StoreObject[string]{Object: "b", Key: "b"})).To(Succeed())
+
+	// the expiration is checked against the given time
+	removed, err := cache.DeleteIfExpired("valid", now.Add(2*time.Hour))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(removed).To(BeTrue())
+}
+
+// fakeClock is a Clock whose time is set by the tests.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+func Test_Cache_WithClock(t *testing.T) {
+	g := NewWithT(t)
+	start := time.Now()
+	clock := &fakeClock{now: start}
+	cache, err := New[StoreObject[string]](2, StoreObjectKeyFunc,
+		WithCleanupInterval[StoreObject[string]](1*time.Hour),
+		WithClock[StoreObject[string]](clock))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(cache.Clock()).To(Equal(clock))
+
+	obj := StoreObject[string]{Object: "token", Key: "key"}
+	g.Expect(cache.Set(obj)).To(Succeed())
+	expiresAt := start.Add(1 * time.Minute)
+	g.Expect(cache.SetExpiration(obj, expiresAt)).To(Succeed())
+
+	// the item expires after its expiration time
+	for _, tt := range []struct {
+		now     time.Time
+		expired bool
+	}{
+		{now: expiresAt.Add(-1 * time.Nanosecond), expired: false},
+		{now: expiresAt, expired: false},
+		{now: expiresAt.Add(1 * time.Nanosecond), expired: true},
+	} {
+		clock.Set(tt.now)
+		expired, err := cache.HasExpired(obj)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(expired).To(Equal(tt.expired), "at %s", tt.now)
+		_, found, err := cache.Get(obj)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(found).To(Equal(!tt.expired), "at %s", tt.now)
+	}
+
+	// the cleanup removes it
+	cache.deleteExpired()
+	_, _, found, err := cache.PeekByKey("key")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(found).To(BeFalse())
+
+	// a deleted item expires at the current time of the clock
+	g.Expect(cache.Set(obj)).To(Succeed())
+	g.Expect(cache.Delete(obj)).To(Succeed())
+	g.Expect(cache.items[len(cache.items)-1].expiresAt).To(Equal(clock.Now()))
+
+	_, err = New[StoreObject[string]](2, StoreObjectKeyFunc, WithClock[StoreObject[string]](nil))
+	g.Expect(err).To(HaveOccurred())
+}
+
 func Test_Cache_Resize(t *testing.T) {
 	n := 100
 	g := NewWithT(t)
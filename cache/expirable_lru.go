@@ -0,0 +1,287 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// ExpirableLRU bounds the number of entries of an Expirable store by
+// evicting the least recently used ones. Entries still expire as
+// configured in the underlying store.
+//
+// Setting or getting an object marks it as the most recently used. When
+// a Set of a new entry would exceed the capacity, the expired entries are
+// removed first, and then the least recently used ones. They are removed
+// from the underlying store right away if it implements DeleteIfExpired,
+// like Cache, so that a store of the same capacity does not fill up
+// before its cleanup.
+//
+// ExpirableLRU implements Expirable, so it can be used in place of the
+// store it wraps. All methods are safe for concurrent use.
+type ExpirableLRU[T any] struct {
+	Expirable[T]
+	keyFunc  KeyFunc[T]
+	capacity int
+
+	// order holds the lruEntry values, the most recently used at the
+	// front.
+	order    *list.List
+	elements map[string]*list.Element
+	mu       sync.Mutex
+}
+
+var _ Expirable[any] = &ExpirableLRU[any]{}
+
+// lruEntry is an object tracked by ExpirableLRU with its key.
+type lruEntry[T any] struct {
+	key    string
+	object T
+}
+
+// NewExpirableLRU wraps store to hold at most capacity entries, whose
+// keys are made by keyFunc. The capacity must be greater than zero.
+func NewExpirableLRU[T any](store Expirable[T], capacity int, keyFunc KeyFunc[T]) (*ExpirableLRU[T], error) {
+	if capacity <= 0 {
+		return nil, ErrInvalidSize
+	}
+	return &ExpirableLRU[T]{
+		Expirable: store,
+		keyFunc:   keyFunc,
+		capacity:  capacity,
+		order:     list.New(),
+		elements:  make(map[string]*list.Element),
+	}, nil
+}
+
+// Set adds the object to the store as the most recently used one, after
+// making room for it at the capacity.
+func (c *ExpirableLRU[T]) Set(object T) error {
+	key, err := c.keyFunc(object)
+	if err != nil {
+		return &CacheError{Reason: ErrInvalidKey, Err: err}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.elements[key]; !ok && c.order.Len() >= c.capacity {
+		if err := c.makeRoom(); err != nil {
+			return err
+		}
+	}
+	if err := c.Expirable.Set(object); err != nil {
+		return err
+	}
+	c.touch(key, object)
+	return nil
+}
+
+// Get returns the object from the store, and marks it as the most
+// recently used if it exists.
+func (c *ExpirableLRU[T]) Get(object T) (T, bool, error) {
+	item, exists, err := c.Expirable.Get(object)
+	if err != nil {
+		return item, exists, err
+	}
+	key, err := c.keyFunc(object)
+	if err != nil {
+		return item, exists, &CacheError{Reason: ErrInvalidKey, Err: err}
+	}
+	c.access(key, item, exists)
+	return item, exists, nil
+}
+
+// GetByKey returns the object stored under key, and marks it as the
+// most recently used if it exists.
+func (c *ExpirableLRU[T]) GetByKey(key string) (T, bool, error) {
+	item, exists, err := c.Expirable.GetByKey(key)
+	if err != nil {
+		return item, exists, err
+	}
+	c.access(key, item, exists)
+	return item, exists, nil
+}
+
+// Delete deletes the object from the store.
+func (c *ExpirableLRU[T]) Delete(object T) error {
+	if err := c.Expirable.Delete(object); err != nil {
+		return err
+	}
+	key, err := c.keyFunc(object)
+	if err != nil {
+		return &CacheError{Reason: ErrInvalidKey, Err: err}
+	}
+	c.mu.Lock()
+	if e, ok := c.elements[key]; ok {
+		c.remove(e)
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// PeekByKey returns the object stored under key and its expiration time,
+// including when it has expired, if the underlying store supports it like
+// Cache. Otherwise, only the objects which have not expired are returned.
+// It does not mark the object as the most recently used.
+func (c *ExpirableLRU[T]) PeekByKey(key string) (item T, expiresAt time.Time, exists bool, err error) {
+	if p, ok := c.Expirable.(expiredPeeker[T]); ok {
+		return p.PeekByKey(key)
+	}
+	item, exists, err = c.Expirable.GetByKey(key)
+	if err != nil || !exists {
+		return item, expiresAt, exists, err
+	}
+	expiresAt, err = c.Expirable.GetExpiration(item)
+	return item, expiresAt, err == nil, err
+}
+
+// DeleteIfExpired removes the object stored under key if it expired
+// before t or was deleted, and reports whether it did, if the underlying
+// store supports it like Cache. Otherwise, it reports false.
+func (c *ExpirableLRU[T]) DeleteIfExpired(key string, t time.Time) (bool, error) {
+	d, ok := c.Expirable.(expiredDeleter)
+	if !ok {
+		return false, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed, err := d.DeleteIfExpired(key, t)
+	if err != nil || !removed {
+		return false, err
+	}
+	if e, ok := c.elements[key]; ok {
+		c.remove(e)
+	}
+	return true, nil
+}
+
+// Len returns the number of entries which have not expired.
+func (c *ExpirableLRU[T]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		if expired, err := c.Expirable.HasExpired(e.Value.(lruEntry[T]).object); err != nil || !expired {
+			n++
+		}
+	}
+	return n
+}
+
+// Clock returns the clock of the underlying store, or the system clock if
+// it has none.
+func (c *ExpirableLRU[T]) Clock() Clock {
+	if s, ok := c.Expirable.(clocked); ok {
+		return s.Clock()
+	}
+	return realClock{}
+}
+
+// clocked is implemented by the stores telling the time with a Clock,
+// like Cache.
+type clocked interface {
+	Clock() Clock
+}
+
+// expiredPeeker is implemented by the stores returning their expired
+// entries, like Cache.
+type expiredPeeker[T any] interface {
+	PeekByKey(key string) (item T, expiresAt time.Time, exists bool, err error)
+}
+
+// expiredDeleter is implemented by the stores removing their expired
+// and deleted entries right away, like Cache.
+type expiredDeleter interface {
+	DeleteIfExpired(key string, t time.Time) (bool, error)
+}
+
+// makeRoom removes the expired entries, and then the least recently used
+// ones until there is room for a new entry. It must be called with the
+// lock held.
+func (c *ExpirableLRU[T]) makeRoom() error {
+	for e := c.order.Back(); e != nil; {
+		prev := e.Prev()
+		expired, err := c.Expirable.HasExpired(e.Value.(lruEntry[T]).object)
+		if err != nil {
+			return err
+		}
+		if expired {
+			if err := c.evict(e); err != nil {
+				return err
+			}
+		}
+		e = prev
+	}
+	for c.order.Len() >= c.capacity {
+		if err := c.evict(c.order.Back()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evict deletes the object of the element from the underlying store and
+// forgets it. It must be called with the lock held.
+func (c *ExpirableLRU[T]) evict(e *list.Element) error {
+	entry := e.Value.(lruEntry[T])
+	if err := c.Expirable.Delete(entry.object); err != nil {
+		return err
+	}
+	if d, ok := c.Expirable.(expiredDeleter); ok {
+		// Cache only marks the deleted objects until its cleanup
+		if _, err := d.DeleteIfExpired(entry.key, c.Clock().Now()); err != nil {
+			return err
+		}
+	}
+	c.remove(e)
+	return nil
+}
+
+// access marks the object stored under key as the most recently used,
+// or forgets the key if the object no longer exists, e.g. because it
+// expired.
+func (c *ExpirableLRU[T]) access(key string, object T, exists bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.elements[key]
+	switch {
+	case exists:
+		c.touch(key, object)
+	case ok:
+		c.remove(e)
+	}
+}
+
+// touch moves the object stored under key to the front of the order.
+// It must be called with the lock held.
+func (c *ExpirableLRU[T]) touch(key string, object T) {
+	entry := lruEntry[T]{key: key, object: object}
+	if e, ok := c.elements[key]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return
+	}
+	c.elements[key] = c.order.PushFront(entry)
+}
+
+// remove forgets the element. It must be called with the lock held.
+func (c *ExpirableLRU[T]) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.elements, e.Value.(lruEntry[T]).key)
+}
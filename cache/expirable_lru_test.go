@@ -0,0 +1,196 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func newExpirableLRU(t *testing.T, capacity int) *ExpirableLRU[StoreObject[string]] {
+	t.Helper()
+	g := NewWithT(t)
+	store, err := New(capacity*2, StoreObjectKeyFunc[string],
+		WithCleanupInterval[StoreObject[string]](time.Hour))
+	g.Expect(err).ToNot(HaveOccurred())
+	t.Cleanup(func() { store.Close() })
+
+	lru, err := NewExpirableLRU[StoreObject[string]](store, capacity, StoreObjectKeyFunc[string])
+	g.Expect(err).ToNot(HaveOccurred())
+	return lru
+}
+
+func TestExpirableLRU(t *testing.T) {
+	t.Run("evicts the least recently used entry", func(t *testing.T) {
+		g := NewWithT(t)
+		lru := newExpirableLRU(t, 3)
+
+		for i := 0; i < 3; i++ {
+			err := lru.Set(StoreObject[string]{Object: fmt.Sprintf("v%d", i), Key: fmt.Sprintf("k%d", i)})
+			g.Expect(err).ToNot(HaveOccurred())
+		}
+
+		// use k0 so that k1 becomes the least recently used
+		_, found, err := lru.GetByKey("k0")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(found).To(BeTrue())
+
+		err = lru.Set(StoreObject[string]{Object: "v3", Key: "k3"})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(lru.Len()).To(Equal(3))
+
+		_, found, err = lru.GetByKey("k1")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(found).To(BeFalse())
+		for _, key := range []string{"k0", "k2", "k3"} {
+			_, found, err := lru.GetByKey(key)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(found).To(BeTrue(), key)
+		}
+	})
+
+	t.Run("updating an entry does not evict", func(t *testing.T) {
+		g := NewWithT(t)
+		lru := newExpirableLRU(t, 2)
+
+		g.Expect(lru.Set(StoreObject[string]{Object: "a", Key: "k0"})).To(Succeed())
+		g.Expect(lru.Set(StoreObject[string]{Object: "b", Key: "k1"})).To(Succeed())
+		g.Expect(lru.Set(StoreObject[string]{Object: "c", Key: "k0"})).To(Succeed())
+		g.Expect(lru.Len()).To(Equal(2))
+
+		obj, found, err := lru.Get(StoreObject[string]{Key: "k0"})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(found).To(BeTrue())
+		g.Expect(obj.Object).To(Equal("c"))
+	})
+
+	t.Run("honors expiration", func(t *testing.T) {
+		g := NewWithT(t)
+		lru := newExpirableLRU(t, 2)
+
+		obj := StoreObject[string]{Object: "a", Key: "k0"}
+		g.Expect(lru.Set(obj)).To(Succeed())
+		g.Expect(lru.SetExpiration(obj, time.Now().Add(-time.Second))).To(Succeed())
+
+		_, found, err := lru.GetByKey("k0")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(found).To(BeFalse())
+		g.Expect(lru.Len()).To(Equal(0))
+	})
+
+	t.Run("deletes entries", func(t *testing.T) {
+		g := NewWithT(t)
+		lru := newExpirableLRU(t, 2)
+
+		obj := StoreObject[string]{Object: "a", Key: "k0"}
+		g.Expect(lru.Set(obj)).To(Succeed())
+		g.Expect(lru.Delete(obj)).To(Succeed())
+		g.Expect(lru.Len()).To(Equal(0))
+
+		_, found, err := lru.GetByKey("k0")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(found).To(BeFalse())
+	})
+
+	t.Run("evicts with a store of the same capacity", func(t *testing.T) {
+		g := NewWithT(t)
+		store, err := New(2, StoreObjectKeyFunc[string],
+			WithCleanupInterval[StoreObject[string]](time.Hour))
+		g.Expect(err).ToNot(HaveOccurred())
+		t.Cleanup(func() { store.Close() })
+		lru, err := NewExpirableLRU[StoreObject[string]](store, 2, StoreObjectKeyFunc[string])
+		g.Expect(err).ToNot(HaveOccurred())
+
+		for i := 0; i < 5; i++ {
+			err := lru.Set(StoreObject[string]{Object: fmt.Sprintf("v%d", i), Key: fmt.Sprintf("k%d", i)})
+			g.Expect(err).ToNot(HaveOccurred())
+		}
+		g.Expect(lru.Len()).To(Equal(2))
+		keys, err := store.ListKeys()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(keys).To(ConsistOf("k3", "k4"))
+	})
+
+	t.Run("removes the expired entries before evicting", func(t *testing.T) {
+		g := NewWithT(t)
+		lru := newExpirableLRU(t, 2)
+
+		g.Expect(lru.Set(StoreObject[string]{Object: "a", Key: "k0"})).To(Succeed())
+		expired := StoreObject[string]{Object: "b", Key: "k1"}
+		g.Expect(lru.Set(expired)).To(Succeed())
+		g.Expect(lru.SetExpiration(expired, time.Now().Add(-time.Second))).To(Succeed())
+		g.Expect(lru.Len()).To(Equal(1))
+
+		g.Expect(lru.Set(StoreObject[string]{Object: "c", Key: "k2"})).To(Succeed())
+		g.Expect(lru.Len()).To(Equal(2))
+		for _, key := range []string{"k0", "k2"} {
+			_, found, err := lru.GetByKey(key)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(found).To(BeTrue(), key)
+		}
+	})
+
+	t.Run("peeks and deletes expired entries", func(t *testing.T) {
+		g := NewWithT(t)
+		lru := newExpirableLRU(t, 2)
+
+		obj := StoreObject[string]{Object: "a", Key: "k0"}
+		g.Expect(lru.Set(obj)).To(Succeed())
+		expiresAt := time.Now().Add(-time.Second)
+		g.Expect(lru.SetExpiration(obj, expiresAt)).To(Succeed())
+
+		item, gotExpiresAt, exists, err := lru.PeekByKey("k0")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(exists).To(BeTrue())
+		g.Expect(item.Object).To(Equal("a"))
+		g.Expect(gotExpiresAt).To(Equal(expiresAt))
+
+		removed, err := lru.DeleteIfExpired("k0", time.Now())
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(removed).To(BeTrue())
+		_, _, exists, err = lru.PeekByKey("k0")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(exists).To(BeFalse())
+		g.Expect(lru.Len()).To(Equal(0))
+	})
+
+	t.Run("tells the time with the clock of the store", func(t *testing.T) {
+		g := NewWithT(t)
+		clock := &fakeClock{now: time.Now()}
+		store, err := New(2, StoreObjectKeyFunc[string], WithClock[StoreObject[string]](clock))
+		g.Expect(err).ToNot(HaveOccurred())
+		t.Cleanup(func() { store.Close() })
+		lru, err := NewExpirableLRU[StoreObject[string]](store, 2, StoreObjectKeyFunc[string])
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(lru.Clock()).To(Equal(clock))
+
+		obj := StoreObject[string]{Object: "a", Key: "k0"}
+		g.Expect(lru.Set(obj)).To(Succeed())
+		g.Expect(lru.SetExpiration(obj, clock.Now().Add(time.Minute))).To(Succeed())
+		clock.Set(clock.Now().Add(time.Minute + time.Nanosecond))
+		g.Expect(lru.Len()).To(Equal(0))
+	})
+
+	t.Run("rejects an invalid capacity", func(t *testing.T) {
+		g := NewWithT(t)
+		_, err := NewExpirableLRU[StoreObject[string]](nil, 0, StoreObjectKeyFunc[string])
+		g.Expect(err).To(MatchError(ErrInvalidSize))
+	})
+}
@@ -57,11 +57,23 @@ type Expirable[T any] interface {
 
 type storeOptions[T any] struct {
 	interval    time.Duration
+	retention   time.Duration
 	registerer  prometheus.Registerer
 	extraLabels []string
 	labelsFunc  GetLvsFunc[T]
+	clock       Clock
 }
 
+// Clock tells the current time to a cache store.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the Clock telling the system time.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
 // Options is a function that sets the store options.
 type Options[T any] func(*storeOptions[T]) error
 
@@ -85,6 +97,32 @@ func WithCleanupInterval[T any](interval time.Duration) Options[T] {
 	}
 }
 
+// WithExpiredRetention keeps the expired items for the given duration
+// after their expiration before the cleanup removes them, so that they
+// can still be retrieved with PeekByKey. They are removed earlier to make
+// room for a new item when the cache is full.
+func WithExpiredRetention[T any](retention time.Duration) Options[T] {
+	return func(o *storeOptions[T]) error {
+		if retention < 0 {
+			return fmt.Errorf("retention must not be negative")
+		}
+		o.retention = retention
+		return nil
+	}
+}
+
+// WithClock sets the clock telling the cache the current time, which
+// defaults to the system time. It allows tests to control the expiration.
+func WithClock[T any](clock Clock) Options[T] {
+	return func(o *storeOptions[T]) error {
+		if clock == nil {
+			return fmt.Errorf("clock must not be nil")
+		}
+		o.clock = clock
+		return nil
+	}
+}
+
 // WithMetricsRegisterer sets the Prometheus registerer for the cache metrics.
 func WithMetricsRegisterer[T any](r prometheus.Registerer) Options[T] {
 	return func(o *storeOptions[T]) error {
@@ -132,6 +170,23 @@ type StoreObject[T any] struct {
 	Key string
 }
 
+// Cloner is implemented by objects that can make a deep copy of
+// themselves.
+type Cloner[T any] interface {
+	// Clone returns a deep copy of the object.
+	Clone() T
+}
+
+// Clone returns a copy of the StoreObject that can be modified without
+// affecting the original. The Object is deep-copied if it implements
+// Cloner[T], and shallow-copied otherwise.
+func (o StoreObject[T]) Clone() StoreObject[T] {
+	if c, ok := any(o.Object).(Cloner[T]); ok {
+		return StoreObject[T]{Object: c.Clone(), Key: o.Key}
+	}
+	return StoreObject[T]{Object: o.Object, Key: o.Key}
+}
+
 // StoreObjectKeyFunc returns the key for a StoreObject.
 func StoreObjectKeyFunc[T any](object StoreObject[T]) (string, error) {
 	return object.Key, nil
@@ -0,0 +1,107 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+type token struct {
+	value string
+}
+
+type cloneableToken struct {
+	value string
+}
+
+func (t *cloneableToken) Clone() *cloneableToken {
+	c := *t
+	return &c
+}
+
+func TestStoreObject_Clone(t *testing.T) {
+	t.Run("deep copies a Cloner", func(t *testing.T) {
+		g := NewWithT(t)
+		obj := StoreObject[*cloneableToken]{Object: &cloneableToken{value: "a"}, Key: "key"}
+
+		clone := obj.Clone()
+		g.Expect(clone.Key).To(Equal("key"))
+		g.Expect(clone.Object).To(Equal(obj.Object))
+		g.Expect(clone.Object).ToNot(BeIdenticalTo(obj.Object))
+
+		clone.Object.value = "b"
+		g.Expect(obj.Object.value).To(Equal("a"))
+	})
+
+	t.Run("shallow copies other objects", func(t *testing.T) {
+		g := NewWithT(t)
+		obj := StoreObject[*token]{Object: &token{value: "a"}, Key: "key"}
+
+		clone := obj.Clone()
+		g.Expect(clone.Key).To(Equal("key"))
+		g.Expect(clone.Object).To(BeIdenticalTo(obj.Object))
+	})
+}
+
+func TestStoreObject_Clone_Concurrent(t *testing.T) {
+	const concurrency = 50
+	g := NewWithT(t)
+	cache, err := New(10, StoreObjectKeyFunc[*cloneableToken],
+		WithCleanupInterval[StoreObject[*cloneableToken]](1*time.Second))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	err = cache.Set(StoreObject[*cloneableToken]{Object: &cloneableToken{value: "a"}, Key: "key"})
+	g.Expect(err).ToNot(HaveOccurred())
+
+	wg := sync.WaitGroup{}
+	run := make(chan bool)
+	errs := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-run
+			obj, found, err := cache.GetByKey("key")
+			if err != nil || !found {
+				errs <- fmt.Errorf("object not found: %v", err)
+				return
+			}
+			clone := obj.Clone()
+			if clone.Object.value != "a" {
+				errs <- fmt.Errorf("unexpected value %q", clone.Object.value)
+				return
+			}
+			clone.Object.value = fmt.Sprintf("modified-%d", i)
+		}()
+	}
+	close(run)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	obj, found, err := cache.GetByKey("key")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(found).To(BeTrue())
+	g.Expect(obj.Object.value).To(Equal("a"))
+}
@@ -23,6 +23,8 @@ package envsubst
 import (
 	"errors"
 	"testing"
+
+	"github.com/fluxcd/pkg/envsubst/parse"
 )
 
 // test cases sourced from tldp.org
@@ -58,6 +60,37 @@ func TestExpand(t *testing.T) {
 			input:  "${var01^^}",
 			output: "ABCDEFGH28IJ",
 		},
+		// transformations
+		{
+			params: map[string]string{"var01": "it's"},
+			input:  "${var01@Q}",
+			output: `'it'\''s'`,
+		},
+		{
+			params: map[string]string{"var01": "abcdEFGH28ij"},
+			input:  "${var01@U}",
+			output: "ABCDEFGH28IJ",
+		},
+		{
+			params: map[string]string{"var01": "abcdEFGH28ij"},
+			input:  "${var01@u}",
+			output: "AbcdEFGH28ij",
+		},
+		{
+			params: map[string]string{"var01": "ABCDEFGH28IJ"},
+			input:  "${var01@L}",
+			output: "abcdefgh28ij",
+		},
+		{
+			params: map[string]string{"var01": `a\tb`},
+			input:  "${var01@E}",
+			output: "a\tb",
+		},
+		{
+			params: map[string]string{"var01": "abc"},
+			input:  "${var01@A}",
+			output: "var01='abc'",
+		},
 		// lowercase first
 		{
 			params: map[string]string{"var01": "ABCDEFGH28IJ"},
@@ -70,6 +103,18 @@ func TestExpand(t *testing.T) {
 			input:  "${var01,,}",
 			output: "abcdefgh28ij",
 		},
+		// uppercase matching pattern
+		{
+			params: map[string]string{"var01": "abcdEFGH28ij"},
+			input:  "${var01^^[a-c]}",
+			output: "ABCdEFGH28ij",
+		},
+		// lowercase matching pattern
+		{
+			params: map[string]string{"var01": "ABCDEFGH28IJ"},
+			input:  "${var01,,[A-Z]}",
+			output: "abcdefgh28ij",
+		},
 		// substring with position
 		{
 			params: map[string]string{"path_name": "/home/bozo/ideas/thoughts.for.today"},
@@ -82,6 +127,18 @@ func TestExpand(t *testing.T) {
 			input:  "${path_name:11:5}",
 			output: "ideas",
 		},
+		// substring with negative length
+		{
+			params: map[string]string{"path_name": "/home/bozo/ideas/thoughts.for.today"},
+			input:  "${path_name:11:-10}",
+			output: "ideas/thoughts",
+		},
+		// substring with negative offset
+		{
+			params: map[string]string{"path_name": "/home/bozo/ideas/thoughts.for.today"},
+			input:  "${path_name: -5:3}",
+			output: "tod",
+		},
 		// default not used
 		{
 			params: map[string]string{"var": "abc"},
@@ -114,6 +171,65 @@ func TestExpand(t *testing.T) {
 			input:  "${var:=xyz}",
 			output: "xyz",
 		},
+		// default with escaped closing brace
+		{
+			params: map[string]string{},
+			input:  `${FOO:-a\}b}`,
+			output: "a}b",
+		},
+		{
+			params: map[string]string{},
+			input:  `${FOO:-a}b}`,
+			output: "ab}",
+		},
+		// default ending with a backslash
+		{
+			params: map[string]string{},
+			input:  `${B:-a\}`,
+			output: `a\`,
+		},
+		{
+			params: map[string]string{},
+			input:  `${B:-C:\\}`,
+			output: `C:\\`,
+		},
+		{
+			params: map[string]string{},
+			input:  `${B:=\\}x`,
+			output: `\\x`,
+		},
+		{
+			params: map[string]string{},
+			input:  `${B:-\\}`,
+			output: `\\`,
+		},
+		// empty default words
+		{
+			params: map[string]string{},
+			input:  "a${FOO:-}b",
+			output: "ab",
+		},
+		{
+			params: map[string]string{},
+			input:  "a${FOO:=}b",
+			output: "ab",
+		},
+		{
+			params: map[string]string{"FOO": "foo"},
+			input:  "${FOO:-}",
+			output: "foo",
+		},
+		// escaped dollar sign in default and replace words
+		{
+			params: map[string]string{"HOME": "/root"},
+			input:  `${FOO:-\$HOME}`,
+			output: "$HOME",
+		},
+		{
+			params: map[string]string{"FOO": "~/bin"},
+			input:  `${FOO/~/\$HOME}`,
+			output: "$HOME/bin",
+		},
 		// replace suffix
 		{
 			params: map[string]string{"stringZ": "abcABC123ABCabc"},
@@ -126,6 +242,24 @@ func TestExpand(t *testing.T) {
 			input:  "${stringZ/#abc/XYZ}",
 			output: "XYZABC123ABCabc",
 		},
+		// replace anchored prefix only
+		{
+			params: map[string]string{"PATH": "/usr/bin:/usr/local/bin"},
+			input:  `${PATH/#\/usr/\/opt}`,
+			output: "/opt/bin:/usr/local/bin",
+		},
+		// insert at the start or end with an anchored empty pattern
+		{
+			params: map[string]string{"stringZ": "abc"},
+			input:  "${stringZ/#/x}${stringZ/%/y}",
+			output: "xabcabcy",
+		},
+		// replace a pattern starting with the anchor character
+		{
+			params: map[string]string{"stringZ": "a#b#c"},
+			input:  "${stringZ//#/-}",
+			output: "a-b-c",
+		},
 		// replace all
 		{
 			params: map[string]string{"stringZ": "abcABC123ABCabc"},
@@ -183,6 +317,24 @@ func TestExpand(t *testing.T) {
 			output: "bash",
 		},
 
+		// positional parameters
+		{
+			params: map[string]string{"#": "2", "1": "foo", "2": "bar"},
+			input:  "${#}: ${1} ${2} ${3:-baz}",
+			output: "2: foo bar baz",
+		},
+		// indirect
+		{
+			params: map[string]string{"ptr": "var01", "var01": "abcdEFGH28ij"},
+			input:  "${!ptr}",
+			output: "abcdEFGH28ij",
+		},
+		// name listing, the mapping cannot list the names
+		{
+			params: map[string]string{"var01": "abcdEFGH28ij"},
+			input:  "[${!var*}]",
+			output: "[]",
+		},
 		// nested parameters
 		{
 			params: map[string]string{"var01": "abcdEFGH28ij"},
@@ -228,6 +380,48 @@ func TestExpand(t *testing.T) {
 			input:  `${stringZ/./}`,
 			output: "foobar",
 		},
+		// nested substitutions in remove patterns
+		{
+			params: map[string]string{"FILE": "/srv/app/config.yaml", "DIR": "/srv/app", "EXT": "yaml"},
+			input:  "${FILE##${DIR}/} ${FILE%.${EXT}}",
+			output: "config.yaml /srv/app/config",
+		},
+		// arithmetic expansion is not evaluated
+		{
+			params: map[string]string{"a": "1"},
+			input:  "${a} $((a + 1))",
+			output: "1 $((a + 1))",
+		},
+		// references in arithmetic expansions are expanded
+		{
+			params: map[string]string{"N": "41"},
+			input:  "$(( ${N} + 1 ))",
+			output: "$(( 41 + 1 ))",
+		},
+		// arithmetic expansions which are not closed are text
+		{
+			params: map[string]string{"N": "41"},
+			input:  "$((${N} + 1",
+			output: "$((41 + 1",
+		},
+		// command substitution is not run
+		{
+			params: map[string]string{"a": "1"},
+			input:  "${a} $(POD_NAME) ${b:-$(a)}",
+			output: "1 $(POD_NAME) $(a)",
+		},
+		// references in command substitutions are expanded
+		{
+			params: map[string]string{"NAME": "flux"},
+			input:  "echo $(echo ${NAME})",
+			output: "echo $(echo flux)",
+		},
+		// command substitutions which are not closed are text
+		{
+			params: map[string]string{},
+			input:  "price $(5",
+			output: "price $(5",
+		},
 	}
 
 	for _, expr := range expressions {
@@ -285,6 +479,13 @@ func TestExpandStrict(t *testing.T) {
 			output:  "",
 			wantErr: errVarNotSet,
 		},
+		// indirect missing
+		{
+			params:  map[string]string{"ptr": "missing"},
+			input:   "${!ptr}",
+			output:  "",
+			wantErr: errVarNotSet,
+		},
 		// missing but has default
 		{
 			params:  map[string]string{"foo": "bar"},
@@ -316,3 +517,20 @@ func TestExpandStrict(t *testing.T) {
 		})
 	}
 }
+
+func TestExecute_Comment(t *testing.T) {
+	tree, err := parse.ParseWithOptions("a${// note}b${foo}", parse.ParseOptions{CommentPrefix: "//"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &Template{tree: tree}
+	output, err := tmpl.Execute(func(s string) (string, bool) {
+		return "c", s == "foo"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "abc" {
+		t.Errorf("Want comment expanded to nothing, got %q", output)
+	}
+}
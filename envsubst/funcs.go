@@ -24,8 +24,8 @@ import (
 	"strconv"
 	"strings"
 	"unicode"
-	"unicode/utf8"
 
+	"github.com/fluxcd/pkg/envsubst/internal/shell"
 	"github.com/fluxcd/pkg/envsubst/path"
 )
 
@@ -38,35 +38,60 @@ func toLen(s string, args ...string) string {
 }
 
 // toLower returns a copy of the string s with all characters
-// mapped to their lower case.
+// mapped to their lower case. If a pattern is given, only the
+// characters matching the pattern are mapped.
 func toLower(s string, args ...string) string {
-	return strings.ToLower(s)
+	if len(args) == 0 {
+		return strings.ToLower(s)
+	}
+	return shell.MapRunes(s, args[0], unicode.ToLower, false)
 }
 
 // toUpper returns a copy of the string s with all characters
-// mapped to their upper case.
+// mapped to their upper case. If a pattern is given, only the
+// characters matching the pattern are mapped.
 func toUpper(s string, args ...string) string {
-	return strings.ToUpper(s)
+	if len(args) == 0 {
+		return strings.ToUpper(s)
+	}
+	return shell.MapRunes(s, args[0], unicode.ToUpper, false)
 }
 
 // toLowerFirst returns a copy of the string s with the first
-// character mapped to its lower case.
+// character mapped to its lower case. If a pattern is given, the
+// first character is only mapped if it matches the pattern.
 func toLowerFirst(s string, args ...string) string {
-	if s == "" {
-		return s
-	}
-	r, n := utf8.DecodeRuneInString(s)
-	return string(unicode.ToLower(r)) + s[n:]
+	return shell.MapRunes(s, pattern(args), unicode.ToLower, true)
 }
 
 // toUpperFirst returns a copy of the string s with the first
-// character mapped to its upper case.
+// character mapped to its upper case. If a pattern is given, the
+// first character is only mapped if it matches the pattern.
 func toUpperFirst(s string, args ...string) string {
-	if s == "" {
+	return shell.MapRunes(s, pattern(args), unicode.ToUpper, true)
+}
+
+// pattern returns the pattern of the casing functions, or an empty
+// string matching all characters if none is given.
+func pattern(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+// transform returns a copy of the string s transformed by the bash
+// operator letter in args[0]. The name of the parameter is expected in
+// args[1] for the "A" operator.
+func transform(s string, args ...string) string {
+	if len(args) == 0 || (args[0] == "A" && len(args) < 2) {
 		return s
 	}
-	r, n := utf8.DecodeRuneInString(s)
-	return string(unicode.ToUpper(r)) + s[n:]
+	var name string
+	if len(args) > 1 {
+		name = args[1]
+	}
+	return shell.Transform(name, s, args[0])
 }
 
 // toDefault returns a copy of the string s if not empty, else
@@ -80,59 +105,31 @@ func toDefault(s string, args ...string) string {
 }
 
 // toSubstr returns a slice of the string s at the specified
-// length and position.
+// length and position, counting characters.
 func toSubstr(s string, args ...string) string {
 	if len(args) == 0 {
 		return s // should never happen
 	}
 
-	pos, err := strconv.Atoi(args[0])
+	// a space may be used to separate a negative offset from the
+	// colon, as ${var:-n} is parsed as a default function.
+	pos, err := strconv.Atoi(strings.TrimSpace(args[0]))
 	if err != nil {
 		// bash returns the string if the position
 		// cannot be parsed.
 		return s
 	}
-
-	if pos < 0 {
-		// if pos is negative (counts from the end) add it
-		// to length to get first character offset
-		pos = len(s) + pos
-
-		// if negative offset exceeds the length of the string
-		// start from 0
-		if pos < 0 {
-			pos = 0
-		}
-	}
-
 	if len(args) == 1 {
-		if pos < len(s) {
-			return s[pos:]
-		}
-		// if the position exceeds the length of the
-		// string an empty string is returned
-		return ""
+		return shell.Substring(s, pos)
 	}
 
-	length, err := strconv.Atoi(args[1])
+	length, err := strconv.Atoi(strings.TrimSpace(args[1]))
 	if err != nil {
 		// bash returns the string if the length
 		// cannot be parsed.
 		return s
 	}
-
-	if pos+length >= len(s) {
-		if pos < len(s) {
-			// if the position exceeds the length of the
-			// string just return the rest of it like bash
-			return s[pos:]
-		}
-		// if the position exceeds the length of the
-		// string an empty string is returned
-		return ""
-	}
-
-	return s[pos : pos+length]
+	return shell.Substring(s, pos, length)
 }
 
 // replaceAll returns a copy of the string s with all instances
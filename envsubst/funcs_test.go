@@ -69,6 +69,28 @@ func Test_upperFirst(t *testing.T) {
 	toUpperFirst("")
 }
 
+func Test_casingPattern(t *testing.T) {
+	got, want := toUpper("hello world", "[aeiou]"), "hEllO wOrld"
+	if got != want {
+		t.Errorf("Expect upper function to map matching characters to %s, got %s", want, got)
+	}
+
+	got, want = toLower("HELLO WORLD", "[A-L]"), "hellO WORld"
+	if got != want {
+		t.Errorf("Expect lower function to map matching characters to %s, got %s", want, got)
+	}
+
+	got, want = toUpperFirst("hello", "[a-g]"), "hello"
+	if got != want {
+		t.Errorf("Expect upperFirst function to ignore non-matching first character, got %s", got)
+	}
+
+	got, want = toLowerFirst("HELLO", "H"), "hELLO"
+	if got != want {
+		t.Errorf("Expect lowerFirst function to map matching first character to %s, got %s", want, got)
+	}
+}
+
 func Test_default(t *testing.T) {
 	got, want := toDefault("Hello World", "Hola Mundo"), "Hello World"
 	if got != want {
@@ -121,4 +143,19 @@ func Test_substr(t *testing.T) {
 	if got != want {
 		t.Errorf("Expect substr function to cut entire string if pos is itself out of bound")
 	}
+
+	got, want = toSubstr("123456789", "2", "-1"), "345678"
+	if got != want {
+		t.Errorf("Expect substr function to stop negative length characters from the end")
+	}
+
+	got, want = toSubstr("123456789", "5", "-5"), ""
+	if got != want {
+		t.Errorf("Expect substr function to return empty string if negative length ends before offset")
+	}
+
+	got, want = toSubstr("123456789", " -2", "1"), "8"
+	if got != want {
+		t.Errorf("Expect substr function to accept a space-guarded negative offset")
+	}
 }
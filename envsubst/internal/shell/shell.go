@@ -0,0 +1,122 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package shell implements the parameter expansions shared by the
+// envsubst templates and the parse.Tree expansion.
+package shell
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/fluxcd/pkg/envsubst/path"
+)
+
+// Match reports whether s matches the shell pattern. Malformed patterns
+// match nothing.
+func Match(pattern, s string) bool {
+	ok, err := path.Match(pattern, s)
+	return ok && err == nil
+}
+
+// MapRunes returns v with the runes matching the pattern mapped by fn,
+// or all of them if the pattern is empty. If first is true, only the
+// first rune of v is considered.
+func MapRunes(v, pattern string, fn func(rune) rune, first bool) string {
+	var out strings.Builder
+	for i, r := range v {
+		if first && i > 0 {
+			out.WriteString(v[i:])
+			break
+		}
+		if pattern == "" || Match(pattern, string(r)) {
+			r = fn(r)
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+// Substring returns the ${param:offset:length} expansion of v, counting
+// runes. A negative offset counts from the end of v, and a negative
+// length is an offset from the end of v where the substring stops. The
+// substring runs to the end of v without length.
+func Substring(v string, offset int, length ...int) string {
+	runes := []rune(v)
+	if offset < 0 {
+		offset = max(len(runes)+offset, 0)
+	}
+	if offset > len(runes) {
+		return ""
+	}
+	if len(length) == 0 {
+		return string(runes[offset:])
+	}
+
+	end := offset + length[0]
+	if length[0] < 0 {
+		end = len(runes) + length[0]
+	}
+	end = min(end, len(runes))
+	if end <= offset {
+		return ""
+	}
+	return string(runes[offset:end])
+}
+
+// Transform returns v transformed by the ${param@operator} operator
+// letter, name being the parameter. Variables have no attributes, so "a"
+// expands to nothing and the prompt expansion of "P" leaves v unchanged.
+func Transform(name, v, letter string) string {
+	switch letter {
+	case "Q", "K", "k":
+		return Quote(v)
+	case "A":
+		return name + "=" + Quote(v)
+	case "a":
+		return ""
+	case "U":
+		return strings.ToUpper(v)
+	case "u":
+		return MapRunes(v, "", unicode.ToUpper, true)
+	case "L":
+		return strings.ToLower(v)
+	case "E":
+		return escapeSequences.Replace(v)
+	}
+	return v
+}
+
+// Quote returns s in single quotes, which the shell reads back as s
+// without expanding anything.
+func Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// escapeSequences expands the backslash escape sequences of $'...' strings.
+var escapeSequences = strings.NewReplacer(
+	`\\`, `\`,
+	`\'`, "'",
+	`\"`, `"`,
+	`\a`, "\a",
+	`\b`, "\b",
+	`\e`, "\x1b",
+	`\f`, "\f",
+	`\n`, "\n",
+	`\r`, "\r",
+	`\t`, "\t",
+	`\v`, "\v",
+)
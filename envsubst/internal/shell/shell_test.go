@@ -0,0 +1,84 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shell
+
+import (
+	"testing"
+	"unicode"
+)
+
+func TestSubstring(t *testing.T) {
+	tests := []struct {
+		v      string
+		offset int
+		length []int
+		want   string
+	}{
+		{v: "123456789", offset: 2, want: "3456789"},
+		{v: "123456789", offset: 2, length: []int{3}, want: "345"},
+		{v: "123456789", offset: 2, length: []int{50}, want: "3456789"},
+		{v: "123456789", offset: -3, want: "789"},
+		{v: "123456789", offset: -300, length: []int{3}, want: "123"},
+		{v: "123456789", offset: 10, want: ""},
+		{v: "123456789", offset: 2, length: []int{-1}, want: "345678"},
+		{v: "123456789", offset: 5, length: []int{-5}, want: ""},
+		{v: "héllo", offset: 1, length: []int{2}, want: "él"},
+	}
+	for _, tt := range tests {
+		if got := Substring(tt.v, tt.offset, tt.length...); got != tt.want {
+			t.Errorf("Substring(%q, %d, %v) = %q, want %q", tt.v, tt.offset, tt.length, got, tt.want)
+		}
+	}
+}
+
+func TestMapRunes(t *testing.T) {
+	tests := []struct {
+		v, pattern string
+		first      bool
+		want       string
+	}{
+		{v: "hello", want: "HELLO"},
+		{v: "hello", first: true, want: "Hello"},
+		{v: "hello", pattern: "[el]", want: "hELLo"},
+		{v: "hello", pattern: "[el]", first: true, want: "hello"},
+		{v: "hello", pattern: "[", want: "hello"}, // malformed
+	}
+	for _, tt := range tests {
+		if got := MapRunes(tt.v, tt.pattern, unicode.ToUpper, tt.first); got != tt.want {
+			t.Errorf("MapRunes(%q, %q, %t) = %q, want %q", tt.v, tt.pattern, tt.first, got, tt.want)
+		}
+	}
+}
+
+func TestTransform(t *testing.T) {
+	tests := []struct {
+		v, letter, want string
+	}{
+		{v: "it's", letter: "Q", want: `'it'\''s'`},
+		{v: "a b", letter: "A", want: "VAR='a b'"},
+		{v: `a\tb`, letter: "E", want: "a\tb"},
+		{v: "hello", letter: "u", want: "Hello"},
+		{v: "Hello", letter: "L", want: "hello"},
+		{v: "hello", letter: "a", want: ""},
+		{v: "hello", letter: "P", want: "hello"},
+	}
+	for _, tt := range tests {
+		if got := Transform("VAR", tt.v, tt.letter); got != tt.want {
+			t.Errorf("Transform(%q, %q) = %q, want %q", tt.v, tt.letter, got, tt.want)
+		}
+	}
+}
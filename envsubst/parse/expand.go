@@ -0,0 +1,739 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parse
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/fluxcd/pkg/envsubst/internal/shell"
+)
+
+var (
+	// ErrParameterNotSet represents a ${param:?word} expansion of an
+	// unset or empty parameter.
+	ErrParameterNotSet = errors.New("parameter null or not set")
+
+	// ErrUnsetVariable represents a reference to an unset variable
+	// without default in a strict expansion.
+	ErrUnsetVariable = errors.New("variable not set")
+
+	// ErrInvalidArithmetic represents an offset or length of a substring
+	// expansion which is not an integer.
+	ErrInvalidArithmetic = errors.New("invalid arithmetic expression")
+
+	// ErrVariableNotAllowed represents a reference to a variable which
+	// the Allow or Deny expand options prevent from being read.
+	ErrVariableNotAllowed = errors.New("variable not allowed")
+
+	// ErrExpansionCycle represents a variable whose value refers back to
+	// itself in a recursive expansion.
+	ErrExpansionCycle = errors.New("expansion cycle")
+
+	// ErrExpansionTooDeep represents a chain of variables whose values
+	// refer to each other deeper than maxRecursionDepth in a recursive
+	// expansion.
+	ErrExpansionTooDeep = errors.New("expansion too deep")
+)
+
+// maxRecursionDepth is the maximum number of values expanded within each
+// other in a recursive expansion.
+const maxRecursionDepth = 32
+
+// errUnknownVariable is returned within a partial expansion for the
+// references to unset variables without default.
+var errUnknownVariable = errors.New("unknown variable")
+
+// Expand evaluates the tree, resolving the variables with mapping. The
+// boolean returned by mapping reports whether the variable is set, so
+// that an unset variable can be told apart from an empty one. Unset
+// variables without default expand to an empty string.
+//
+// The values assigned by ${param=word} and ${param:=word} are seen by
+// the following references of the same expansion, but are not stored
+// anywhere else. Arithmetic expansions and command substitutions are
+// written unevaluated, with the substitutions they contain expanded, and
+// comments expand to nothing. Patterns which
+// are malformed match nothing.
+func (t *Tree) Expand(mapping func(name string) (string, bool)) (string, error) {
+	return t.expand(&expander{mapping: mapping})
+}
+
+// ExpandTo evaluates the tree like Expand, writing the expansion to w as
+// it goes rather than building the whole string, e.g. to stream a large
+// template to a file. On error, the expansion written to w until then is
+// incomplete.
+func (t *Tree) ExpandTo(w io.Writer, mapping func(name string) (string, bool)) error {
+	if t == nil || t.Root == nil {
+		return nil
+	}
+	return (&expander{mapping: mapping}).expand(w, t.Root)
+}
+
+// ExpandPartial evaluates the tree like Expand, but writes the
+// substitutions referring to unset variables without default as they
+// are, so that the result is a template which can be expanded later
+// with the variables known then. The substitutions whose words refer to
+// such variables are written as they are too, e.g. ${A:-${UNKNOWN}} when
+// A is unset, and so are ${param:?word} substitutions of unset variables.
+// The text and the values of the other substitutions are escaped, so
+// that expanding the result gives the same text.
+func (t *Tree) ExpandPartial(mapping func(name string) (string, bool)) (string, error) {
+	return t.expand(&expander{mapping: mapping, partial: true, syntax: t.opts.syntax()})
+}
+
+// ExpandStrict evaluates the tree like Expand, but fails with
+// ErrUnsetVariable on the first reference to an unset variable. The
+// default, assignment, error and alternate functions still handle unset
+// variables, e.g. ${VAR:-word} expands to word.
+func (t *Tree) ExpandStrict(mapping func(name string) (string, bool)) (string, error) {
+	return t.expand(&expander{mapping: mapping, strict: true})
+}
+
+// ExpandOptions contains options for expanding a tree.
+type ExpandOptions struct {
+	// Strict fails with ErrUnsetVariable on the references to unset
+	// variables, see ExpandStrict.
+	Strict bool
+
+	// Names returns the names of the variables set, listed by the
+	// ${!prefix*} and ${!prefix@} expansions, which expand to nothing
+	// when it is nil.
+	Names func() []string
+
+	// ShellQuote writes the expansion of each substitution in single
+	// quotes, escaping the single quotes it contains, so that the output
+	// can be given to "sh -c" without the values being interpreted by
+	// the shell. The words of the functions are not quoted, only their
+	// results, e.g. ${VAR:-a b} expands to 'a b' when VAR is unset.
+	ShellQuote bool
+
+	// Allow lists the only variables which can be read, when not empty.
+	Allow []string
+
+	// Deny lists the variables which cannot be read, e.g. PATH or HOME
+	// when expanding untrusted templates. It takes precedence over
+	// Allow.
+	Deny []string
+
+	// DeniedAsUnset expands the references to the variables which cannot
+	// be read as if they were unset, instead of failing with
+	// ErrVariableNotAllowed. They are not listed by ${!prefix*} either.
+	DeniedAsUnset bool
+
+	// EnableRecursive expands the values of the variables as templates,
+	// so that A=${B} and B=b expand ${A} to b. A value referring back to
+	// itself fails with ErrExpansionCycle, and chains deeper than 32
+	// variables fail with ErrExpansionTooDeep. The values assigned by
+	// ${param=word} are already expanded and are not expanded again.
+	EnableRecursive bool
+
+	// ContinueOnError carries on past the substitutions failing to
+	// expand, e.g. ${VAR:x} with an offset which is not an integer,
+	// writing ErrorPlaceholder in their place. The expansion is returned
+	// along with the errors of all the substitutions, joined together.
+	// A substitution failing within the word of another one fails the
+	// outermost one, so that each error is only reported once.
+	ContinueOnError bool
+
+	// ErrorPlaceholder is written in place of the substitutions failing
+	// to expand when ContinueOnError is set.
+	ErrorPlaceholder string
+}
+
+// ExpandWithOptions evaluates the tree like Expand, with the given
+// options.
+func (t *Tree) ExpandWithOptions(mapping func(name string) (string, bool), opts ExpandOptions) (string, error) {
+	e := &expander{
+		mapping:       mapping,
+		names:         opts.Names,
+		strict:        opts.Strict,
+		quote:         opts.ShellQuote,
+		deniedAsUnset: opts.DeniedAsUnset,
+		recursive:     opts.EnableRecursive,
+		opts:          t.opts,
+		continueOnErr: opts.ContinueOnError,
+		placeholder:   opts.ErrorPlaceholder,
+	}
+	if len(opts.Allow) > 0 {
+		e.allow = make(map[string]bool, len(opts.Allow))
+		for _, name := range opts.Allow {
+			e.allow[name] = true
+		}
+	}
+	if len(opts.Deny) > 0 {
+		e.deny = make(map[string]bool, len(opts.Deny))
+		for _, name := range opts.Deny {
+			e.deny[name] = true
+		}
+	}
+	s, err := t.expand(e)
+	if err != nil {
+		return "", err
+	}
+	return s, errors.Join(e.errs...)
+}
+
+// ExpandUsed evaluates the tree like Expand, and also returns the names
+// of the variables it read, de-duplicated and in the order they were
+// first read. Unlike Variables, the names only include the variables of
+// the branches taken, e.g. ${A:-${B}} only reads B if A is unset or
+// empty.
+func (t *Tree) ExpandUsed(mapping func(name string) (string, bool)) (string, []string, error) {
+	e := &expander{mapping: mapping, used: make(map[string]bool)}
+	s, err := t.expand(e)
+	if err != nil {
+		return "", nil, err
+	}
+	return s, e.usedList, nil
+}
+
+// MissingVariables evaluates the tree like Expand without producing any
+// output, and returns the names of all the variables referenced without
+// being set, de-duplicated and in the order they were first read. Like
+// ExpandStrict, the default, assignment and alternate functions handle
+// unset variables, and only the branches taken are evaluated. The
+// ${param:?word} references of unset or empty variables are listed
+// instead of failing.
+//
+// Evaluation stops at the first other error, e.g. an invalid substring
+// offset, returning the names found until then.
+func (t *Tree) MissingVariables(mapping func(name string) (string, bool)) []string {
+	e := &expander{mapping: mapping, missing: make(map[string]bool)}
+	_, _ = t.expand(e)
+	return e.missingList
+}
+
+// expand returns the expansion of the tree by e.
+func (t *Tree) expand(e *expander) (string, error) {
+	if t == nil || t.Root == nil {
+		return "", nil
+	}
+	var b strings.Builder
+	if err := e.expand(&b, t.Root); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// expander holds the state of a Tree.Expand call.
+type expander struct {
+	mapping  func(name string) (string, bool)
+	names    func() []string
+	assigned map[string]string
+	strict   bool
+
+	// partial writes the substitutions of unknown variables as they are,
+	// and escapes the rest of the expansion, with the syntax of the tree.
+	partial bool
+	syntax  syntax
+
+	// quote quotes the expansion of the substitutions, but not of the
+	// words of functions, which are expanded at a depth above zero.
+	quote bool
+	depth int
+
+	// used records the names of the variables read, in usedList, when
+	// not nil.
+	used     map[string]bool
+	usedList []string
+
+	// allow and deny restrict the variables which can be read, when not
+	// nil. The others are unset if deniedAsUnset is true.
+	allow         map[string]bool
+	deny          map[string]bool
+	deniedAsUnset bool
+
+	// recursive expands the values of the variables, parsed with opts,
+	// those of the tree. resolving holds the names of the variables whose
+	// values are being expanded.
+	recursive bool
+	opts      ParseOptions
+	resolving []string
+
+	// missing records the names of the unset variables referenced
+	// without default, in missingList, when not nil.
+	missing     map[string]bool
+	missingList []string
+
+	// continueOnErr writes placeholder in place of the substitutions
+	// failing to expand, and records their errors in errs.
+	continueOnErr bool
+	placeholder   string
+	errs          []error
+}
+
+// allowed reports whether the variable name can be read.
+func (e *expander) allowed(name string) bool {
+	return !e.deny[name] && (e.allow == nil || e.allow[name])
+}
+
+// lookup returns the value of the variable name and whether it is set.
+func (e *expander) lookup(name string) (string, bool, error) {
+	if e.used != nil && !e.used[name] {
+		e.used[name] = true
+		e.usedList = append(e.usedList, name)
+	}
+	if !e.allowed(name) {
+		if e.deniedAsUnset {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("%w: %q", ErrVariableNotAllowed, name)
+	}
+	if v, ok := e.assigned[name]; ok {
+		return v, true, nil
+	}
+	v, ok := e.mapping(name)
+	if ok && e.recursive {
+		var err error
+		if v, err = e.resolve(name, v); err != nil {
+			return "", false, err
+		}
+	}
+	return v, ok, nil
+}
+
+// resolve returns the expansion of the value v of the variable name in a
+// recursive expansion.
+func (e *expander) resolve(name, v string) (string, error) {
+	if i := slices.Index(e.resolving, name); i >= 0 {
+		cycle := append(slices.Clone(e.resolving[i:]), name)
+		return "", fmt.Errorf("%w: %s", ErrExpansionCycle, strings.Join(cycle, " -> "))
+	}
+	if len(e.resolving) >= maxRecursionDepth {
+		return "", fmt.Errorf("%w: %q", ErrExpansionTooDeep, name)
+	}
+	if sigil, _, _ := e.opts.delims(); !strings.ContainsRune(v, sigil) {
+		return v, nil
+	}
+	tree, err := ParseWithOptions(v, e.opts)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the value of %q: %w", name, err)
+	}
+
+	e.resolving = append(e.resolving, name)
+	e.depth++
+	defer func() {
+		e.resolving = e.resolving[:len(e.resolving)-1]
+		e.depth--
+	}()
+	return tree.expand(e)
+}
+
+// unset records that the variable name is referenced without being set
+// nor having a default, and returns ErrUnsetVariable in a strict
+// expansion.
+func (e *expander) unset(name string) error {
+	if e.missing != nil && !e.missing[name] {
+		e.missing[name] = true
+		e.missingList = append(e.missingList, name)
+	}
+	if e.partial {
+		return errUnknownVariable
+	}
+	if e.strict {
+		return fmt.Errorf("%w: %q", ErrUnsetVariable, name)
+	}
+	return nil
+}
+
+// assign records the value of the variable name for the rest of the
+// expansion.
+func (e *expander) assign(name, value string) {
+	if e.assigned == nil {
+		e.assigned = make(map[string]string)
+	}
+	e.assigned[name] = value
+}
+
+// expand writes the expansion of node to w.
+func (e *expander) expand(w io.Writer, node Node) error {
+	switch n := node.(type) {
+	case *TextNode:
+		if e.partial && e.depth == 0 {
+			return writeString(w, e.syntax.render(n))
+		}
+		return writeString(w, n.Value)
+	case *ListNode:
+		for _, child := range n.Nodes {
+			if err := e.expand(w, child); err != nil {
+				return err
+			}
+		}
+	case *FuncNode:
+		if e.partial && e.depth == 0 {
+			return e.expandPartial(w, n)
+		}
+		v, err := e.expandFunc(n)
+		if err != nil {
+			if !e.continueOnErr || e.depth > 0 {
+				return err
+			}
+			e.errs = append(e.errs, err)
+			return writeString(w, e.placeholder)
+		}
+		if e.quote && e.depth == 0 {
+			v = shell.Quote(v)
+		}
+		return writeString(w, v)
+	case *ArithNode:
+		if n.Nodes == nil {
+			return writeString(w, n.String())
+		}
+		return e.expandNested(w, "$((", n.Nodes, "))")
+	case *CmdNode:
+		if n.Nodes == nil {
+			return writeString(w, n.String())
+		}
+		return e.expandNested(w, "$(", n.Nodes, ")")
+	}
+	return nil
+}
+
+// expandNested writes the nodes of an arithmetic expansion or command
+// substitution to w between its delimiters, expanding its substitutions.
+func (e *expander) expandNested(w io.Writer, open string, nodes []Node, close string) error {
+	if err := writeString(w, open); err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		if err := e.expand(w, n); err != nil {
+			return err
+		}
+	}
+	return writeString(w, close)
+}
+
+// expandPartial writes the escaped expansion of the function f to w, or
+// its source if it refers to an unknown variable. The values assigned by
+// the functions written as they are are discarded.
+func (e *expander) expandPartial(w io.Writer, f *FuncNode) error {
+	assigned := maps.Clone(e.assigned)
+	v, err := e.expandFunc(f)
+	if errors.Is(err, errUnknownVariable) {
+		e.assigned = assigned
+		return writeString(w, e.syntax.render(f))
+	}
+	if err != nil {
+		return err
+	}
+	return writeString(w, e.syntax.render(newTextNode(v)))
+}
+
+// writeString writes s to w, skipping empty strings.
+func writeString(w io.Writer, s string) error {
+	if s == "" {
+		return nil
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// prefixNames returns the sorted names of the variables set which start
+// with prefix, separated by spaces.
+func (e *expander) prefixNames(prefix string) string {
+	var names []string
+	if e.names != nil {
+		names = slices.Clone(e.names())
+	}
+	for name := range e.assigned {
+		names = append(names, name)
+	}
+	names = slices.DeleteFunc(names, func(name string) bool {
+		return !strings.HasPrefix(name, prefix) || !e.allowed(name)
+	})
+	slices.Sort(names)
+	return strings.Join(slices.Compact(names), " ")
+}
+
+// word returns the expansion of the i-th argument of f, or an empty
+// string if there is none. Arguments are only expanded when needed,
+// so that the words of defaults which are not used have no effect.
+func (e *expander) word(f *FuncNode, i int) (string, error) {
+	if i >= len(f.Args) {
+		return "", nil
+	}
+	e.depth++
+	defer func() { e.depth-- }()
+	var b strings.Builder
+	if err := e.expand(&b, f.Args[i]); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// words returns the expansion of all the arguments of f joined
+// together, which make up the word of the default, assignment, error
+// and alternate functions, e.g. "a" and ${B} in ${VAR:-a${B}}.
+func (e *expander) words(f *FuncNode) (string, error) {
+	e.depth++
+	defer func() { e.depth-- }()
+	var b strings.Builder
+	for _, arg := range f.Args {
+		if err := e.expand(&b, arg); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+// expandFunc returns the expansion of the function f.
+func (e *expander) expandFunc(f *FuncNode) (string, error) {
+	op := f.Op()
+	if op == OpPrefixNames {
+		// the parameter is a prefix, not a variable
+		return e.prefixNames(f.Param), nil
+	}
+	v, set, err := e.lookup(f.Param)
+	if err != nil {
+		return "", err
+	}
+
+	if !set {
+		switch op {
+		case OpAssign, OpAssignIfEmpty, OpDefaultIfUnset, OpDefaultIfEmpty,
+			OpErrorIfUnset, OpErrorIfEmpty, OpAlternateUnlessUnset, OpAlternateIfSet:
+		default:
+			if err := e.unset(f.Param); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	switch op {
+	case OpNone:
+		return v, nil
+	case OpLength:
+		return strconv.Itoa(utf8.RuneCountInString(v)), nil
+	case OpIndirect:
+		if !set {
+			return "", nil
+		}
+		name := v
+		if v, set, err = e.lookup(name); err != nil {
+			return "", err
+		}
+		if !set {
+			if err := e.unset(name); err != nil {
+				return "", err
+			}
+		}
+		return v, nil
+	case OpLowerFirst, OpLower, OpUpperFirst, OpUpper:
+		pattern, err := e.word(f, 0)
+		if err != nil {
+			return "", err
+		}
+		fn := unicode.ToUpper
+		if op == OpLowerFirst || op == OpLower {
+			fn = unicode.ToLower
+		}
+		return shell.MapRunes(v, pattern, fn, op == OpLowerFirst || op == OpUpperFirst), nil
+	case OpSubstring:
+		return e.substring(f, v)
+	case OpRemoveShortestPrefix, OpRemoveLongestPrefix, OpRemoveShortestSuffix, OpRemoveLongestSuffix:
+		pattern, err := e.word(f, 0)
+		if err != nil {
+			return "", err
+		}
+		longest := op == OpRemoveLongestPrefix || op == OpRemoveLongestSuffix
+		if op == OpRemoveShortestPrefix || op == OpRemoveLongestPrefix {
+			return removePrefix(v, pattern, longest), nil
+		}
+		return removeSuffix(v, pattern, longest), nil
+	case OpReplaceFirst, OpReplaceAll, OpReplacePrefix, OpReplaceSuffix:
+		pattern, err := e.word(f, 0)
+		if err != nil {
+			return "", err
+		}
+		repl, err := e.word(f, 1)
+		if err != nil {
+			return "", err
+		}
+		return replace(v, pattern, repl, op, f.Global), nil
+	case OpAssign, OpAssignIfEmpty:
+		if set && (op == OpAssign || v != "") {
+			return v, nil
+		}
+		w, err := e.words(f)
+		if err != nil {
+			return "", err
+		}
+		e.assign(f.Param, w)
+		return w, nil
+	case OpDefaultIfUnset, OpDefaultIfEmpty:
+		if set && (op == OpDefaultIfUnset || v != "") {
+			return v, nil
+		}
+		return e.words(f)
+	case OpErrorIfUnset, OpErrorIfEmpty:
+		if set && (op == OpErrorIfUnset || v != "") {
+			return v, nil
+		}
+		if e.partial && !set {
+			return "", errUnknownVariable
+		}
+		msg, err := e.words(f)
+		if err != nil {
+			return "", err
+		}
+		if e.missing != nil {
+			// list the variable rather than failing the dry run
+			return "", e.unset(f.Param)
+		}
+		if msg == "" {
+			return "", fmt.Errorf("%s: %w", f.Param, ErrParameterNotSet)
+		}
+		return "", fmt.Errorf("%s: %w: %s", f.Param, ErrParameterNotSet, msg)
+	case OpAlternateUnlessUnset, OpAlternateIfSet:
+		if !set || (op == OpAlternateIfSet && v == "") {
+			return "", nil
+		}
+		return e.words(f)
+	case OpTransform:
+		letter, err := e.word(f, 0)
+		if err != nil {
+			return "", err
+		}
+		return shell.Transform(f.Param, v, letter), nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnsupportedOperator, f.Name)
+}
+
+// substring returns the ${param:offset:length} expansion of v, see
+// shell.Substring.
+func (e *expander) substring(f *FuncNode, v string) (string, error) {
+	offset, err := e.integer(f, 0)
+	if err != nil {
+		return "", err
+	}
+	if len(f.Args) < 2 {
+		return shell.Substring(v, offset), nil
+	}
+	length, err := e.integer(f, 1)
+	if err != nil {
+		return "", err
+	}
+	return shell.Substring(v, offset, length), nil
+}
+
+// integer returns the i-th argument of f as an integer. Spaces are
+// allowed around it, e.g. to tell ${param: -1} from ${param:-1}.
+func (e *expander) integer(f *FuncNode, i int) (int, error) {
+	w, err := e.word(f, i)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(w))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w: %q", f.Param, ErrInvalidArithmetic, w)
+	}
+	return n, nil
+}
+
+// boundaries returns the byte offsets of the runes of s, followed by
+// the length of s.
+func boundaries(s string) []int {
+	offsets := make([]int, 0, len(s)+1)
+	for i := range s {
+		offsets = append(offsets, i)
+	}
+	return append(offsets, len(s))
+}
+
+// removePrefix returns v without the shortest or longest prefix matching
+// the pattern.
+func removePrefix(v, pattern string, longest bool) string {
+	b := boundaries(v)
+	for k := range b {
+		if longest {
+			k = len(b) - 1 - k
+		}
+		if shell.Match(pattern, v[:b[k]]) {
+			return v[b[k]:]
+		}
+	}
+	return v
+}
+
+// removeSuffix returns v without the shortest or longest suffix matching
+// the pattern.
+func removeSuffix(v, pattern string, longest bool) string {
+	b := boundaries(v)
+	for k := range b {
+		if !longest {
+			k = len(b) - 1 - k
+		}
+		if shell.Match(pattern, v[b[k]:]) {
+			return v[:b[k]]
+		}
+	}
+	return v
+}
+
+// replace returns v with the longest matches of the pattern replaced
+// by repl, as selected by the replace operation op, all of them if
+// global is set.
+func replace(v, pattern, repl string, op Op, global bool) string {
+	b := boundaries(v)
+	switch op {
+	case OpReplacePrefix:
+		for k := len(b) - 1; k >= 0; k-- {
+			if shell.Match(pattern, v[:b[k]]) {
+				return repl + v[b[k]:]
+			}
+		}
+		return v
+	case OpReplaceSuffix:
+		for k := range b {
+			if shell.Match(pattern, v[b[k]:]) {
+				return v[:b[k]] + repl
+			}
+		}
+		return v
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(b)-1; {
+		end := -1
+		for j := len(b) - 1; j > i; j-- {
+			if shell.Match(pattern, v[b[i]:b[j]]) {
+				end = j
+				break
+			}
+		}
+		if end < 0 {
+			out.WriteString(v[b[i]:b[i+1]])
+			i++
+			continue
+		}
+		out.WriteString(repl)
+		if !global {
+			out.WriteString(v[b[end]:])
+			return out.String()
+		}
+		i = end
+	}
+	return out.String()
+}
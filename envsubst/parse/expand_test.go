@@ -0,0 +1,781 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTree_Expand(t *testing.T) {
+	vars := map[string]string{
+		"EMPTY": "",
+		"NAME":  "hello World",
+		"PATH":  "/usr/local/bin:/usr/bin",
+		"FILE":  "archive.tar.gz",
+		"PTR":   "NAME",
+		"QUOTE": "it's",
+		"UTF":   "héllo",
+	}
+	tests := []struct {
+		Text string
+		Want string
+		Err  error
+	}{
+		// text and plain references
+		{Text: "plain text", Want: "plain text"},
+		{Text: "${NAME}", Want: "hello World"},
+		{Text: "a ${UNSET} b", Want: "a  b"},
+		{Text: "$$NAME $((1 + 2))", Want: "$NAME $((1 + 2))"},
+
+		// length and indirection
+		{Text: "${#NAME}", Want: "11"},
+		{Text: "${#UTF}", Want: "5"},
+		{Text: "${#UNSET}", Want: "0"},
+		{Text: "${!PTR}", Want: "hello World"},
+		{Text: "${!UNSET}", Want: ""},
+
+		// casing
+		{Text: "${NAME^}", Want: "Hello World"},
+		{Text: "${NAME^^}", Want: "HELLO WORLD"},
+		{Text: "${NAME,}", Want: "hello World"},
+		{Text: "${NAME,,}", Want: "hello world"},
+		{Text: "${NAME^^[lo]}", Want: "heLLO WOrLd"},
+		{Text: "${UTF^^}", Want: "HÉLLO"},
+
+		// substrings
+		{Text: "${NAME:6}", Want: "World"},
+		{Text: "${NAME:0:5}", Want: "hello"},
+		{Text: "${NAME: -5}", Want: "World"},
+		{Text: "${NAME:6:-2}", Want: "Wor"},
+		{Text: "${NAME:20}", Want: ""},
+		{Text: "${UTF:1:3}", Want: "éll"},
+		{Text: "${NAME:x}", Err: ErrInvalidArithmetic},
+
+		// removal
+		{Text: "${FILE#*.}", Want: "tar.gz"},
+		{Text: "${FILE##*.}", Want: "gz"},
+		{Text: "${FILE%.*}", Want: "archive.tar"},
+		{Text: "${FILE%%.*}", Want: "archive"},
+		{Text: "${FILE#nomatch}", Want: "archive.tar.gz"},
+
+		// replacement
+		{Text: `${PATH/\/usr/\/opt}`, Want: "/opt/local/bin:/usr/bin"},
+		{Text: `${PATH//\/usr/\/opt}`, Want: "/opt/local/bin:/opt/bin"},
+		{Text: `${PATH/#\/usr/\/opt}`, Want: "/opt/local/bin:/usr/bin"},
+		{Text: `${PATH/%bin/sbin}`, Want: "/usr/local/bin:/usr/sbin"},
+		{Text: `${PATH/#local/x}`, Want: "/usr/local/bin:/usr/bin"},
+		{Text: "${FILE//?a/_}", Want: "archive._r.gz"},
+		{Text: "${FILE/.tar/}", Want: "archive.gz"},
+		{Text: "${FILE/#/x}", Want: "xarchive.tar.gz"},
+
+		// defaults
+		{Text: "${UNSET:-default}", Want: "default"},
+		{Text: "${EMPTY:-default}", Want: "default"},
+		{Text: "${NAME:-default}", Want: "hello World"},
+		{Text: "${UNSET:-${NAME,,}}", Want: "hello world"},
+		{Text: "${UNSET:-}", Want: ""},
+		{Text: "${EMPTY:-${EMPTY}_fallback}", Want: "_fallback"},
+		{Text: "${NAME:-${NAME}_fallback}", Want: "hello World"},
+		{Text: "${UNSET:-a ${NAME} b}", Want: "a hello World b"},
+		{Text: "${NAME:+[${NAME}]}", Want: "[hello World]"},
+
+		// assignments
+		{Text: "${UNSET=a} ${UNSET}", Want: "a a"},
+		{Text: "${EMPTY=a}", Want: ""},
+		{Text: "${EMPTY:=a} ${EMPTY}", Want: "a a"},
+		{Text: "${EMPTY:=a${NAME}} ${EMPTY}", Want: "ahello World ahello World"},
+		{Text: "${NAME:=a}", Want: "hello World"},
+
+		// errors and alternates
+		{Text: "${NAME:?must be set}", Want: "hello World"},
+		{Text: "${EMPTY:?must be set}", Err: ErrParameterNotSet},
+		{Text: "${EMPTY:?${NAME} must be set}", Err: ErrParameterNotSet},
+		{Text: "${UNSET:?}", Err: ErrParameterNotSet},
+		{Text: "${NAME:+set}", Want: "set"},
+		{Text: "${EMPTY:+set}", Want: ""},
+		{Text: "${UNSET:+set}", Want: ""},
+
+		// unused words are not expanded
+		{Text: "${NAME:-${UNSET:?unused}}", Want: "hello World"},
+
+		// transformations
+		{Text: "${QUOTE@Q}", Want: `'it'\''s'`},
+		{Text: "${NAME@U}", Want: "HELLO WORLD"},
+		{Text: "${NAME@u}", Want: "Hello World"},
+		{Text: "${NAME@L}", Want: "hello world"},
+		{Text: "${QUOTE@A}", Want: `QUOTE='it'\''s'`},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tree.Expand(func(name string) (string, bool) {
+				v, ok := vars[name]
+				return v, ok
+			})
+			if test.Err != nil {
+				if !errors.Is(err, test.Err) {
+					t.Errorf("Want error %q, got %v", test.Err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.Want {
+				t.Errorf("Want %q expanded to %q, got %q", test.Text, test.Want, got)
+			}
+		})
+	}
+}
+
+func TestTree_Expand_Empty(t *testing.T) {
+	var tree *Tree
+	got, err := tree.Expand(func(string) (string, bool) { return "", false })
+	if err != nil || got != "" {
+		t.Errorf("Want an empty tree expanded to nothing, got %q, %v", got, err)
+	}
+}
+
+func TestTree_ExpandTo(t *testing.T) {
+	mapping := func(name string) (string, bool) {
+		return map[string]string{"B": "b", "FOO": "foo"}[name], name != "UNSET"
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, wantErr := tree.Expand(mapping)
+			var b bytes.Buffer
+			err = tree.ExpandTo(&b, mapping)
+			if (err == nil) != (wantErr == nil) {
+				t.Fatalf("Want error %v, got %v", wantErr, err)
+			}
+			if err == nil && b.String() != want {
+				t.Errorf("Want %q expanded to %q, got %q", test.Text, want, b.String())
+			}
+		})
+	}
+
+	writeErr := errors.New("disk full")
+	err := MustParse("a${B}").ExpandTo(failingWriter{err: writeErr}, mapping)
+	if !errors.Is(err, writeErr) {
+		t.Errorf("Want error %q, got %v", writeErr, err)
+	}
+}
+
+// failingWriter is an io.Writer failing with err.
+type failingWriter struct {
+	err error
+}
+
+func (w failingWriter) Write([]byte) (int, error) {
+	return 0, w.err
+}
+
+func TestTree_ExpandPartial(t *testing.T) {
+	first := map[string]string{
+		"HOST":   "example.com",
+		"EMPTY":  "",
+		"DOLLAR": "${HOST}",
+		"PTR":    "PORT",
+	}
+	second := map[string]string{
+		"PORT": "8080",
+		"USER": "admin",
+		"PATH": "/api",
+	}
+	tests := []struct {
+		Text    string
+		Partial string
+		Want    string
+	}{
+		{Text: "http://${HOST}:${PORT}${PATH}", Partial: "http://example.com:${PORT}${PATH}", Want: "http://example.com:8080/api"},
+		{Text: "${USER:-guest}@${HOST}", Partial: "guest@example.com", Want: "guest@example.com"},
+		{Text: "${#HOST} ${#PORT}", Partial: "11 ${#PORT}", Want: "11 4"},
+		{Text: "${EMPTY:-${USER}}", Partial: "${EMPTY:-${USER}}", Want: "admin"},
+		{Text: "${PORT:?port required}", Partial: "${PORT:?port required}", Want: "8080"},
+		{Text: "${!PTR}", Partial: "${!PTR}", Want: ""},
+		{Text: "$${HOST} ${DOLLAR} $$", Partial: "$${HOST} $${HOST} $$", Want: "${HOST} ${HOST} $"},
+		{Text: "${X:=${USER}} ${X}", Partial: "${X:=${USER}} ${X}", Want: "admin admin"},
+		{Text: "$((1 + 2)) ${HOST/.com/.org}", Partial: "$((1 + 2)) example.org", Want: "$((1 + 2)) example.org"},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			partial, err := MustParse(test.Text).ExpandPartial(func(name string) (string, bool) {
+				v, ok := first[name]
+				return v, ok
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if partial != test.Partial {
+				t.Errorf("Want %q partially expanded to %q, got %q", test.Text, test.Partial, partial)
+			}
+
+			got, err := MustParse(partial).Expand(func(name string) (string, bool) {
+				v, ok := second[name]
+				return v, ok
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.Want {
+				t.Errorf("Want %q expanded to %q, got %q", partial, test.Want, got)
+			}
+		})
+	}
+}
+
+func TestTree_ExpandPartial_BareReferences(t *testing.T) {
+	opts := ParseOptions{AllowBareReferences: true}
+	first := map[string]string{
+		"HOST":   "example.com",
+		"DOLLAR": "$HOST",
+	}
+	second := map[string]string{
+		"_":    "underscore",
+		"BB":   "bb",
+		"HOST": "other.com",
+		"PORT": "8080",
+	}
+	tests := []struct {
+		Text    string
+		Partial string
+		Want    string
+	}{
+		{Text: "a%_$$_", Partial: "a%_$$_", Want: "a%_$_"},
+		{Text: "$$BB $HOST:$PORT", Partial: "$$BB example.com:${PORT}", Want: "$BB example.com:8080"},
+		{Text: "$DOLLAR ${PORT}", Partial: "$$HOST ${PORT}", Want: "$HOST 8080"},
+		{Text: "cost: 5$ $? $", Partial: "cost: 5$ $? $$", Want: "cost: 5$ $? $"},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := ParseWithOptions(test.Text, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			partial, err := tree.ExpandPartial(func(name string) (string, bool) {
+				v, ok := first[name]
+				return v, ok
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if partial != test.Partial {
+				t.Errorf("Want %q partially expanded to %q, got %q", test.Text, test.Partial, partial)
+			}
+
+			// the escaped sigils are not read as references in the second pass
+			tree, err = ParseWithOptions(partial, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tree.Expand(func(name string) (string, bool) {
+				v, ok := second[name]
+				return v, ok
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.Want {
+				t.Errorf("Want %q expanded to %q, got %q", partial, test.Want, got)
+			}
+		})
+	}
+}
+
+func TestTree_ExpandStrict(t *testing.T) {
+	vars := map[string]string{
+		"EMPTY": "",
+		"NAME":  "hello",
+		"PTR":   "UNSET",
+	}
+	tests := []struct {
+		Text    string
+		Want    string
+		Err     error
+		Message string
+	}{
+		{Text: "${NAME} ${EMPTY}", Want: "hello "},
+		{Text: "${UNSET:-default}", Want: "default"},
+		{Text: "${UNSET:=default} ${UNSET}", Want: "default default"},
+		{Text: "${UNSET=default}", Want: "default"},
+		{Text: "${UNSET:+alternate}", Want: ""},
+		{Text: "${NAME:-${UNSET}}", Want: "hello"},
+		{Text: "${UNSET}", Err: ErrUnsetVariable, Message: `variable not set: "UNSET"`},
+		{Text: "a ${NAME} ${UNSET,,}", Err: ErrUnsetVariable, Message: `variable not set: "UNSET"`},
+		{Text: "${#UNSET}", Err: ErrUnsetVariable},
+		{Text: "${!PTR}", Err: ErrUnsetVariable, Message: `variable not set: "UNSET"`},
+		{Text: "${UNSET:-${OTHER}}", Err: ErrUnsetVariable, Message: `variable not set: "OTHER"`},
+		{Text: "${UNSET:?must be set}", Err: ErrParameterNotSet, Message: "UNSET: parameter null or not set: must be set"},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tree.ExpandStrict(func(name string) (string, bool) {
+				v, ok := vars[name]
+				return v, ok
+			})
+			if test.Err != nil {
+				if !errors.Is(err, test.Err) {
+					t.Fatalf("Want error %q, got %v", test.Err, err)
+				}
+				if test.Message != "" && err.Error() != test.Message {
+					t.Errorf("Want error message %q, got %q", test.Message, err.Error())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.Want {
+				t.Errorf("Want %q expanded to %q, got %q", test.Text, test.Want, got)
+			}
+		})
+	}
+}
+
+func TestTree_ExpandUsed(t *testing.T) {
+	vars := map[string]string{
+		"A":   "a",
+		"PTR": "A",
+	}
+	tests := []struct {
+		Text string
+		Want []string
+	}{
+		{Text: "text", Want: nil},
+		{Text: "${A} ${B} ${A}", Want: []string{"A", "B"}},
+		{Text: "${A:-${B}}", Want: []string{"A"}},
+		{Text: "${UNSET:-${B}}", Want: []string{"UNSET", "B"}},
+		{Text: "${A:+${B}}", Want: []string{"A", "B"}},
+		{Text: "${UNSET:+${B}}", Want: []string{"UNSET"}},
+		{Text: "${!PTR}", Want: []string{"PTR", "A"}},
+		{Text: "${C:=x} ${C}", Want: []string{"C"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, got, err := tree.ExpandUsed(func(name string) (string, bool) {
+				v, ok := vars[name]
+				return v, ok
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Want, got); diff != "" {
+				t.Errorf(diff)
+			}
+		})
+	}
+}
+
+func TestTree_MissingVariables(t *testing.T) {
+	vars := map[string]string{
+		"A":     "a",
+		"EMPTY": "",
+		"PTR":   "NOWHERE",
+	}
+	tests := []struct {
+		Text string
+		Want []string
+	}{
+		{Text: "${A}", Want: nil},
+		{Text: "host=${HOST} port=${PORT} user=${USER} host=${HOST}", Want: []string{"HOST", "PORT", "USER"}},
+		{Text: "${HOST:-localhost} ${PORT=80} ${USER:=root} ${USER}", Want: nil},
+		{Text: "${A:+${B}} ${UNSET:+${C}}", Want: []string{"B"}},
+		{Text: "${A:-${B}} ${UNSET:-${C}}", Want: []string{"C"}},
+		{Text: "${EMPTY} ${#LEN} ${X/a/b}", Want: []string{"LEN", "X"}},
+		{Text: "${!PTR} ${!UNSET}", Want: []string{"NOWHERE", "UNSET"}},
+		{Text: "${REQUIRED:?must be set} ${EMPTY:?} ${A:?}", Want: []string{"REQUIRED", "EMPTY"}},
+		{Text: "${B} ${A:${OFFSET}} ${C}", Want: []string{"B", "OFFSET"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			got := MustParse(test.Text).MissingVariables(func(name string) (string, bool) {
+				v, ok := vars[name]
+				return v, ok
+			})
+			if diff := cmp.Diff(test.Want, got); diff != "" {
+				t.Errorf(diff)
+			}
+		})
+	}
+}
+
+func TestTree_Expand_Colon(t *testing.T) {
+	vars := map[string]string{
+		"SET":   "value",
+		"EMPTY": "",
+	}
+	// the forms without a colon only test whether the variable is set,
+	// the forms with a colon also treat an empty value as unset
+	tests := []struct {
+		Op    string
+		Set   string
+		Empty string
+		Unset string
+	}{
+		{Op: "=", Set: "value", Empty: "", Unset: "word"},
+		{Op: ":=", Set: "value", Empty: "word", Unset: "word"},
+		{Op: "-", Set: "value", Empty: "", Unset: "word"},
+		{Op: ":-", Set: "value", Empty: "word", Unset: "word"},
+		{Op: "?", Set: "value", Empty: "", Unset: "error"},
+		{Op: ":?", Set: "value", Empty: "error", Unset: "error"},
+		{Op: "+", Set: "word", Empty: "word", Unset: ""},
+		{Op: ":+", Set: "word", Empty: "", Unset: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.Op, func(t *testing.T) {
+			for name, want := range map[string]string{"SET": test.Set, "EMPTY": test.Empty, "UNSET": test.Unset} {
+				text := "${" + name + test.Op + "word}"
+				got, err := MustParse(text).Expand(func(name string) (string, bool) {
+					v, ok := vars[name]
+					return v, ok
+				})
+				if want == "error" {
+					if !errors.Is(err, ErrParameterNotSet) {
+						t.Errorf("Want %q failing with %q, got %q, %v", text, ErrParameterNotSet, got, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("Want %q expanded to %q, got %q", text, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestTree_ExpandWithOptions_Names(t *testing.T) {
+	vars := map[string]string{
+		"CONFIG_B": "b",
+		"CONFIG_A": "a",
+		"OTHER":    "x",
+	}
+	names := func() []string {
+		var names []string
+		for name := range vars {
+			names = append(names, name)
+		}
+		return names
+	}
+	mapping := func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+	tests := []struct {
+		Text string
+		Want string
+	}{
+		{Text: "${!CONFIG_*}", Want: "CONFIG_A CONFIG_B"},
+		{Text: "${!CONFIG_@}", Want: "CONFIG_A CONFIG_B"},
+		{Text: "${CONFIG_C=c} ${!CONFIG_*}", Want: "c CONFIG_A CONFIG_B CONFIG_C"},
+		{Text: "${!NONE_*}", Want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			got, err := MustParse(test.Text).ExpandWithOptions(mapping, ExpandOptions{Names: names, Strict: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.Want {
+				t.Errorf("Want %q expanded to %q, got %q", test.Text, test.Want, got)
+			}
+		})
+	}
+
+	got, err := MustParse("[${!CONFIG_*}]").Expand(mapping)
+	if err != nil || got != "[]" {
+		t.Errorf("Want no names listed without Names, got %q, %v", got, err)
+	}
+	if got := MustParse("${!CONFIG_*} ${OTHER}").Variables(); !cmp.Equal(got, []string{"OTHER"}) {
+		t.Errorf("Want the prefix not listed as a variable, got %v", got)
+	}
+}
+
+func TestTree_ExpandWithOptions_AllowDeny(t *testing.T) {
+	vars := map[string]string{
+		"APP_NAME": "app",
+		"APP_PORT": "80",
+		"PATH":     "/usr/bin",
+		"HOME":     "/root",
+		"PTR":      "PATH",
+	}
+	names := func() []string {
+		return []string{"APP_NAME", "APP_PORT", "PATH", "HOME"}
+	}
+	mapping := func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+	tests := []struct {
+		Text string
+		Opts ExpandOptions
+		Want string
+		Err  error
+	}{
+		{Text: "${APP_NAME}", Opts: ExpandOptions{Deny: []string{"PATH", "HOME"}}, Want: "app"},
+		{Text: "${PATH}", Opts: ExpandOptions{Deny: []string{"PATH", "HOME"}}, Err: ErrVariableNotAllowed},
+		{Text: "${!PTR}", Opts: ExpandOptions{Deny: []string{"PATH"}}, Err: ErrVariableNotAllowed},
+		{Text: "${HOME:-none}", Opts: ExpandOptions{Deny: []string{"HOME"}}, Err: ErrVariableNotAllowed},
+		{Text: "${HOME:-none}", Opts: ExpandOptions{Deny: []string{"HOME"}, DeniedAsUnset: true}, Want: "none"},
+		{Text: "[${PATH}]", Opts: ExpandOptions{Deny: []string{"PATH"}, DeniedAsUnset: true}, Want: "[]"},
+		{Text: "${PATH}", Opts: ExpandOptions{Deny: []string{"PATH"}, DeniedAsUnset: true, Strict: true}, Err: ErrUnsetVariable},
+		{Text: "${APP_NAME}:${APP_PORT}", Opts: ExpandOptions{Allow: []string{"APP_NAME", "APP_PORT"}}, Want: "app:80"},
+		{Text: "${PATH}", Opts: ExpandOptions{Allow: []string{"APP_NAME"}}, Err: ErrVariableNotAllowed},
+		{Text: "${APP_NAME}", Opts: ExpandOptions{Allow: []string{"APP_NAME"}, Deny: []string{"APP_NAME"}}, Err: ErrVariableNotAllowed},
+		{Text: "${!APP_*} ${!HOME*}", Opts: ExpandOptions{Names: names, Allow: []string{"APP_NAME"}, DeniedAsUnset: true}, Want: "APP_NAME "},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			got, err := MustParse(test.Text).ExpandWithOptions(mapping, test.Opts)
+			if test.Err != nil {
+				if !errors.Is(err, test.Err) {
+					t.Fatalf("Want error %q, got %v", test.Err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.Want {
+				t.Errorf("Want %q expanded to %q, got %q", test.Text, test.Want, got)
+			}
+		})
+	}
+}
+
+func TestTree_ExpandWithOptions_Recursive(t *testing.T) {
+	vars := map[string]string{
+		"URL":     "${SCHEME}://${HOST}",
+		"SCHEME":  "https",
+		"HOST":    "${NAME}.${DOMAIN:-example.com}",
+		"NAME":    "app",
+		"A":       "${B}",
+		"B":       "${A}",
+		"SELF":    "${SELF:-x}",
+		"INVALID": "${",
+		"ESCAPED": "$${URL}",
+	}
+	for i := range maxRecursionDepth + 1 {
+		vars[fmt.Sprintf("CHAIN_%d", i)] = fmt.Sprintf("${CHAIN_%d}", i+1)
+	}
+	mapping := func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+	tests := []struct {
+		Text   string
+		Want   string
+		Err    error
+		ErrMsg string
+	}{
+		{Text: "${URL}", Want: "https://app.example.com"},
+		{Text: "${#URL} ${URL/app/api}", Want: "23 https://api.example.com"},
+		{Text: "${ESCAPED}", Want: "${URL}"},
+		{Text: "${A}", Err: ErrExpansionCycle, ErrMsg: "A -> B -> A"},
+		{Text: "${UNSET:-${B}}", Err: ErrExpansionCycle, ErrMsg: "B -> A -> B"},
+		{Text: "${SELF}", Err: ErrExpansionCycle, ErrMsg: "SELF -> SELF"},
+		{Text: "${CHAIN_0}", Err: ErrExpansionTooDeep},
+		{Text: "${INVALID}", ErrMsg: `failed to parse the value of "INVALID"`},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			got, err := MustParse(test.Text).ExpandWithOptions(mapping, ExpandOptions{EnableRecursive: true})
+			if test.Err != nil || test.ErrMsg != "" {
+				if test.Err != nil && !errors.Is(err, test.Err) {
+					t.Fatalf("Want error %q, got %v", test.Err, err)
+				}
+				if err == nil || !strings.Contains(err.Error(), test.ErrMsg) {
+					t.Fatalf("Want error containing %q, got %v", test.ErrMsg, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.Want {
+				t.Errorf("Want %q expanded to %q, got %q", test.Text, test.Want, got)
+			}
+		})
+	}
+
+	got, err := MustParse("${URL}").Expand(mapping)
+	if err != nil || got != "${SCHEME}://${HOST}" {
+		t.Errorf("Want values not expanded by default, got %q, %v", got, err)
+	}
+}
+
+func TestTree_ExpandWithOptions_RecursiveParseOptions(t *testing.T) {
+	vars := map[string]string{
+		"URL":     "%{SCHEME}://%{HOST}",
+		"DEFAULT": "${HOST}",
+		"SCHEME":  "https",
+		"HOST":    "example.com",
+		"CMD":     "$(date) %{HOST}",
+	}
+	mapping := func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+	tests := []struct {
+		Text string
+		Opts ParseOptions
+		Want string
+	}{
+		{Text: "%{URL} %{DEFAULT}", Opts: ParseOptions{LeftDelim: "%{"}, Want: "https://example.com ${HOST}"},
+		{Text: "%{CMD}", Opts: ParseOptions{LeftDelim: "%{", AllowCommandSubstitution: true}, Want: "$(date) example.com"},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := ParseWithOptions(test.Text, test.Opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tree.ExpandWithOptions(mapping, ExpandOptions{EnableRecursive: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.Want {
+				t.Errorf("Want %q expanded to %q, got %q", test.Text, test.Want, got)
+			}
+		})
+	}
+
+	// the values are parsed with the options of the tree
+	vars["DEFAULT"] = "$(date) ${HOST}"
+	tree, err := ParseWithOptions("${DEFAULT}", ParseOptions{AllowCommandSubstitution: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := tree.ExpandWithOptions(mapping, ExpandOptions{EnableRecursive: true})
+	if err != nil || got != "$(date) example.com" {
+		t.Errorf("Want command substitution allowed in the values, got %q, %v", got, err)
+	}
+	_, err = MustParse("${DEFAULT}").ExpandWithOptions(mapping, ExpandOptions{EnableRecursive: true})
+	if !errors.Is(err, ErrCommandSubstitutionDisallowed) {
+		t.Errorf("Want error %q, got %v", ErrCommandSubstitutionDisallowed, err)
+	}
+}
+
+func TestTree_ExpandWithOptions_ShellQuote(t *testing.T) {
+	vars := map[string]string{
+		"SPACES": "hello world",
+		"QUOTE":  "it's",
+		"DOLLAR": "$HOME `id` $(id)",
+		"EMPTY":  "",
+	}
+	tests := []struct {
+		Text string
+		Want string
+	}{
+		{Text: "echo ${SPACES}", Want: `echo 'hello world'`},
+		{Text: "echo ${QUOTE}", Want: `echo 'it'\''s'`},
+		{Text: "echo ${DOLLAR}", Want: "echo '$HOME `id` $(id)'"},
+		{Text: "echo ${EMPTY}", Want: `echo ''`},
+		{Text: "echo ${UNSET:-a b}", Want: `echo 'a b'`},
+		{Text: "echo ${UNSET:-${QUOTE}}", Want: `echo 'it'\''s'`},
+		{Text: "echo ${SPACES/world/${QUOTE}}", Want: `echo 'hello it'\''s'`},
+		{Text: "echo $((1 + 2)) 'text'", Want: `echo $((1 + 2)) 'text'`},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tree.ExpandWithOptions(func(name string) (string, bool) {
+				v, ok := vars[name]
+				return v, ok
+			}, ExpandOptions{ShellQuote: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.Want {
+				t.Errorf("Want %q expanded to %q, got %q", test.Text, test.Want, got)
+			}
+		})
+	}
+
+	_, err := MustParse("${UNSET}").ExpandWithOptions(func(string) (string, bool) { return "", false }, ExpandOptions{Strict: true})
+	if !errors.Is(err, ErrUnsetVariable) {
+		t.Errorf("Want error %q, got %v", ErrUnsetVariable, err)
+	}
+}
+
+func TestTree_ExpandWithOptions_ContinueOnError(t *testing.T) {
+	vars := map[string]string{
+		"A": "alpha",
+		"B": "beta",
+	}
+	mapping := func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+	tree := MustParse("a=${A:x} b=${B} c=${C:?required} d=${B:1:${UNSET:-y}} e=${A:1:2}")
+
+	got, err := tree.ExpandWithOptions(mapping, ExpandOptions{ContinueOnError: true, ErrorPlaceholder: "<error>"})
+	if want := "a=<error> b=beta c=<error> d=<error> e=lp"; got != want {
+		t.Errorf("Want expanded to %q, got %q", want, got)
+	}
+	if !errors.Is(err, ErrInvalidArithmetic) || !errors.Is(err, ErrParameterNotSet) {
+		t.Fatalf("Want errors %q and %q, got %v", ErrInvalidArithmetic, ErrParameterNotSet, err)
+	}
+	want := []string{
+		`A: invalid arithmetic expression: "x"`,
+		"C: parameter null or not set: required",
+		`B: invalid arithmetic expression: "y"`,
+	}
+	if diff := cmp.Diff(want, strings.Split(err.Error(), "\n")); diff != "" {
+		t.Errorf("Errors differ (-want +got):\n%s", diff)
+	}
+
+	got, err = tree.ExpandWithOptions(mapping, ExpandOptions{})
+	if !errors.Is(err, ErrInvalidArithmetic) || got != "" {
+		t.Errorf("Want expansion failing with %q by default, got %q, %v", ErrInvalidArithmetic, got, err)
+	}
+
+	got, err = MustParse("${A:-${B:x}}").ExpandWithOptions(mapping, ExpandOptions{ContinueOnError: true})
+	if err != nil || got != "alpha" {
+		t.Errorf("Want words not taken skipped, got %q, %v", got, err)
+	}
+	got, err = MustParse("${UNSET:-${B:x}}!").ExpandWithOptions(mapping, ExpandOptions{ContinueOnError: true})
+	if !errors.Is(err, ErrInvalidArithmetic) || got != "!" {
+		t.Errorf("Want the outermost substitution failing, got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parse
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var update = flag.Bool("update", false, "update the golden files of the parser")
+
+// goldenTests lists the templates whose trees are recorded in the golden
+// file, covering every branch of the parser.
+var goldenTests = []struct {
+	Name string
+	Text string
+	Opts ParseOptions
+}{
+	// parseAny and parseNext
+	{Name: "text", Text: "hello world"},
+	{Name: "escaped dollar", Text: "$$HOME $${HOME}"},
+	{Name: "text and functions", Text: "a ${B} c ${D}"},
+
+	// parseFunc and parseFuncOp
+	{Name: "reference", Text: "${VAR}"},
+	{Name: "positional", Text: "${1}"},
+
+	// parseBare
+	{Name: "bare reference", Text: "$HOME/bin $1", Opts: ParseOptions{AllowBareReferences: true}},
+	{Name: "bare reference in word", Text: "${VAR:-$FALLBACK}", Opts: ParseOptions{AllowBareReferences: true}},
+
+	// parseDefaultOrSubstr and parseSubstrFunc
+	{Name: "substring offset", Text: "${VAR:1}"},
+	{Name: "substring length", Text: "${VAR:1:2}"},
+	{Name: "substring negative offset", Text: "${VAR: -2}"},
+	{Name: "substring nested args", Text: "${VAR:${START}:${COUNT}}"},
+	{Name: "substring mixed args", Text: "${VAR: -${COUNT}}"},
+
+	// parseRemoveFunc
+	{Name: "remove shortest prefix", Text: "${VAR#a*}"},
+	{Name: "remove longest prefix", Text: "${VAR##a*}"},
+	{Name: "remove shortest suffix", Text: "${VAR%*b}"},
+	{Name: "remove longest suffix", Text: "${VAR%%*b}"},
+	{Name: "remove nested pattern", Text: "${VAR#x${B}}"},
+
+	// parseReplaceFunc
+	{Name: "replace first", Text: "${VAR/a/b}"},
+	{Name: "replace all", Text: "${VAR//a/b}"},
+	{Name: "replace prefix", Text: "${VAR/#a/b}"},
+	{Name: "replace suffix", Text: "${VAR/%a/b}"},
+	{Name: "replace empty anchored pattern", Text: "${VAR/#/b}"},
+	{Name: "replace without string", Text: "${VAR/a/}"},
+	{Name: "replace escaped slash", Text: `${VAR/\//-}`},
+
+	// parseDefaultFunc
+	{Name: "assign", Text: "${VAR=a}"},
+	{Name: "assign if empty", Text: "${VAR:=a}"},
+	{Name: "default if unset", Text: "${VAR-a}"},
+	{Name: "default if empty", Text: "${VAR:-a}"},
+	{Name: "error if unset", Text: "${VAR?a}"},
+	{Name: "error if empty", Text: "${VAR:?a}"},
+	{Name: "alternate unless unset", Text: "${VAR+a}"},
+	{Name: "alternate if set", Text: "${VAR:+a}"},
+	{Name: "default nested", Text: "${VAR:-a${B:-c}d}"},
+	{Name: "default escaped brace", Text: `${VAR:-a\}b}`},
+
+	// parseCasingFunc
+	{Name: "lower first", Text: "${VAR,}"},
+	{Name: "lower", Text: "${VAR,,}"},
+	{Name: "upper first", Text: "${VAR^}"},
+	{Name: "upper pattern", Text: "${VAR^^[a-z]}"},
+
+	// parseTransformFunc
+	{Name: "transform", Text: "${VAR@Q}"},
+
+	// parseLenFunc
+	{Name: "length", Text: "${#VAR}"},
+	{Name: "positional count", Text: "${#}"},
+
+	// parseIndirectFunc
+	{Name: "indirect", Text: "${!VAR}"},
+	{Name: "prefix names", Text: "${!PREFIX*} ${!PREFIX@}"},
+
+	// parseArith, parseCmd, parseQuote and parseComment
+	{Name: "arithmetic", Text: "$((1 + (2 * 3)))"},
+	{Name: "arithmetic with reference", Text: "$(( ${N} + 1 ))"},
+	{Name: "arithmetic not closed", Text: "$((1 + ${N}"},
+	{Name: "command", Text: "$(echo (a))", Opts: ParseOptions{AllowCommandSubstitution: true}},
+	{Name: "command with reference", Text: "$(echo ${A})", Opts: ParseOptions{AllowCommandSubstitution: true}},
+	{Name: "command not closed", Text: "$(echo ${A}", Opts: ParseOptions{AllowCommandSubstitution: true}},
+	{Name: "quote", Text: "'${VAR}' ${VAR}", Opts: ParseOptions{AllowSingleQuoteLiterals: true}},
+	{Name: "quote next to text", Text: "'#'^", Opts: ParseOptions{AllowSingleQuoteLiterals: true}},
+	{Name: "comment", Text: "a${// note}b", Opts: ParseOptions{CommentPrefix: "//"}},
+
+	// errors
+	{Name: "missing closing brace", Text: "${VAR"},
+	{Name: "missing offset", Text: "${VAR:}"},
+	{Name: "missing pattern", Text: "${VAR//}"},
+	{Name: "bad substitution", Text: "${VAR:1:2:3}"},
+	{Name: "length operand", Text: "${#VAR:1}"},
+	{Name: "unknown transformation", Text: "${VAR@Z}"},
+	{Name: "command disallowed", Text: "$(echo)"},
+	{Name: "unsupported operator", Text: "${VAR//a/b}", Opts: ParseOptions{Mode: ModePOSIX}},
+}
+
+// goldenEntry is the record of a template in the golden file.
+type goldenEntry struct {
+	Name  string `json:"name"`
+	Text  string `json:"text"`
+	Tree  *Tree  `json:"tree,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// TestParse_Golden compares the trees of goldenTests with the ones
+// recorded in testdata/parse.golden.json. Run the tests with -update to
+// record the trees again after changing the parser on purpose.
+func TestParse_Golden(t *testing.T) {
+	entries := make([]goldenEntry, 0, len(goldenTests))
+	for _, test := range goldenTests {
+		entry := goldenEntry{Name: test.Name, Text: test.Text}
+		tree, err := ParseWithOptions(test.Text, test.Opts)
+		if err != nil {
+			entry.Error = err.Error()
+		} else {
+			entry.Tree = tree
+		}
+		entries = append(entries, entry)
+	}
+	got, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = append(got, '\n')
+
+	golden := filepath.Join("testdata", "parse.golden.json")
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(golden), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("Trees differ from %s, run the tests with -update if the change is expected:\n%s",
+			golden, cmp.Diff(string(want), string(got)))
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parse
+
+import "encoding/json"
+
+// jsonNode is the JSON representation of a node. Only the fields
+// relevant to the type of the node are set.
+type jsonNode struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	Unclosed bool   `json:"unclosed,omitempty"`
+	Quoted   bool   `json:"quoted,omitempty"`
+	Param    string `json:"param,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Args     []Node `json:"args,omitempty"`
+	Global   bool   `json:"global,omitempty"`
+	Nodes    []Node `json:"nodes,omitempty"`
+	Expr     string `json:"expr,omitempty"`
+	Command  string `json:"command,omitempty"`
+}
+
+// MarshalJSON encodes the tree as the JSON representation of its root
+// node, or null if the tree is empty.
+func (t *Tree) MarshalJSON() ([]byte, error) {
+	if t == nil || t.Root == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(t.Root)
+}
+
+// MarshalJSON encodes the text node as {"type": "text", "text": ...,
+// "unclosed": true, "quoted": true}, omitting the flags unless set.
+func (t *TextNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{
+		Type:     t.Type().String(),
+		Text:     t.Value,
+		Unclosed: t.Unclosed,
+		Quoted:   t.Quoted,
+	})
+}
+
+// MarshalJSON encodes the list node as {"type": "list", "nodes": [...]}.
+func (l *ListNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{Type: l.Type().String(), Nodes: l.Nodes})
+}
+
+// MarshalJSON encodes the function node as {"type": "func", "param": ...,
+// "name": ..., "args": [...], "global": true}, omitting the name of plain
+// references, the arguments of functions without any and global unless
+// set.
+func (f *FuncNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{Type: f.Type().String(), Param: f.Param, Name: f.Name, Args: f.Args, Global: f.Global})
+}
+
+// MarshalJSON encodes the arithmetic expansion as {"type": "arith",
+// "expr": ..., "nodes": [...]}, omitting the nodes of plain expressions.
+func (a *ArithNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{Type: a.Type().String(), Expr: a.Expr, Nodes: a.Nodes})
+}
+
+// MarshalJSON encodes the command substitution as {"type": "cmd",
+// "command": ..., "nodes": [...]}, omitting the nodes of plain commands.
+func (c *CmdNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{Type: c.Type().String(), Command: c.Command, Nodes: c.Nodes})
+}
+
+// MarshalJSON encodes the comment as {"type": "comment", "text": ...}.
+func (c *CommentNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode{Type: c.Type().String(), Text: c.Text})
+}
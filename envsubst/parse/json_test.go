@@ -0,0 +1,94 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parse
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTree_MarshalJSON(t *testing.T) {
+	tests := []struct {
+		Text string
+		Want string
+	}{
+		{
+			Text: "${FOO:-bar}",
+			Want: `{"type":"func","param":"FOO","name":":-","args":[{"type":"text","text":"bar"}]}`,
+		},
+		{
+			Text: "a ${FOO}",
+			Want: `{"type":"list","nodes":[{"type":"text","text":"a "},{"type":"func","param":"FOO"}]}`,
+		},
+		{
+			Text: "${FOO:-${BAR,,}}",
+			Want: `{"type":"func","param":"FOO","name":":-","args":[{"type":"func","param":"BAR","name":",,"}]}`,
+		},
+		{
+			Text: "${FOO//a/b}",
+			Want: `{"type":"func","param":"FOO","name":"//","args":[{"type":"text","text":"a"},{"type":"text","text":"b"}],"global":true}`,
+		},
+		{
+			Text: "$((1 + 2))",
+			Want: `{"type":"arith","expr":"1 + 2"}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.Marshal(tree)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Want, string(got)); diff != "" {
+				t.Errorf(diff)
+			}
+		})
+	}
+}
+
+func TestTree_MarshalJSON_Fields(t *testing.T) {
+	got, err := json.Marshal(MustParse("${FOO:-bar}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var node map[string]any
+	if err := json.Unmarshal(got, &node); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"type":  "func",
+		"param": "FOO",
+		"name":  ":-",
+		"args": []any{
+			map[string]any{"type": "text", "text": "bar"},
+		},
+	}
+	if diff := cmp.Diff(want, node); diff != "" {
+		t.Errorf(diff)
+	}
+
+	var empty *Tree
+	if got, _ := json.Marshal(empty); string(got) != "null" {
+		t.Errorf("Want an empty tree encoded as null, got %s", got)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parse
+
+import "fmt"
+
+// Token identifies the type of a lexical token returned by a Lexer.
+type Token int
+
+const (
+	TokenIllegal Token = iota // An unrecognized character.
+	TokenEOF                  // The end of the input.
+	TokenIdent                // Text, including variable names and operators.
+	TokenLbrack               // The "${" opening a substitution.
+	TokenRbrack               // The "}" closing a substitution.
+)
+
+// String returns the name of the token.
+func (t Token) String() string {
+	switch t {
+	case TokenIllegal:
+		return "Illegal"
+	case TokenEOF:
+		return "EOF"
+	case TokenIdent:
+		return "Ident"
+	case TokenLbrack:
+		return "Lbrack"
+	case TokenRbrack:
+		return "Rbrack"
+	default:
+		return fmt.Sprintf("Token(%d)", int(t))
+	}
+}
+
+// Lexer splits a template into lexical tokens, without parsing the
+// substitutions. It is meant for tooling such as syntax highlighters.
+type Lexer struct {
+	scanner scanner
+	depth   int
+}
+
+// NewLexer returns a Lexer reading the tokens of buf.
+func NewLexer(buf string) *Lexer {
+	l := new(Lexer)
+	l.scanner.init(buf)
+	return l
+}
+
+// Next returns the next token and its text as it appears in the input,
+// escape characters included. It returns TokenEOF at the end of the
+// input.
+func (l *Lexer) Next() (Token, string) {
+	s := &l.scanner
+	s.accept = acceptRune
+	s.mode = scanIdent | scanLbrack | scanEscape
+	s.escapeChars = dollar
+	if l.depth > 0 {
+		s.accept = acceptNotClosing
+		s.mode |= scanRbrack
+		s.escapeChars = dollar | rbrace
+	}
+
+	tok := s.scan()
+	text := s.buf[s.start:s.pos]
+	switch tok {
+	case tokenEOF:
+		return TokenEOF, ""
+	case tokenIdent:
+		return TokenIdent, text
+	case tokenLbrack:
+		l.depth++
+		return TokenLbrack, text
+	case tokenRbrack:
+		l.depth--
+		return TokenRbrack, text
+	}
+	return TokenIllegal, text
+}
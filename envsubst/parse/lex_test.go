@@ -0,0 +1,111 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parse
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type lexItem struct {
+	Token Token
+	Text  string
+}
+
+func lexAll(buf string) []lexItem {
+	var items []lexItem
+	l := NewLexer(buf)
+	for {
+		tok, text := l.Next()
+		items = append(items, lexItem{tok, text})
+		if tok == TokenEOF || tok == TokenIllegal {
+			return items
+		}
+	}
+}
+
+func TestLexer(t *testing.T) {
+	tests := []struct {
+		Text string
+		Want []lexItem
+	}{
+		{
+			Text: "abc${FOO:-x}def",
+			Want: []lexItem{
+				{TokenIdent, "abc"},
+				{TokenLbrack, "${"},
+				{TokenIdent, "FOO:-x"},
+				{TokenRbrack, "}"},
+				{TokenIdent, "def"},
+				{TokenEOF, ""},
+			},
+		},
+		{
+			Text: "${a:-${b}}}",
+			Want: []lexItem{
+				{TokenLbrack, "${"},
+				{TokenIdent, "a:-"},
+				{TokenLbrack, "${"},
+				{TokenIdent, "b"},
+				{TokenRbrack, "}"},
+				{TokenRbrack, "}"},
+				{TokenIdent, "}"},
+				{TokenEOF, ""},
+			},
+		},
+		{
+			Text: `$${a} ${b:-\}}`,
+			Want: []lexItem{
+				{TokenIdent, "$${a} "},
+				{TokenLbrack, "${"},
+				{TokenIdent, `b:-\}`},
+				{TokenRbrack, "}"},
+				{TokenEOF, ""},
+			},
+		},
+		{
+			Text: "",
+			Want: []lexItem{
+				{TokenEOF, ""},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			got := lexAll(test.Text)
+			if diff := cmp.Diff(test.Want, got); diff != "" {
+				t.Errorf(diff)
+			}
+		})
+	}
+}
+
+func TestLexer_Source(t *testing.T) {
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			var b strings.Builder
+			for _, item := range lexAll(test.Text) {
+				b.WriteString(item.Text)
+			}
+			if got := b.String(); got != test.Text {
+				t.Errorf("Want tokens joined into %q, got %q", test.Text, got)
+			}
+		})
+	}
+}
@@ -20,11 +20,125 @@ limitations under the License.
 
 package parse
 
+import (
+	"strings"
+	"unicode/utf8"
+)
+
 // Node is an element in the parse tree.
 type Node interface {
+	// Type returns the type of the node.
+	Type() NodeType
+	// String returns the template source of the node.
+	String() string
+	// Source returns the span of the input the node was parsed from.
+	Source() Span
 	node()
 }
 
+// Span is the range of bytes of the input a node was parsed from,
+// recorded when parsing with ParseOptions.TrackSource. It is zero
+// otherwise, and for the nodes created by the parser without a source,
+// such as the empty pattern of ${VAR/#/x}.
+type Span struct {
+	// Start is the offset of the first byte of the node.
+	Start int
+	// End is the offset following the last byte of the node.
+	End int
+}
+
+// Source returns the span.
+func (s Span) Source() Span {
+	return s
+}
+
+// setSource sets the span to the range start to end.
+func (s *Span) setSource(start, end int) {
+	s.Start, s.End = start, end
+}
+
+// NodeType identifies the type of a parse tree node.
+type NodeType int
+
+const (
+	NodeText    NodeType = iota // Plain text.
+	NodeList                    // A list of nodes.
+	NodeFunc                    // A variable reference or string function.
+	NodeArith                   // An arithmetic expansion.
+	NodeCmd                     // A command substitution.
+	NodeComment                 // A comment.
+)
+
+// String returns the lowercase name of the node type.
+func (t NodeType) String() string {
+	switch t {
+	case NodeText:
+		return "text"
+	case NodeList:
+		return "list"
+	case NodeFunc:
+		return "func"
+	case NodeArith:
+		return "arith"
+	case NodeCmd:
+		return "cmd"
+	case NodeComment:
+		return "comment"
+	default:
+		return "unknown"
+	}
+}
+
+// Op identifies the operation of a FuncNode.
+type Op int
+
+const (
+	OpUnknown              Op = iota // An unrecognized operator.
+	OpNone                           // ${param}
+	OpLength                         // ${#param}
+	OpIndirect                       // ${!param}
+	OpLowerFirst                     // ${param,}
+	OpLower                          // ${param,,}
+	OpUpperFirst                     // ${param^}
+	OpUpper                          // ${param^^}
+	OpSubstring                      // ${param:offset:length}
+	OpRemoveShortestPrefix           // ${param#word}
+	OpRemoveLongestPrefix            // ${param##word}
+	OpRemoveShortestSuffix           // ${param%word}
+	OpRemoveLongestSuffix            // ${param%%word}
+	OpReplaceFirst                   // ${param/pattern/string}
+	OpReplaceAll                     // ${param//pattern/string}
+	OpReplacePrefix                  // ${param/#pattern/string}
+	OpReplaceSuffix                  // ${param/%pattern/string}
+	OpAssign                         // ${param=word}
+	OpAssignIfEmpty                  // ${param:=word}
+	OpDefaultIfEmpty                 // ${param:-word}
+	OpErrorIfEmpty                   // ${param:?word}
+	OpAlternateIfSet                 // ${param:+word}
+	OpTransform                      // ${param@operator}
+	OpPrefixNames                    // ${!prefix*} or ${!prefix@}
+	OpDefaultIfUnset                 // ${param-word}
+	OpErrorIfUnset                   // ${param?word}
+	OpAlternateUnlessUnset           // ${param+word}
+)
+
+// OperatorSet is a set of function operations, see Tree.Validate.
+type OperatorSet map[Op]bool
+
+// NewOperatorSet returns the set of the given operations.
+func NewOperatorSet(ops ...Op) OperatorSet {
+	s := make(OperatorSet, len(ops))
+	for _, op := range ops {
+		s[op] = true
+	}
+	return s
+}
+
+// Has reports whether op is in the set.
+func (s OperatorSet) Has(op Op) bool {
+	return s[op]
+}
+
 // empty string node
 var empty = new(TextNode)
 
@@ -33,21 +147,62 @@ var empty = new(TextNode)
 type (
 	// TextNode represents a string of text.
 	TextNode struct {
+		Span
 		Value string
+		// Unclosed is set for the text read from an arithmetic expansion
+		// or a command substitution missing its closing parentheses, e.g.
+		// "$(echo", which starts with the opening. The opening is not
+		// escaped by String, so that it is read back the same.
+		Unclosed bool
+		// Quoted is set for the text read between single quotes with
+		// AllowSingleQuoteLiterals, which String quotes again.
+		Quoted bool
 	}
 
 	// FuncNode represents a string function.
 	FuncNode struct {
+		Span
 		Param string
 		Name  string
 		Args  []Node
+		// Global is set for the replace function replacing all the
+		// matches of the pattern, i.e. ${param//pattern/string}.
+		Global bool
 	}
 
 	// ListNode represents a list of nodes.
 	ListNode struct {
+		Span
 		Nodes []Node
 	}
 
+	// ArithNode represents an arithmetic expansion. Expr is the source
+	// of the expression, and Nodes its text and substitutions, e.g. ${N}
+	// in $((${N} + 1)), which are expanded. Nodes is nil when Expr is
+	// plain text, which is written as it is.
+	ArithNode struct {
+		Span
+		Expr  string
+		Nodes []Node
+	}
+
+	// CmdNode represents a command substitution. Command is the source
+	// of the command, and Nodes its text and substitutions, which are
+	// expanded like those of an ArithNode.
+	CmdNode struct {
+		Span
+		Command string
+		Nodes   []Node
+	}
+
+	// CommentNode represents a comment, i.e. a substitution whose body
+	// starts with ParseOptions.CommentPrefix. Text is the body of the
+	// comment, including the prefix.
+	CommentNode struct {
+		Span
+		Text string
+	}
+
 	// ParamNode struct{
 	// 	Name string
 	// }
@@ -99,8 +254,528 @@ func newFuncNode(name string) *FuncNode {
 	return &FuncNode{Param: name}
 }
 
+// newArithNode returns a new ArithNode.
+func newArithNode(expr string) *ArithNode {
+	return &ArithNode{Expr: expr}
+}
+
+// newCmdNode returns a new CmdNode.
+func newCmdNode(command string) *CmdNode {
+	return &CmdNode{Command: command}
+}
+
+// newCommentNode returns a new CommentNode.
+func newCommentNode(text string) *CommentNode {
+	return &CommentNode{Text: text}
+}
+
 // node() defines the node in a parse tree
 
-func (*TextNode) node() {}
-func (*ListNode) node() {}
-func (*FuncNode) node() {}
+func (*TextNode) node()    {}
+func (*ListNode) node()    {}
+func (*FuncNode) node()    {}
+func (*ArithNode) node()   {}
+func (*CmdNode) node()     {}
+func (*CommentNode) node() {}
+
+// Type returns the type of the node.
+
+func (*TextNode) Type() NodeType    { return NodeText }
+func (*ListNode) Type() NodeType    { return NodeList }
+func (*FuncNode) Type() NodeType    { return NodeFunc }
+func (*ArithNode) Type() NodeType   { return NodeArith }
+func (*CmdNode) Type() NodeType     { return NodeCmd }
+func (*CommentNode) Type() NodeType { return NodeComment }
+
+// String returns the text with the dollar signs escaped.
+func (t *TextNode) String() string {
+	return defaultSyntax.render(t)
+}
+
+// String returns the concatenated source of the nodes.
+func (l *ListNode) String() string {
+	return defaultSyntax.render(l)
+}
+
+// Flatten returns the nodes of the list in source order, replacing the
+// nested lists with their own nodes, so that the segments of a template
+// can be ranged over directly. The list itself is not modified.
+func (l *ListNode) Flatten() []Node {
+	var nodes []Node
+	for _, n := range l.Nodes {
+		if list, ok := n.(*ListNode); ok {
+			nodes = append(nodes, list.Flatten()...)
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// String returns the source of the arithmetic expansion.
+func (a *ArithNode) String() string {
+	return "$((" + a.Expr + "))"
+}
+
+// String returns the source of the command substitution.
+func (c *CmdNode) String() string {
+	return "$(" + c.Command + ")"
+}
+
+// String returns the source of the comment.
+func (c *CommentNode) String() string {
+	return defaultSyntax.render(c)
+}
+
+// String returns the source of the substitution, including its operator
+// and arguments.
+func (f *FuncNode) String() string {
+	return defaultSyntax.render(f)
+}
+
+// syntax holds the delimiters and escaping the nodes are rendered with,
+// those of the options a tree was parsed with.
+type syntax struct {
+	sigil, lbrack, rbrack rune
+	// backslashes doubles the backslashes of the text and of the default
+	// words, read back as single ones with UnescapeBackslashes.
+	backslashes bool
+	// ident accepts the first rune of the references without braces, or
+	// is nil if they are not recognized.
+	ident acceptFunc
+	// quotes writes the quoted text between single quotes, read back
+	// verbatim with AllowSingleQuoteLiterals.
+	quotes bool
+}
+
+// defaultSyntax renders the nodes with the default delimiters.
+var defaultSyntax = syntax{sigil: '$', lbrack: '{', rbrack: '}'}
+
+// render returns the template source of the node.
+func (syn syntax) render(node Node) string {
+	var b strings.Builder
+	syn.write(&b, node)
+	return b.String()
+}
+
+// write writes the template source of the node to b.
+func (syn syntax) write(b *strings.Builder, node Node) {
+	switch n := node.(type) {
+	case *TextNode:
+		if syn.quotes && n.Quoted {
+			b.WriteString("'" + n.Value + "'")
+			break
+		}
+		syn.writeText(b, n, func(s string) string {
+			return syn.escape(syn.escapeBackslashes(s), string(syn.sigil), "")
+		})
+	case *ListNode:
+		for _, child := range n.Nodes {
+			syn.write(b, child)
+		}
+	case *FuncNode:
+		syn.writeFunc(b, n)
+	case *CommentNode:
+		b.WriteString(string(syn.sigil) + string(syn.lbrack) + n.Text + string(syn.rbrack))
+	case nil:
+	default:
+		b.WriteString(node.String())
+	}
+}
+
+// writeText writes the text of the node escaped by esc, but for the
+// opening of an unclosed text.
+func (syn syntax) writeText(b *strings.Builder, n *TextNode, esc func(string) string) {
+	v := n.Value
+	if n.Unclosed && strings.HasPrefix(v, "$(") {
+		b.WriteString("$(")
+		v = v[len("$("):]
+	}
+	b.WriteString(esc(v))
+}
+
+// escapeBackslashes returns s with the backslashes doubled if the scanner
+// unescapes them.
+func (syn syntax) escapeBackslashes(s string) string {
+	if !syn.backslashes {
+		return s
+	}
+	return strings.ReplaceAll(s, `\`, `\\`)
+}
+
+// writeFunc writes the source of the substitution f to b, including its
+// operator and arguments.
+func (syn syntax) writeFunc(b *strings.Builder, f *FuncNode) {
+	b.WriteRune(syn.sigil)
+	b.WriteRune(syn.lbrack)
+	switch f.Name {
+	case "!":
+		b.WriteString(f.Name + f.Param)
+	case "!*", "!@":
+		b.WriteString("!" + f.Param + f.Name[1:])
+	case "#":
+		if len(f.Args) == 0 {
+			b.WriteString(f.Name + f.Param)
+			break
+		}
+		fallthrough
+	case "##", "%", "%%", ",", ",,", "^", "^^", "@":
+		// the patterns are scanned without escape characters
+		b.WriteString(f.Param + f.Name)
+		syn.writeArgs(b, f.Args, "", nil)
+	case ":":
+		b.WriteString(f.Param + f.Name)
+		syn.writeArgs(b, f.Args, ":", nil)
+	case "/", "//", "/#", "/%":
+		b.WriteString(f.Param + f.Name)
+		syn.writeArgs(b, f.Args, "/", func(s string) string {
+			return syn.escape(s, "\\", string(syn.sigil)+"/")
+		})
+		if len(f.Args) < 2 {
+			// the parser always expects the replacement delimiter
+			b.WriteString("/")
+		}
+	default:
+		b.WriteString(f.Param + f.Name)
+		syn.writeArgs(b, f.Args, "", func(s string) string {
+			return syn.escape(syn.escapeBackslashes(s), "", string(syn.sigil)+string(syn.rbrack))
+		})
+	}
+	b.WriteRune(syn.rbrack)
+}
+
+// Op returns the operation of the function, as identified by its Name
+// and number of arguments.
+func (f *FuncNode) Op() Op {
+	switch f.Name {
+	case "":
+		return OpNone
+	case "!":
+		return OpIndirect
+	case ",":
+		return OpLowerFirst
+	case ",,":
+		return OpLower
+	case "^":
+		return OpUpperFirst
+	case "^^":
+		return OpUpper
+	case ":":
+		return OpSubstring
+	case "#":
+		if len(f.Args) == 0 {
+			return OpLength
+		}
+		return OpRemoveShortestPrefix
+	case "##":
+		return OpRemoveLongestPrefix
+	case "%":
+		return OpRemoveShortestSuffix
+	case "%%":
+		return OpRemoveLongestSuffix
+	case "/":
+		return OpReplaceFirst
+	case "//":
+		return OpReplaceAll
+	case "/#":
+		return OpReplacePrefix
+	case "/%":
+		return OpReplaceSuffix
+	case "=":
+		return OpAssign
+	case ":=":
+		return OpAssignIfEmpty
+	case "-":
+		return OpDefaultIfUnset
+	case ":-":
+		return OpDefaultIfEmpty
+	case "?":
+		return OpErrorIfUnset
+	case ":?":
+		return OpErrorIfEmpty
+	case "+":
+		return OpAlternateUnlessUnset
+	case ":+":
+		return OpAlternateIfSet
+	case "@":
+		return OpTransform
+	case "!*", "!@":
+		return OpPrefixNames
+	default:
+		return OpUnknown
+	}
+}
+
+// Costs of the nodes estimated by Cost.
+const (
+	// funcCost is the cost of a substitution, arithmetic expansion or
+	// command substitution, to which the number of arguments is added.
+	funcCost = 1
+	// replaceCost is added for the replace functions, which scan the
+	// whole value for the pattern.
+	replaceCost = 8
+)
+
+// Cost returns an estimate of the work needed to evaluate the function,
+// including its nested arguments. It grows with the number of arguments
+// and nested functions, and is higher for replace functions.
+func (f *FuncNode) Cost() int {
+	cost := funcCost + len(f.Args)
+	switch f.Op() {
+	case OpReplaceFirst, OpReplaceAll, OpReplacePrefix, OpReplaceSuffix:
+		cost += replaceCost
+	}
+	for _, arg := range f.Args {
+		cost += nodeCost(arg)
+	}
+	return cost
+}
+
+// nodeCost returns the estimated cost of evaluating the node.
+func nodeCost(node Node) int {
+	switch n := node.(type) {
+	case *FuncNode:
+		return n.Cost()
+	case *ListNode:
+		var cost int
+		for _, child := range n.Nodes {
+			cost += nodeCost(child)
+		}
+		return cost
+	case *ArithNode:
+		cost := funcCost
+		for _, child := range n.Nodes {
+			cost += nodeCost(child)
+		}
+		return cost
+	case *CmdNode:
+		cost := funcCost
+		for _, child := range n.Nodes {
+			cost += nodeCost(child)
+		}
+		return cost
+	default:
+		return 0
+	}
+}
+
+// Walk traverses the tree depth-first in source order, calling fn for
+// each node. The children of a ListNode are visited in order, and the
+// arguments of a FuncNode and the nodes of an ArithNode or a CmdNode are
+// visited in order after the node itself. If fn returns false, the
+// children of the node are skipped.
+func Walk(tree *Tree, fn func(Node) bool) {
+	if tree == nil || tree.Root == nil {
+		return
+	}
+	walk(tree.Root, fn)
+}
+
+func walk(node Node, fn func(Node) bool) {
+	if !fn(node) {
+		return
+	}
+	switch n := node.(type) {
+	case *ListNode:
+		for _, child := range n.Nodes {
+			walk(child, fn)
+		}
+	case *FuncNode:
+		for _, arg := range n.Args {
+			walk(arg, fn)
+		}
+	case *ArithNode:
+		for _, child := range n.Nodes {
+			walk(child, fn)
+		}
+	case *CmdNode:
+		for _, child := range n.Nodes {
+			walk(child, fn)
+		}
+	}
+}
+
+// TreesEqual reports whether the trees a and b are structurally equal,
+// comparing the type and fields of their nodes recursively. The source
+// spans of the nodes are not compared.
+func TreesEqual(a, b *Tree) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return nodesEqual(a.Root, b.Root)
+}
+
+func nodesEqual(a, b Node) bool {
+	switch a := a.(type) {
+	case *TextNode:
+		b, ok := b.(*TextNode)
+		return ok && a.Value == b.Value && a.Unclosed == b.Unclosed && a.Quoted == b.Quoted
+	case *ListNode:
+		b, ok := b.(*ListNode)
+		return ok && nodeListsEqual(a.Nodes, b.Nodes)
+	case *FuncNode:
+		b, ok := b.(*FuncNode)
+		return ok && a.Param == b.Param && a.Name == b.Name && a.Global == b.Global && nodeListsEqual(a.Args, b.Args)
+	case *ArithNode:
+		b, ok := b.(*ArithNode)
+		return ok && a.Expr == b.Expr && nodeListsEqual(a.Nodes, b.Nodes)
+	case *CmdNode:
+		b, ok := b.(*CmdNode)
+		return ok && a.Command == b.Command && nodeListsEqual(a.Nodes, b.Nodes)
+	case *CommentNode:
+		b, ok := b.(*CommentNode)
+		return ok && a.Text == b.Text
+	case nil:
+		return b == nil
+	}
+	return false
+}
+
+// simplify returns the node with its lists flattened and their adjacent
+// text nodes merged, see Tree.Simplify. A list left with a single node
+// is replaced by that node.
+func simplify(node Node) Node {
+	switch n := node.(type) {
+	case *ListNode:
+		var nodes []Node
+		for _, child := range n.Flatten() {
+			child = simplify(child)
+			// an unclosed text is kept apart, its opening would be
+			// escaped past the start of the merged text, and so is a
+			// quoted text, rendered between its quotes
+			if text, ok := child.(*TextNode); ok && !text.Unclosed && !text.Quoted && len(nodes) > 0 {
+				if prev, ok := nodes[len(nodes)-1].(*TextNode); ok && !prev.Quoted {
+					nodes[len(nodes)-1] = &TextNode{
+						Span:     Span{Start: prev.Start, End: text.End},
+						Value:    prev.Value + text.Value,
+						Unclosed: prev.Unclosed,
+					}
+					continue
+				}
+			}
+			nodes = append(nodes, child)
+		}
+		if len(nodes) == 1 {
+			return nodes[0]
+		}
+		return &ListNode{Span: n.Span, Nodes: nodes}
+	case *FuncNode:
+		for i, arg := range n.Args {
+			n.Args[i] = simplify(arg)
+		}
+	case *ArithNode:
+		for i, child := range n.Nodes {
+			n.Nodes[i] = simplify(child)
+		}
+	case *CmdNode:
+		for i, child := range n.Nodes {
+			n.Nodes[i] = simplify(child)
+		}
+	}
+	return node
+}
+
+// cloneNode returns a deep copy of the node.
+func cloneNode(node Node) Node {
+	switch n := node.(type) {
+	case *TextNode:
+		return &TextNode{Span: n.Span, Value: n.Value, Unclosed: n.Unclosed, Quoted: n.Quoted}
+	case *ListNode:
+		return &ListNode{Span: n.Span, Nodes: cloneNodes(n.Nodes)}
+	case *FuncNode:
+		return &FuncNode{Span: n.Span, Param: n.Param, Name: n.Name, Args: cloneNodes(n.Args), Global: n.Global}
+	case *ArithNode:
+		return &ArithNode{Span: n.Span, Expr: n.Expr, Nodes: cloneNodes(n.Nodes)}
+	case *CmdNode:
+		return &CmdNode{Span: n.Span, Command: n.Command, Nodes: cloneNodes(n.Nodes)}
+	case *CommentNode:
+		return &CommentNode{Span: n.Span, Text: n.Text}
+	}
+	return node
+}
+
+// cloneNodes returns a deep copy of the nodes, or nil if there are none.
+func cloneNodes(nodes []Node) []Node {
+	if nodes == nil {
+		return nil
+	}
+	clones := make([]Node, len(nodes))
+	for i, n := range nodes {
+		clones[i] = cloneNode(n)
+	}
+	return clones
+}
+
+func nodeListsEqual(a, b []Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !nodesEqual(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeArgs writes the function arguments separated by sep. Text
+// arguments are passed through esc, or written verbatim if esc is nil
+// since they are not unescaped by the scanner.
+func (syn syntax) writeArgs(b *strings.Builder, args []Node, sep string, esc func(string) string) {
+	for i, arg := range args {
+		if i > 0 {
+			b.WriteString(sep)
+		}
+		if list, ok := arg.(*ListNode); ok {
+			syn.writeArgs(b, list.Nodes, "", esc)
+			continue
+		}
+		if text, ok := arg.(*TextNode); ok {
+			if esc != nil {
+				syn.writeText(b, text, esc)
+				continue
+			}
+			b.WriteString(text.Value)
+			continue
+		}
+		syn.write(b, arg)
+	}
+}
+
+// escape doubles the escape characters of s found in chars when the
+// scanner would otherwise interpret them, and prefixes the runes found
+// in delims with a backslash.
+func (syn syntax) escape(s, chars, delims string) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case strings.ContainsRune(delims, r):
+			b.WriteRune('\\')
+		case strings.ContainsRune(chars, r) && syn.escapes(r, s[i+1:]):
+			b.WriteRune(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// escapes returns true if the escape character r must be doubled
+// when followed by next.
+func (syn syntax) escapes(r rune, next string) bool {
+	if next == "" {
+		return true
+	}
+	switch r {
+	case syn.sigil:
+		n, _ := utf8.DecodeRuneInString(next)
+		if syn.ident != nil && syn.ident(n, 1) {
+			// a reference without braces
+			return true
+		}
+		// "$(" only opens a command substitution with the default sigil
+		return n == syn.sigil || n == syn.lbrack || n == '(' && r == '$'
+	case '\\':
+		return next[0] == '\\' || next[0] == '/'
+	}
+	return false
+}
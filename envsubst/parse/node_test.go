@@ -0,0 +1,403 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parse
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWalk(t *testing.T) {
+	tree, err := Parse("a ${b=c${d}} ${e:${f}:g}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	Walk(tree, func(n Node) bool {
+		switch n := n.(type) {
+		case *TextNode:
+			got = append(got, "text:"+n.Value)
+		case *FuncNode:
+			got = append(got, "func:"+n.Param)
+		}
+		return true
+	})
+
+	want := []string{
+		"text:a ",
+		"func:b",
+		"text:c",
+		"func:d",
+		"text: ",
+		"func:e",
+		"func:f",
+		"text:g",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestWalk_SkipChildren(t *testing.T) {
+	tree, err := Parse("${a=${b}}${c}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	Walk(tree, func(n Node) bool {
+		if n, ok := n.(*FuncNode); ok {
+			got = append(got, n.Param)
+			return false
+		}
+		return true
+	})
+
+	want := []string{"a", "c"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestNodeType(t *testing.T) {
+	tree, err := Parse("a${b}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []NodeType
+	Walk(tree, func(n Node) bool {
+		got = append(got, n.Type())
+		return true
+	})
+
+	want := []NodeType{NodeList, NodeText, NodeFunc}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		Text string
+		Want string
+	}{
+		{Text: "text", Want: "text"},
+		{Text: "$${string} $$string", Want: "$${string} $string"},
+		{Text: "cost $5", Want: "cost $5"},
+		{Text: "${string}", Want: "${string}"},
+		{Text: "${string,}${string,,}${string^}${string^^}", Want: "${string,}${string,,}${string^}${string^^}"},
+		{Text: "${string:position}", Want: "${string:position}"},
+		{Text: "${string:position:length}", Want: "${string:position:length}"},
+		{Text: "${string#sub}${string##sub}", Want: "${string#sub}${string##sub}"},
+		{Text: "${string%sub}${string%%sub}", Want: "${string%sub}${string%%sub}"},
+		{Text: "${string/sub/rep}${string//sub/rep}", Want: "${string/sub/rep}${string//sub/rep}"},
+		{Text: "${string/#sub/rep}${string/%sub/rep}", Want: "${string/#sub/rep}${string/%sub/rep}"},
+		{Text: "${string/./}", Want: "${string/./}"},
+		{Text: `${string/\/position\\/\/length}`, Want: `${string/\/position\\/\/length}`},
+		{Text: "${string=default}${string:=default}", Want: "${string=default}${string:=default}"},
+		{Text: "${string:-default}${string:?default}${string:+default}", Want: "${string:-default}${string:?default}${string:+default}"},
+		{Text: "${#string}", Want: "${#string}"},
+		{Text: "${!string}", Want: "${!string}"},
+		{Text: "$((a+b))", Want: "$((a+b))"},
+		{Text: "$(( (a+b) * ${c} ))$$((d))", Want: "$(( (a+b) * ${c} ))$$((d))"},
+		{Text: "${string#$%:*{}", Want: "${string#$%:*{}"},
+		{Text: "a$${string=prefix-${var}-suffix}", Want: "a$${string=prefix-${var}-suffix}"},
+		{Text: "${string:${stringy:position:length}:${stringz,,}}", Want: "${string:${stringy:position:length}:${stringz,,}}"},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tree.String(); got != test.Want {
+				t.Errorf("Want %q rendered as %q, got %q", test.Text, test.Want, got)
+			}
+		})
+	}
+}
+
+func TestString_RoundTrip(t *testing.T) {
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Parse(tree.String())
+			if err != nil {
+				t.Fatalf("Failed to parse %q: %v", tree.String(), err)
+			}
+			if diff := cmp.Diff(tree.Root, got.Root); diff != "" {
+				t.Errorf(diff)
+			}
+		})
+	}
+}
+
+func TestFuncNode_Op(t *testing.T) {
+	tests := []struct {
+		Text string
+		Op   Op
+	}{
+		{Text: "${VAR}", Op: OpNone},
+		{Text: "${#VAR}", Op: OpLength},
+		{Text: "${!VAR}", Op: OpIndirect},
+		{Text: "${VAR,}", Op: OpLowerFirst},
+		{Text: "${VAR,,}", Op: OpLower},
+		{Text: "${VAR^}", Op: OpUpperFirst},
+		{Text: "${VAR^^[a-z]}", Op: OpUpper},
+		{Text: "${VAR:1:2}", Op: OpSubstring},
+		{Text: "${VAR#word}", Op: OpRemoveShortestPrefix},
+		{Text: "${VAR##word}", Op: OpRemoveLongestPrefix},
+		{Text: "${VAR%word}", Op: OpRemoveShortestSuffix},
+		{Text: "${VAR%%word}", Op: OpRemoveLongestSuffix},
+		{Text: "${VAR/a/b}", Op: OpReplaceFirst},
+		{Text: "${VAR//a/b}", Op: OpReplaceAll},
+		{Text: "${VAR/#a/b}", Op: OpReplacePrefix},
+		{Text: "${VAR/%a/b}", Op: OpReplaceSuffix},
+		{Text: "${VAR=word}", Op: OpAssign},
+		{Text: "${VAR:=word}", Op: OpAssignIfEmpty},
+		{Text: "${VAR-word}", Op: OpDefaultIfUnset},
+		{Text: "${VAR:-word}", Op: OpDefaultIfEmpty},
+		{Text: "${VAR?word}", Op: OpErrorIfUnset},
+		{Text: "${VAR:?word}", Op: OpErrorIfEmpty},
+		{Text: "${VAR+word}", Op: OpAlternateUnlessUnset},
+		{Text: "${VAR:+word}", Op: OpAlternateIfSet},
+		{Text: "${VAR@Q}", Op: OpTransform},
+		{Text: "${!VAR*}", Op: OpPrefixNames},
+		{Text: "${!VAR@}", Op: OpPrefixNames},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fn, ok := tree.Root.(*FuncNode)
+			if !ok {
+				t.Fatalf("Want FuncNode, got %T", tree.Root)
+			}
+			if got := fn.Op(); got != test.Op {
+				t.Errorf("Want op %d, got %d", test.Op, got)
+			}
+		})
+	}
+}
+
+func TestTreesEqual(t *testing.T) {
+	tests := []struct {
+		A, B  string
+		Equal bool
+	}{
+		{A: "${A:-x}", B: "${A:-x}", Equal: true},
+		{A: "$${A}", B: "$${A}", Equal: true},
+		{A: `${A/\//x}`, B: `${A/\//x}`, Equal: true},
+		{A: "a${B}c", B: "a${B}c", Equal: true},
+		{A: "$$a ${B}", B: "$a ${B}", Equal: true},
+		{A: "${A:-x}", B: "${A:=x}"},
+		{A: "${A:-x}", B: "${A:-y}"},
+		{A: "${A:-x}", B: "${B:-x}"},
+		{A: "${A:-${B}}", B: "${A:-${C}}"},
+		{A: "${A}", B: "A"},
+		{A: "a${B}", B: "a${B}c"},
+		{A: "$((a))", B: "$((b))"},
+	}
+	for _, test := range tests {
+		t.Run(test.A+" "+test.B, func(t *testing.T) {
+			a, err := Parse(test.A)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := Parse(test.B)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := TreesEqual(a, b); got != test.Equal {
+				t.Errorf("Want TreesEqual(%q, %q) to be %v, got %v", test.A, test.B, test.Equal, got)
+			}
+		})
+	}
+
+	if !TreesEqual(nil, nil) {
+		t.Error("Want nil trees equal")
+	}
+	if TreesEqual(nil, &Tree{}) {
+		t.Error("Want nil tree not equal to an empty tree")
+	}
+}
+
+func TestTree_Clone(t *testing.T) {
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tree.Root, tree.Clone().Root); diff != "" {
+				t.Errorf(diff)
+			}
+		})
+	}
+}
+
+func TestTree_Clone_Independent(t *testing.T) {
+	tree := MustParse("a ${FOO:-${BAR}} $((1 + 2))")
+	clone := tree.Clone()
+
+	list := clone.Root.(*ListNode)
+	list.Nodes[0].(*TextNode).Value = "b "
+	fn := list.Nodes[1].(*ListNode).Nodes[0].(*FuncNode)
+	fn.Param = "BAZ"
+	fn.Args[0].(*FuncNode).Param = "QUX"
+	fn.Args = append(fn.Args, newTextNode("x"))
+
+	if got := tree.String(); got != "a ${FOO:-${BAR}} $((1 + 2))" {
+		t.Errorf("Want the original tree unchanged, got %q", got)
+	}
+	if got := clone.String(); got != "b ${BAZ:-${QUX}x} $((1 + 2))" {
+		t.Errorf("Want the clone modified, got %q", got)
+	}
+
+	var empty *Tree
+	if empty.Clone() != nil {
+		t.Errorf("Want a nil tree cloned to nil")
+	}
+}
+
+func TestFuncNode_Global(t *testing.T) {
+	tests := []struct {
+		Text   string
+		Global bool
+	}{
+		{Text: "${VAR//a/b}", Global: true},
+		{Text: "${VAR/a/b}"},
+		{Text: "${VAR/#a/b}"},
+		{Text: "${VAR/%a/b}"},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tree.Root.(*FuncNode).Global; got != test.Global {
+				t.Errorf("Want Global %v, got %v", test.Global, got)
+			}
+		})
+	}
+}
+
+func TestListNode_Flatten(t *testing.T) {
+	tree, err := Parse("a${B}c${D}e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, ok := tree.Root.(*ListNode)
+	if !ok {
+		t.Fatalf("Want a list, got %T", tree.Root)
+	}
+	want := []Node{
+		newTextNode("a"),
+		&FuncNode{Param: "B"},
+		newTextNode("c"),
+		&FuncNode{Param: "D"},
+		newTextNode("e"),
+	}
+	if diff := cmp.Diff(want, list.Flatten()); diff != "" {
+		t.Errorf(diff)
+	}
+	if got := list.String(); got != "a${B}c${D}e" {
+		t.Errorf("Want the list unchanged, got %q", got)
+	}
+
+	// the nested lists of function arguments are flattened too
+	tree, err = Parse("${A#x${B}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	arg := tree.Root.(*FuncNode).Args[0].(*ListNode)
+	if diff := cmp.Diff([]Node{newTextNode("x"), &FuncNode{Param: "B"}}, arg.Flatten()); diff != "" {
+		t.Errorf(diff)
+	}
+}
+
+func TestTree_Simplify(t *testing.T) {
+	countNodes := func(tree *Tree) int {
+		var n int
+		Walk(tree, func(Node) bool {
+			n++
+			return true
+		})
+		return n
+	}
+
+	tree := &Tree{Root: newListNode(
+		newTextNode("a"),
+		newListNode(
+			newTextNode("b"),
+			newListNode(
+				newTextNode("c"),
+				newListNode(
+					&FuncNode{Param: "FOO", Name: ":-", Args: []Node{newListNode(newTextNode("x"), newTextNode("y"))}},
+					newListNode(newTextNode("d"), newTextNode("$")),
+				),
+			),
+		),
+	)}
+	before := countNodes(tree)
+	tree.Simplify()
+	want := newListNode(
+		newTextNode("abc"),
+		&FuncNode{Param: "FOO", Name: ":-", Args: []Node{newTextNode("xy")}},
+		newTextNode("d$"),
+	)
+	if diff := cmp.Diff(want, tree.Root); diff != "" {
+		t.Errorf(diff)
+	}
+	if after := countNodes(tree); after >= before {
+		t.Errorf("Want fewer nodes than %d, got %d", before, after)
+	}
+
+	mapping := func(name string) (string, bool) {
+		return map[string]string{"B": "b", "FOO": "foo"}[name], name != "UNSET"
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, wantErr := tree.Expand(mapping)
+			simplified := tree.Clone()
+			simplified.Simplify()
+			got, err := simplified.Expand(mapping)
+			if got != want || (err == nil) != (wantErr == nil) {
+				t.Errorf("Want %q expanded to %q, %v, got %q, %v", test.Text, want, wantErr, got, err)
+			}
+			if countNodes(simplified) > countNodes(tree) {
+				t.Errorf("Want no more nodes than %d, got %d", countNodes(tree), countNodes(simplified))
+			}
+		})
+	}
+
+	var empty *Tree
+	empty.Simplify()
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parse
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Mode controls which substitution functions are recognized by the parser.
+type Mode int
+
+const (
+	// ModeBash accepts the bash extensions on top of the POSIX
+	// substitution functions. It is the default mode.
+	ModeBash Mode = iota
+	// ModePOSIX only accepts the substitution functions defined by
+	// POSIX sh, rejecting the bash-only operators.
+	ModePOSIX
+)
+
+// String returns the name of the mode.
+func (m Mode) String() string {
+	switch m {
+	case ModeBash:
+		return "bash"
+	case ModePOSIX:
+		return "POSIX"
+	default:
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+}
+
+// ParseOptions contains options for parsing a template.
+type ParseOptions struct {
+	// Mode is the shell dialect the template is parsed as.
+	// Defaults to ModeBash.
+	Mode Mode
+
+	// IdentFunc reports whether the rune r at position i (starting at 1)
+	// is valid in a variable name. Defaults to accepting letters, digits
+	// and underscores.
+	IdentFunc func(r rune, i int) bool
+
+	// AllowCommandSubstitution captures "$(command)" into a CmdNode
+	// instead of failing with ErrCommandSubstitutionDisallowed. The
+	// command is never run.
+	AllowCommandSubstitution bool
+
+	// RequireClosingParens fails with ErrMissingClosingParen on the
+	// arithmetic expansions and command substitutions which are not
+	// closed, e.g. "$((1 + 2", instead of reading them as literal text.
+	RequireClosingParens bool
+
+	// AllowSingleQuoteLiterals takes the text between single quotes
+	// verbatim, without expanding the substitutions it contains. The
+	// quotes are not part of the resulting text, but Tree.String writes
+	// them back.
+	AllowSingleQuoteLiterals bool
+
+	// LeftDelim is the pair of runes opening a substitution, "${" by
+	// default. Its first rune replaces "$" in escape sequences, e.g.
+	// "%%" for a literal "%" with "%{". Arithmetic expansions and
+	// command substitutions are only recognized with the default.
+	LeftDelim string
+
+	// RightDelim is the rune closing a substitution, "}" by default.
+	// It replaces "}" in escape sequences, e.g. `\]` with "]".
+	//
+	// Tree.String renders the trees parsed with custom delimiters with
+	// them, while Node.String always uses the default ones.
+	RightDelim string
+
+	// CommentPrefix turns the substitutions whose body starts with it,
+	// e.g. "${// note}" with "//", into a CommentNode expanding to
+	// nothing. The comment ends at the first closing delimiter. It is
+	// checked before any operator, so it should not start with a rune
+	// valid at the start of a substitution. Comments are disabled when
+	// empty, the default.
+	CommentPrefix string
+
+	// AllowBareReferences recognizes the references without braces,
+	// e.g. "$HOME", as plain variable references. The name is the
+	// longest run of runes accepted by IdentFunc, so "$VAR_suffix"
+	// references VAR_suffix, except for positional parameters which are
+	// a single digit: "$10" is "$1" followed by "0". "$$" remains an
+	// escaped "$" rather than the process ID, and the other special
+	// parameters such as "$?" are left as text. Operators still require
+	// braces, but their words may contain references without braces,
+	// e.g. "${VAR:-$FALLBACK}".
+	AllowBareReferences bool
+
+	// MaxFunctions is the maximum number of substitutions of a template,
+	// including the nested ones and excluding comments. Parsing fails
+	// with ErrTooManyFunctions past it. There is no limit when zero, the
+	// default.
+	MaxFunctions int
+
+	// MaxInputBytes is the maximum size of the template in bytes.
+	// Parsing fails with ErrInputTooLarge before processing a larger
+	// input, and ParseReaderWithOptions stops reading past it rather
+	// than buffering the whole input. There is no limit when zero, the
+	// default.
+	MaxInputBytes int
+
+	// TrackSource records the span of the input each node was parsed
+	// from, returned by Node.Source, e.g. for tools rewriting parts of
+	// the input. It is disabled by default to save the overhead.
+	TrackSource bool
+
+	// StrictIdentifiers rejects the parameters whose name does not match
+	// the POSIX name grammar [A-Za-z_][A-Za-z0-9_]* with
+	// ErrParseVariableName, e.g. "${1FOO}". Positional parameters such
+	// as "${1}" are rejected too, only "${#}" is accepted.
+	StrictIdentifiers bool
+
+	// DisableFunctions only accepts plain variable references such as
+	// "${VAR}", rejecting the substitutions with an operator, e.g.
+	// "${VAR:-x}" or "${#VAR}", with ErrFunctionsDisabled. It is
+	// stricter than validating the operators with Tree.Validate.
+	DisableFunctions bool
+
+	// UnescapeBackslashes reads "\\" as a single literal backslash in
+	// text and in the words of the default, assignment, error and
+	// alternate functions, e.g. "C:\\${DIR}" or "${DIR:-C:\\}" for a
+	// path ending with a backslash. Other backslashes are still taken
+	// literally. By default, backslashes outside of the patterns of the
+	// replace functions are kept as they are, e.g. in the UNC path
+	// "\\server\share".
+	//
+	// Tree.String renders the backslashes of the trees parsed with it
+	// doubled, so that they are read back the same.
+	UnescapeBackslashes bool
+}
+
+// validate returns an error if the options are invalid.
+func (o ParseOptions) validate() error {
+	if o.LeftDelim != "" && utf8.RuneCountInString(o.LeftDelim) != 2 {
+		return fmt.Errorf("%w: left delimiter %q must be two characters", ErrInvalidDelimiters, o.LeftDelim)
+	}
+	if o.RightDelim != "" && utf8.RuneCountInString(o.RightDelim) != 1 {
+		return fmt.Errorf("%w: right delimiter %q must be one character", ErrInvalidDelimiters, o.RightDelim)
+	}
+	return nil
+}
+
+// delims returns the runes opening and closing a substitution.
+func (o ParseOptions) delims() (sigil, lbrack, rbrack rune) {
+	sigil, lbrack, rbrack = '$', '{', '}'
+	if o.LeftDelim != "" {
+		var size int
+		sigil, size = utf8.DecodeRuneInString(o.LeftDelim)
+		lbrack, _ = utf8.DecodeRuneInString(o.LeftDelim[size:])
+	}
+	if o.RightDelim != "" {
+		rbrack, _ = utf8.DecodeRuneInString(o.RightDelim)
+	}
+	return sigil, lbrack, rbrack
+}
+
+// syntax returns the syntax the trees parsed with the options are
+// rendered with.
+func (o ParseOptions) syntax() syntax {
+	sigil, lbrack, rbrack := o.delims()
+	syn := syntax{
+		sigil:       sigil,
+		lbrack:      lbrack,
+		rbrack:      rbrack,
+		backslashes: o.UnescapeBackslashes,
+		quotes:      o.AllowSingleQuoteLiterals,
+	}
+	if o.AllowBareReferences {
+		syn.ident = acceptIdent
+		if o.IdentFunc != nil {
+			syn.ident = o.IdentFunc
+		}
+	}
+	return syn
+}
+
+// acceptIdent returns the function accepting the runes of variable names.
+func (t *Tree) acceptIdent() acceptFunc {
+	if t.opts.IdentFunc != nil {
+		return t.opts.IdentFunc
+	}
+	return acceptIdent
+}
+
+// checkIdent returns an error if the parameter name is not a POSIX name
+// while parsing with strict identifiers.
+func (t *Tree) checkIdent(name string) error {
+	if !t.opts.StrictIdentifiers || isName(name) {
+		return nil
+	}
+	return t.error(fmt.Errorf("%w: %q is not a valid name", ErrParseVariableName, name))
+}
+
+// isName reports whether s matches the POSIX name grammar.
+func isName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_', 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z':
+		case i > 0 && '0' <= r && r <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// operatorRunes lists the runes starting the operator of a substitution,
+// either before or after the parameter name.
+const operatorRunes = ":=-?+,^/#%@!"
+
+// checkFunction returns an error if the next rune starts an operator
+// while parsing with functions disabled.
+func (t *Tree) checkFunction() error {
+	r := t.scanner.peek()
+	if !t.opts.DisableFunctions || r == eof || !strings.ContainsRune(operatorRunes, r) {
+		return nil
+	}
+	// scan the rune without accepting it to report its offset
+	t.scanner.mode = 0
+	t.scanner.scan()
+	return t.error(fmt.Errorf("%w: unexpected %q", ErrFunctionsDisabled, r))
+}
+
+// requireBash returns an error if the bash-only operator op is used
+// while parsing in POSIX mode.
+func (t *Tree) requireBash(op string) error {
+	if t.opts.Mode != ModePOSIX {
+		return nil
+	}
+	return t.error(fmt.Errorf("%w: %q is not supported in %s mode", ErrUnsupportedOperator, op, t.opts.Mode))
+}
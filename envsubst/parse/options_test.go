@@ -0,0 +1,846 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parse
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseWithOptions_Mode(t *testing.T) {
+	tests := []struct {
+		Text     string
+		POSIXErr bool
+	}{
+		{Text: "${VAR}"},
+		{Text: "${#VAR}"},
+		{Text: "${VAR:-default}"},
+		{Text: "${VAR=default}"},
+		{Text: "${VAR#prefix}"},
+		{Text: "${VAR%%suffix}"},
+		{Text: "${VAR^^}", POSIXErr: true},
+		{Text: "${VAR,}", POSIXErr: true},
+		{Text: "${VAR//a/b}", POSIXErr: true},
+		{Text: "${VAR/#a/b}", POSIXErr: true},
+		{Text: "${VAR:1:2}", POSIXErr: true},
+		{Text: "${!VAR}", POSIXErr: true},
+		{Text: "${VAR@Q}", POSIXErr: true},
+		{Text: "${VAR:-${OTHER^^}}", POSIXErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			if _, err := ParseWithOptions(test.Text, ParseOptions{Mode: ModeBash}); err != nil {
+				t.Errorf("Want %q parsed in bash mode, got error %v", test.Text, err)
+			}
+
+			_, err := ParseWithOptions(test.Text, ParseOptions{Mode: ModePOSIX})
+			if test.POSIXErr && !errors.Is(err, ErrUnsupportedOperator) {
+				t.Errorf("Want error %q in POSIX mode, got %v", ErrUnsupportedOperator, err)
+			}
+			if !test.POSIXErr && err != nil {
+				t.Errorf("Want %q parsed in POSIX mode, got error %v", test.Text, err)
+			}
+		})
+	}
+}
+
+func TestParseWithOptions_IdentFunc(t *testing.T) {
+	permissive := func(r rune, i int) bool {
+		return acceptIdent(r, i) || r == '.' || r == '-'
+	}
+	tests := []struct {
+		Text string
+		Node Node
+	}{
+		{
+			Text: "${my.app.config}",
+			Node: &FuncNode{Param: "my.app.config"},
+		},
+		{
+			Text: "${my-app:-default}",
+			Node: &FuncNode{
+				Param: "my-app",
+				Name:  ":-",
+				Args:  []Node{&TextNode{Value: "default"}},
+			},
+		},
+		{
+			Text: "${#my.app}",
+			Node: &FuncNode{Param: "my.app", Name: "#"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := ParseWithOptions(test.Text, ParseOptions{IdentFunc: permissive})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Node, tree.Root); diff != "" {
+				t.Errorf(diff)
+			}
+
+			// ${my-app:-default} is the default of "my" otherwise
+			if tree, err := Parse(test.Text); err == nil && cmp.Equal(test.Node, tree.Root) {
+				t.Errorf("Want %q rejected or parsed differently with the default identifier set", test.Text)
+			}
+		})
+	}
+}
+
+func TestParseWithOptions_AllowCommandSubstitution(t *testing.T) {
+	opts := ParseOptions{AllowCommandSubstitution: true}
+
+	tree, err := ParseWithOptions("a $(echo $(date) (b)) c", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ListNode{
+		Nodes: []Node{
+			&TextNode{Value: "a "},
+			&ListNode{
+				Nodes: []Node{
+					&CmdNode{Command: "echo $(date) (b)"},
+					&TextNode{Value: " c"},
+				},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, tree.Root); diff != "" {
+		t.Errorf(diff)
+	}
+	if got := tree.String(); got != "a $(echo $(date) (b)) c" {
+		t.Errorf("Want command substitution rendered unchanged, got %q", got)
+	}
+
+	tree, err = ParseWithOptions("$(echo ${a}) $(b", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = &ListNode{
+		Nodes: []Node{
+			&CmdNode{
+				Command: "echo ${a}",
+				Nodes:   []Node{&TextNode{Value: "echo "}, &FuncNode{Param: "a"}},
+			},
+			&TextNode{Value: " "},
+			&TextNode{Value: "$(b", Unclosed: true}, // not closed
+		},
+	}
+	tree.Simplify()
+	if diff := cmp.Diff(want, tree.Root); diff != "" {
+		t.Errorf(diff)
+	}
+	if got := tree.String(); got != "$(echo ${a}) $(b" {
+		t.Errorf("Want unclosed command substitution rendered unchanged, got %q", got)
+	}
+	tree, err = ParseWithOptions("${a:-$(b)}", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantFunc := &FuncNode{Param: "a", Name: ":-", Args: []Node{&CmdNode{Command: "b"}}}
+	if diff := cmp.Diff(wantFunc, tree.Root); diff != "" {
+		t.Errorf(diff)
+	}
+
+	if _, err := ParseWithOptions("$((1+2))", opts); err != nil {
+		t.Errorf("Want arithmetic expansion parsed, got error %v", err)
+	}
+}
+
+func TestParseWithOptions_RequireClosingParens(t *testing.T) {
+	tests := []string{
+		"$(( a",
+		"$((a + (b)",
+		"$((a)",
+		"price $((5 ${A}",
+		"$(echo",
+		"price $(5 ${A}",
+		"${A:-$(b}",
+	}
+	for _, text := range tests {
+		t.Run(text, func(t *testing.T) {
+			opts := ParseOptions{AllowCommandSubstitution: true}
+			tree, err := ParseWithOptions(text, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			Walk(tree, func(n Node) bool {
+				if n.Type() == NodeArith || n.Type() == NodeCmd {
+					t.Errorf("Want %q read as literal text by default, got %s", text, n.Type())
+				}
+				return true
+			})
+			if got := tree.String(); got != text {
+				t.Errorf("Want %q rendered unchanged, got %q", text, got)
+			}
+			reparsed, err := ParseWithOptions(tree.String(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !TreesEqual(tree, reparsed) {
+				t.Errorf("Want %q parsed back the same, got %q", text, reparsed.String())
+			}
+			tree.Simplify()
+			if got := tree.String(); got != text {
+				t.Errorf("Want %q rendered unchanged once simplified, got %q", text, got)
+			}
+
+			opts.RequireClosingParens = true
+			_, err = ParseWithOptions(text, opts)
+			if !errors.Is(err, ErrMissingClosingParen) {
+				t.Errorf("Want error %q, got %v", ErrMissingClosingParen, err)
+			}
+		})
+	}
+}
+
+func TestParseWithOptions_AllowSingleQuoteLiterals(t *testing.T) {
+	opts := ParseOptions{AllowSingleQuoteLiterals: true}
+	tests := []struct {
+		Text string
+		Node Node
+	}{
+		{
+			Text: "'${LITERAL}'",
+			Node: &TextNode{Value: "${LITERAL}", Quoted: true},
+		},
+		{
+			Text: "a ${b} '$c ${d:-e}'f",
+			Node: &ListNode{
+				Nodes: []Node{
+					&TextNode{Value: "a "},
+					&ListNode{
+						Nodes: []Node{
+							&FuncNode{Param: "b"},
+							&ListNode{
+								Nodes: []Node{
+									&TextNode{Value: " "},
+									&ListNode{
+										Nodes: []Node{
+											&TextNode{Value: "$c ${d:-e}", Quoted: true},
+											&TextNode{Value: "f"},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			Text: "''",
+			Node: &TextNode{Quoted: true},
+		},
+		{
+			Text: "'#'^",
+			Node: &ListNode{
+				Nodes: []Node{
+					&TextNode{Value: "#", Quoted: true},
+					&TextNode{Value: "^"},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := ParseWithOptions(test.Text, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Node, tree.Root); diff != "" {
+				t.Errorf(diff)
+			}
+			if got := tree.String(); got != test.Text {
+				t.Errorf("Want %q rendered unchanged, got %q", test.Text, got)
+			}
+			tree.Simplify()
+			if got := tree.String(); got != test.Text {
+				t.Errorf("Want %q rendered unchanged once simplified, got %q", test.Text, got)
+			}
+		})
+	}
+
+	if _, err := ParseWithOptions("it's ${a}", opts); !errors.Is(err, ErrMissingClosingQuote) {
+		t.Errorf("Want error %q, got %v", ErrMissingClosingQuote, err)
+	}
+
+	tree, err := Parse("it's '${a}'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ListNode{
+		Nodes: []Node{
+			&TextNode{Value: "it's '"},
+			&ListNode{
+				Nodes: []Node{
+					&FuncNode{Param: "a"},
+					&TextNode{Value: "'"},
+				},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, tree.Root); diff != "" {
+		t.Errorf("Want quotes taken literally by default: %s", diff)
+	}
+}
+
+func TestParseWithOptions_Delims(t *testing.T) {
+	tests := []struct {
+		Text  string
+		Left  string
+		Right string
+		Node  Node
+	}{
+		{
+			Text: "%{VAR:-x}",
+			Left: "%{",
+			Node: &FuncNode{
+				Param: "VAR",
+				Name:  ":-",
+				Args:  []Node{&TextNode{Value: "x"}},
+			},
+		},
+		{
+			Text: "${VAR} $(cmd) %%{VAR}",
+			Left: "%{",
+			Node: &TextNode{Value: "${VAR} $(cmd) %{VAR}"},
+		},
+		{
+			Text:  "@[VAR:-{}\\]]",
+			Left:  "@[",
+			Right: "]",
+			Node: &FuncNode{
+				Param: "VAR",
+				Name:  ":-",
+				Args:  []Node{&TextNode{Value: "{}]"}},
+			},
+		},
+		{
+			Text:  "a @[B##@[C]/] d",
+			Left:  "@[",
+			Right: "]",
+			Node: &ListNode{
+				Nodes: []Node{
+					&TextNode{Value: "a "},
+					&ListNode{
+						Nodes: []Node{
+							&FuncNode{
+								Param: "B",
+								Name:  "##",
+								Args: []Node{
+									&ListNode{
+										Nodes: []Node{
+											&FuncNode{Param: "C"},
+											&TextNode{Value: "/"},
+										},
+									},
+								},
+							},
+							&TextNode{Value: " d"},
+						},
+					},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			opts := ParseOptions{LeftDelim: test.Left, RightDelim: test.Right}
+			tree, err := ParseWithOptions(test.Text, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Node, tree.Root); diff != "" {
+				t.Errorf(diff)
+			}
+
+			// the tree is rendered with its delimiters
+			reparsed, err := ParseWithOptions(tree.String(), opts)
+			if err != nil {
+				t.Fatalf("Want %q reparsed, got error %v", tree.String(), err)
+			}
+			if diff := cmp.Diff(test.Node, reparsed.Root); diff != "" {
+				t.Errorf(diff)
+			}
+		})
+	}
+
+	for text, want := range map[string]string{
+		"%{A:-x}":      "%{A:-x}",
+		"%%{A} ${A}":   "%%{A} ${A}",
+		"%{A:-%%{B}}":  `%{A:-\%%{B}}`,
+		"%{A//%%/$}":   `%{A//\%/$}`,
+		"100% $$ %{A}": "100% $$ %{A}",
+	} {
+		tree, err := ParseWithOptions(text, ParseOptions{LeftDelim: "%{"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tree.String(); got != want {
+			t.Errorf("Want %q rendered as %q, got %q", text, want, got)
+		}
+	}
+
+	tree, err := ParseWithOptions("%{A} %{B}", ParseOptions{LeftDelim: "%{"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := tree.ExpandPartial(func(name string) (string, bool) {
+		return "%{B}", name == "B"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "%{A} %%{B}"; got != want {
+		t.Errorf("Want partial expansion %q, got %q", want, got)
+	}
+
+	for _, opts := range []ParseOptions{{LeftDelim: "%"}, {LeftDelim: "%{{"}, {RightDelim: "}}"}} {
+		if _, err := ParseWithOptions("", opts); !errors.Is(err, ErrInvalidDelimiters) {
+			t.Errorf("Want error %q for %+v, got %v", ErrInvalidDelimiters, opts, err)
+		}
+	}
+	if _, err := ParseWithOptions("@[VAR", ParseOptions{LeftDelim: "@[", RightDelim: "]"}); !errors.Is(err, ErrMissingClosingBrace) {
+		t.Errorf("Want error %q, got %v", ErrMissingClosingBrace, err)
+	}
+}
+
+func TestParseWithOptions_CommentPrefix(t *testing.T) {
+	opts := ParseOptions{CommentPrefix: "//"}
+
+	tree, err := ParseWithOptions("${//this is a comment}", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(&CommentNode{Text: "//this is a comment"}, tree.Root); diff != "" {
+		t.Errorf(diff)
+	}
+	if got := tree.String(); got != "${//this is a comment}" {
+		t.Errorf("Want comment rendered unchanged, got %q", got)
+	}
+	if got := tree.Variables(); len(got) != 0 {
+		t.Errorf("Want no variables referenced by a comment, got %v", got)
+	}
+
+	tree, err = ParseWithOptions("a${// unused}b ${VAR//x/y} ${OTHER:-${// nested}}", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"VAR", "OTHER"}, tree.Variables()); diff != "" {
+		t.Errorf(diff)
+	}
+
+	if _, err := ParseWithOptions("${// unterminated", opts); !errors.Is(err, ErrMissingClosingBrace) {
+		t.Errorf("Want error %q, got %v", ErrMissingClosingBrace, err)
+	}
+	if _, err := Parse("${//this is a comment}"); !errors.Is(err, ErrParseVariableName) {
+		t.Errorf("Want error %q without comments, got %v", ErrParseVariableName, err)
+	}
+}
+
+func TestParseWithOptions_StrictIdentifiers(t *testing.T) {
+	tests := []struct {
+		Text      string
+		StrictErr bool
+	}{
+		{Text: "${FOO}"},
+		{Text: "${_foo_1}"},
+		{Text: "${#FOO}"},
+		{Text: "${!FOO}"},
+		{Text: "${#}"},
+		{Text: "${FOO:-${BAR_2}}"},
+		{Text: "${1FOO}", StrictErr: true},
+		{Text: "${1}", StrictErr: true},
+		{Text: "${#1FOO}", StrictErr: true},
+		{Text: "${!1FOO}", StrictErr: true},
+		{Text: "${FOO:-${9BAR}}", StrictErr: true},
+		{Text: "${FÖO}", StrictErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			if _, err := Parse(test.Text); err != nil {
+				t.Errorf("Want %q parsed by default, got error %v", test.Text, err)
+			}
+
+			_, err := ParseWithOptions(test.Text, ParseOptions{StrictIdentifiers: true})
+			if test.StrictErr && !errors.Is(err, ErrParseVariableName) {
+				t.Errorf("Want error %q with strict identifiers, got %v", ErrParseVariableName, err)
+			}
+			if !test.StrictErr && err != nil {
+				t.Errorf("Want %q parsed with strict identifiers, got error %v", test.Text, err)
+			}
+		})
+	}
+}
+
+func TestParseWithOptions_DisableFunctions(t *testing.T) {
+	tests := []struct {
+		Text   string
+		Offset int
+	}{
+		{Text: "${VAR}", Offset: -1},
+		{Text: "a ${VAR} b ${OTHER}", Offset: -1},
+		{Text: "$$ $((1 + 2))", Offset: -1},
+		{Text: "${VAR:-x}", Offset: 5},
+		{Text: "${VAR=x}", Offset: 5},
+		{Text: "${VAR//a/b}", Offset: 5},
+		{Text: "${VAR#x}", Offset: 5},
+		{Text: "${VAR%x}", Offset: 5},
+		{Text: "${VAR^^}", Offset: 5},
+		{Text: "${VAR@Q}", Offset: 5},
+		{Text: "${#VAR}", Offset: 2},
+		{Text: "${!VAR}", Offset: 2},
+		{Text: "${VAR} ${OTHER:1}", Offset: 14},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			if _, err := Parse(test.Text); err != nil {
+				t.Fatalf("Want %q parsed by default, got error %v", test.Text, err)
+			}
+
+			_, err := ParseWithOptions(test.Text, ParseOptions{DisableFunctions: true})
+			if test.Offset < 0 {
+				if err != nil {
+					t.Errorf("Want %q parsed with functions disabled, got error %v", test.Text, err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrFunctionsDisabled) {
+				t.Fatalf("Want error %q, got %v", ErrFunctionsDisabled, err)
+			}
+			var perr *ParseError
+			if !errors.As(err, &perr) || perr.Offset != test.Offset {
+				t.Errorf("Want error at offset %d, got %v", test.Offset, err)
+			}
+		})
+	}
+}
+
+func TestParseWithOptions_UnescapeBackslashes(t *testing.T) {
+	tests := []struct {
+		Text    string
+		Want    string
+		Default string
+	}{
+		{Text: `a\\b`, Want: `a\b`, Default: `a\\b`},
+		{Text: `${VAR:-a\\b}`, Want: `a\b`, Default: `a\\b`},
+		{Text: `a\b`, Want: `a\b`, Default: `a\b`},
+		{Text: `a\\\\b`, Want: `a\\b`, Default: `a\\\\b`},
+		{Text: `\\\\server\share`, Want: `\\server\share`, Default: `\\\\server\share`},
+		{Text: `C:\\${DIR}`, Want: `C:\dir`, Default: `C:\\dir`},
+		{Text: `${VAR:-C:\\}`, Want: `C:\`},
+		{Text: `${VAR:-a\\\}b}`, Want: `a\}b`, Default: `a\\}b`},
+		{Text: `${VAR:=a\\b} ${VAR}`, Want: `a\b a\b`, Default: `a\\b a\\b`},
+		{Text: `\\$${DIR}`, Want: `\${DIR}`, Default: `\\${DIR}`},
+		{Text: `${DIR/\\/\/}`, Want: `dir`, Default: `dir`},
+		{Text: `${VAR:-C:\\}${VAR:-\\\\}`, Want: `C:\\\`},
+	}
+	mapping := func(name string) (string, bool) {
+		return map[string]string{"DIR": "dir"}[name], name == "DIR"
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := ParseWithOptions(test.Text, ParseOptions{UnescapeBackslashes: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tree.Expand(mapping)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.Want {
+				t.Errorf("Want %q expanded to %q, got %q", test.Text, test.Want, got)
+			}
+
+			// the backslashes are rendered back doubled
+			reparsed, err := ParseWithOptions(tree.String(), ParseOptions{UnescapeBackslashes: true})
+			if err != nil {
+				t.Fatalf("Want %q reparsed, got error %v", tree.String(), err)
+			}
+			if diff := cmp.Diff(tree.Root, reparsed.Root); diff != "" {
+				t.Errorf(diff)
+			}
+
+			if test.Default == "" {
+				return
+			}
+			got, err = MustParse(test.Text).Expand(mapping)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.Default {
+				t.Errorf("Want %q expanded to %q by default, got %q", test.Text, test.Default, got)
+			}
+		})
+	}
+}
+
+func TestParseWithOptions_AllowBareReferences(t *testing.T) {
+	opts := ParseOptions{AllowBareReferences: true}
+
+	bare, err := ParseWithOptions("$HOME/bin", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	braced, err := Parse("${HOME}/bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(braced.Root, bare.Root); diff != "" {
+		t.Errorf(diff)
+	}
+
+	tests := []struct {
+		Text string
+		Node Node
+	}{
+		{
+			Text: "$VAR_suffix",
+			Node: &FuncNode{Param: "VAR_suffix"},
+		},
+		{
+			Text: "$10",
+			Node: newListNode(&FuncNode{Param: "1"}, newTextNode("0")),
+		},
+		{
+			Text: "$$HOME",
+			Node: newTextNode("$HOME"),
+		},
+		{
+			Text: "$$a $$_ $${a}",
+			Node: newTextNode("$a $_ ${a}"),
+		},
+		{
+			Text: "cost: 5$ $? $",
+			Node: newTextNode("cost: 5$ $? $"),
+		},
+		{
+			Text: "$A${B:-$C}",
+			Node: newListNode(
+				&FuncNode{Param: "A"},
+				&FuncNode{Param: "B", Name: ":-", Args: []Node{&FuncNode{Param: "C"}}},
+			),
+		},
+		{
+			Text: "${VAR:-$FALLBACK}",
+			Node: &FuncNode{Param: "VAR", Name: ":-", Args: []Node{&FuncNode{Param: "FALLBACK"}}},
+		},
+		{
+			Text: "${VAR:-$A/$B}",
+			Node: &FuncNode{Param: "VAR", Name: ":-", Args: []Node{
+				&FuncNode{Param: "A"},
+				newTextNode("/"),
+				&FuncNode{Param: "B"},
+			}},
+		},
+		{
+			Text: `${VAR:-\$A $$}`,
+			Node: &FuncNode{Param: "VAR", Name: ":-", Args: []Node{newTextNode("$A $$")}},
+		},
+		{
+			Text: "${VAR#$PREFIX}",
+			Node: &FuncNode{Param: "VAR", Name: "#", Args: []Node{&FuncNode{Param: "PREFIX"}}},
+		},
+		{
+			Text: "${VAR/$OLD/$NEW}",
+			Node: &FuncNode{Param: "VAR", Name: "/", Args: []Node{
+				&FuncNode{Param: "OLD"},
+				&FuncNode{Param: "NEW"},
+			}},
+		},
+		{
+			Text: "$A.$B",
+			Node: newListNode(
+				&FuncNode{Param: "A"},
+				newListNode(newTextNode("."), &FuncNode{Param: "B"}),
+			),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := ParseWithOptions(test.Text, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Node, tree.Root); diff != "" {
+				t.Errorf(diff)
+			}
+			// the references are not read from the escaped sigils
+			again, err := ParseWithOptions(tree.String(), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !TreesEqual(tree, again) {
+				t.Errorf("Want %q parsed back the same from %q, got %q", test.Text, tree.String(), again.String())
+			}
+		})
+	}
+
+	tree, err := Parse("$HOME/bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(newTextNode("$HOME/bin"), tree.Root); diff != "" {
+		t.Errorf("Want bare references left as text by default: %s", diff)
+	}
+	if _, err := ParseWithOptions("$1", ParseOptions{AllowBareReferences: true, StrictIdentifiers: true}); !errors.Is(err, ErrParseVariableName) {
+		t.Errorf("Want error %q with strict identifiers, got %v", ErrParseVariableName, err)
+	}
+}
+
+func TestParseWithOptions_TrackSource(t *testing.T) {
+	const text = "abc${FOO}def"
+	tree, err := ParseWithOptions(text, ParseOptions{TrackSource: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ListNode{
+		Span: Span{Start: 0, End: 12},
+		Nodes: []Node{
+			&TextNode{Span: Span{Start: 0, End: 3}, Value: "abc"},
+			&ListNode{
+				Span: Span{Start: 3, End: 12},
+				Nodes: []Node{
+					&FuncNode{Span: Span{Start: 3, End: 9}, Param: "FOO"},
+					&TextNode{Span: Span{Start: 9, End: 12}, Value: "def"},
+				},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, tree.Root); diff != "" {
+		t.Errorf(diff)
+	}
+
+	tests := []struct {
+		Text    string
+		Sources []string
+	}{
+		{
+			Text:    text,
+			Sources: []string{"abc${FOO}def", "abc", "${FOO}def", "${FOO}", "def"},
+		},
+		{
+			Text:    "${A:-x ${B,,}} $$",
+			Sources: []string{"${A:-x ${B,,}} $$", "${A:-x ${B,,}}", "x ", "${B,,}", " $$"},
+		},
+		{
+			Text:    "${A#x${B}}",
+			Sources: []string{"${A#x${B}}", "x${B}", "x", "${B}"},
+		},
+		{
+			Text:    "${A@Q}",
+			Sources: []string{"${A@Q}", "Q"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := ParseWithOptions(test.Text, ParseOptions{TrackSource: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			Walk(tree, func(n Node) bool {
+				span := n.Source()
+				got = append(got, test.Text[span.Start:span.End])
+				return true
+			})
+			if diff := cmp.Diff(test.Sources, got); diff != "" {
+				t.Errorf(diff)
+			}
+		})
+	}
+
+	tree, err = Parse(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Walk(tree, func(n Node) bool {
+		if span := n.Source(); span != (Span{}) {
+			t.Errorf("Want no span recorded by default, got %+v for %s", span, n)
+		}
+		return true
+	})
+}
+
+func TestParseWithOptions_MaxFunctions(t *testing.T) {
+	text := strings.Repeat("${V}", 10000)
+	if _, err := Parse(text); err != nil {
+		t.Fatalf("Want no limit by default, got error %v", err)
+	}
+	if _, err := ParseWithOptions(text, ParseOptions{MaxFunctions: 10000}); err != nil {
+		t.Fatalf("Want the limit reached but not exceeded, got error %v", err)
+	}
+	_, err := ParseWithOptions(text+"${V}", ParseOptions{MaxFunctions: 10000})
+	if !errors.Is(err, ErrTooManyFunctions) {
+		t.Fatalf("Want error %q, got %v", ErrTooManyFunctions, err)
+	}
+	var perr *ParseError
+	if !errors.As(err, &perr) || perr.Offset != len(text) {
+		t.Errorf("Want the error at the extra function, got %v", err)
+	}
+
+	tests := []struct {
+		Text    string
+		Opts    ParseOptions
+		TooMany bool
+	}{
+		{Text: "${A:-${B:-${C}}}", TooMany: true},
+		{Text: "${A:-x} $((1 + 2))"},
+		{Text: "$A $B", Opts: ParseOptions{AllowBareReferences: true}},
+		{Text: "$A $B $C", Opts: ParseOptions{AllowBareReferences: true}, TooMany: true},
+		{Text: "${// a}${// b}${A}${B}", Opts: ParseOptions{CommentPrefix: "//"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			opts := test.Opts
+			opts.MaxFunctions = 2
+			_, err := ParseWithOptions(test.Text, opts)
+			if test.TooMany != errors.Is(err, ErrTooManyFunctions) {
+				t.Errorf("Want too many functions %v, got error %v", test.TooMany, err)
+			}
+		})
+	}
+}
+
+func TestParseWithOptions_MaxInputBytes(t *testing.T) {
+	text := strings.Repeat("${V}", 100)
+	opts := ParseOptions{MaxInputBytes: len(text)}
+	if _, err := ParseWithOptions(text, opts); err != nil {
+		t.Fatalf("Want the limit reached but not exceeded, got error %v", err)
+	}
+	if _, err := ParseWithOptions(text+"x", opts); !errors.Is(err, ErrInputTooLarge) {
+		t.Fatalf("Want error %q, got %v", ErrInputTooLarge, err)
+	}
+	if _, err := Parse(text + "x"); err != nil {
+		t.Fatalf("Want no limit by default, got error %v", err)
+	}
+
+	if _, err := ParseReaderWithOptions(strings.NewReader(text), opts); err != nil {
+		t.Fatalf("Want the limit reached but not exceeded, got error %v", err)
+	}
+	r := strings.NewReader(text + strings.Repeat("x", 1<<20))
+	if _, err := ParseReaderWithOptions(r, opts); !errors.Is(err, ErrInputTooLarge) {
+		t.Fatalf("Want error %q, got %v", ErrInputTooLarge, err)
+	}
+	if r.Len() != 1<<20-1 {
+		t.Errorf("Want reading stopped one byte past the limit, got %d bytes left", r.Len())
+	}
+}
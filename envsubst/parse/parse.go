@@ -21,7 +21,13 @@ limitations under the License.
 package parse
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 var (
@@ -42,49 +48,436 @@ var (
 	// ErrParseDefaultFunction represent the error when unable to parse a
 	// default function.
 	ErrParseDefaultFunction = errors.New("unable to parse default function")
+
+	// ErrUnterminatedEscape represents the error when an escape character
+	// is the last character of the input.
+	ErrUnterminatedEscape = errors.New("unterminated escape sequence")
+
+	// ErrMissingClosingParen represents a missing closing parenthesis
+	// error of an arithmetic expansion or a command substitution.
+	ErrMissingClosingParen = errors.New("missing closing parenthesis")
+
+	// ErrInvalidDelimiters represents delimiters in ParseOptions which
+	// are not made of two runes on the left and one rune on the right.
+	ErrInvalidDelimiters = errors.New("invalid delimiters")
+
+	// ErrMissingOffset represents a substring function without offset,
+	// i.e. "${VAR:}". It is returned wrapped with ErrParseFuncSubstitution.
+	ErrMissingOffset = errors.New("missing substring offset")
+
+	// ErrMissingLength represents a substring function with an empty
+	// length, i.e. "${VAR:1:}". It is returned wrapped with
+	// ErrParseFuncSubstitution.
+	ErrMissingLength = errors.New("missing substring length")
+
+	// ErrMissingPattern represents a replace function with an empty
+	// pattern, i.e. "${VAR//}" or "${VAR///x}". It is returned wrapped
+	// with ErrParseFuncSubstitution.
+	ErrMissingPattern = errors.New("missing replace pattern")
+
+	// ErrLengthOperand represents a length function applied to anything
+	// but a parameter name, e.g. "${#VAR:0:3}" or "${#VAR[@]}", which
+	// bash rejects as well.
+	ErrLengthOperand = errors.New("length only applies to a parameter name")
+
+	// ErrMissingClosingQuote represents a missing closing single quote
+	// error of a literal.
+	ErrMissingClosingQuote = errors.New("missing closing quote")
+
+	// ErrCommandSubstitutionDisallowed represents a command substitution
+	// "$(...)" found while ParseOptions.AllowCommandSubstitution is unset.
+	ErrCommandSubstitutionDisallowed = errors.New("command substitution is not allowed")
+
+	// ErrUnsupportedOperator represents the error when a substitution
+	// function is not supported by the parsing mode.
+	ErrUnsupportedOperator = errors.New("unsupported operator")
+
+	// ErrUnknownTransformation represents a "${param@operator}"
+	// transformation with an operator letter bash does not define.
+	ErrUnknownTransformation = errors.New("unknown transformation operator")
+
+	// ErrTooManyFunctions represents a template with more substitutions
+	// than ParseOptions.MaxFunctions.
+	ErrTooManyFunctions = errors.New("too many functions")
+
+	// ErrInputTooLarge represents a template larger than
+	// ParseOptions.MaxInputBytes.
+	ErrInputTooLarge = errors.New("input too large")
+
+	// ErrFunctionsDisabled represents a substitution with an operator
+	// parsed with ParseOptions.DisableFunctions.
+	ErrFunctionsDisabled = errors.New("functions are disabled")
+
+	// ErrOperatorNotAllowed represents a function whose operation is
+	// not in the OperatorSet given to Tree.Validate.
+	ErrOperatorNotAllowed = errors.New("operator not allowed")
 )
 
+// contextLen is the number of bytes of input shown on either side of
+// the offset of a ParseError.
+const contextLen = 10
+
+// ParseError represents an error encountered while parsing a template.
+// It records the byte offset in the input where scanning failed and a
+// snippet of the surrounding text.
+type ParseError struct {
+	// Err is the underlying parsing error.
+	Err error
+	// Offset is the byte offset in the input where the error occurred.
+	Offset int
+	// Context is a snippet of the input surrounding Offset.
+	Context string
+	// Partial is the tree of the input parsed successfully before the
+	// error, or nil if the error occurred in the first segment.
+	Partial *Tree
+	// Remainder is the input left unconsumed by Partial, starting with
+	// the segment that failed to parse.
+	Remainder string
+}
+
+// Error returns the underlying error with the offset and context.
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s at offset %d: %q", e.Err, e.Offset, e.Context)
+}
+
+// Unwrap returns the underlying Err.
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Position returns the 1-based line and column of the error in src,
+// the input the error was returned for. Columns count Unicode
+// characters, a tab being a single column. Both "\n" and "\r\n"
+// terminate lines.
+func (e *ParseError) Position(src string) (line, col int) {
+	prefix := src[:min(e.Offset, len(src))]
+	line = 1 + strings.Count(prefix, "\n")
+	start := strings.LastIndexByte(prefix, '\n') + 1
+	col = 1 + utf8.RuneCountInString(prefix[start:])
+	return line, col
+}
+
 // Tree is the representation of a single parsed SQL statement.
 type Tree struct {
 	Root Node
 
 	// Parsing only; cleared after parse.
 	scanner *scanner
+	opts    ParseOptions
+
+	// parsed holds the top-level nodes parsed so far and consumed the
+	// offset of the input following them.
+	parsed   []Node
+	consumed int
+
+	// ctx cancels the parse, checked every ctxCheckInterval segments.
+	ctx   context.Context
+	steps int
+
+	// funcs is the number of substitutions parsed, see countFunc.
+	funcs int
 }
 
+// ctxCheckInterval is the number of top-level segments parsed between
+// two checks of the context given to ParseContext.
+const ctxCheckInterval = 64
+
 // Parse parses the string and returns a Tree.
 func Parse(buf string) (*Tree, error) {
+	return ParseWithOptions(buf, ParseOptions{})
+}
+
+// ParseContext is like Parse but stops parsing and returns ctx.Err()
+// once the context is done.
+func ParseContext(ctx context.Context, buf string) (*Tree, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	t := new(Tree)
+	t.scanner = new(scanner)
+	t.ctx = ctx
+	return t.Parse(buf)
+}
+
+// MustParse is like Parse but panics if the string cannot be parsed.
+// It simplifies safe initialization of global variables holding
+// templates.
+func MustParse(buf string) *Tree {
+	t, err := Parse(buf)
+	if err != nil {
+		panic(`parse: Parse(` + strconv.Quote(buf) + `): ` + err.Error())
+	}
+	return t
+}
+
+// ParseWithOptions parses the string with the given options and
+// returns a Tree.
+func ParseWithOptions(buf string, opts ParseOptions) (*Tree, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
 	t := new(Tree)
 	t.scanner = new(scanner)
+	t.opts = opts
 	return t.Parse(buf)
 }
 
+// String returns the template source of the tree, with the delimiters
+// it was parsed with.
+func (t *Tree) String() string {
+	if t.Root == nil {
+		return ""
+	}
+	return t.opts.syntax().render(t.Root)
+}
+
+// SegmentError represents an error parsing a segment of the input
+// given to ParseAll.
+type SegmentError struct {
+	// Index is the index of the segment that failed to parse.
+	Index int
+	// Offset is the byte offset of the segment in the input.
+	Offset int
+	// Err is the parsing error of the segment.
+	Err error
+}
+
+// Error returns Err prefixed with the index of the segment.
+func (e *SegmentError) Error() string {
+	return fmt.Sprintf("segment %d: %s", e.Index, e.Err)
+}
+
+// Unwrap returns the underlying Err.
+func (e *SegmentError) Unwrap() error {
+	return e.Err
+}
+
+// ParseAll splits the string on sep and parses each segment
+// independently, returning a Tree per segment. Segments failing to parse
+// have a nil Tree, and their errors are joined in the returned error as
+// SegmentError values.
+func ParseAll(buf string, sep byte) ([]*Tree, error) {
+	segments := strings.Split(buf, string(sep))
+	trees := make([]*Tree, len(segments))
+	var errs []error
+	offset := 0
+	for i, segment := range segments {
+		tree, err := Parse(segment)
+		if err != nil {
+			errs = append(errs, &SegmentError{Index: i, Offset: offset, Err: err})
+		} else {
+			trees[i] = tree
+		}
+		offset += len(segment) + 1
+	}
+	return trees, errors.Join(errs...)
+}
+
+// ParseReader reads the template from r and returns a Tree.
+func ParseReader(r io.Reader) (*Tree, error) {
+	return ParseReaderWithOptions(r, ParseOptions{})
+}
+
+// ParseReaderWithOptions reads the template from r and parses it with
+// the given options. With ParseOptions.MaxInputBytes set, it stops
+// reading one byte past the limit and fails with ErrInputTooLarge.
+func ParseReaderWithOptions(r io.Reader, opts ParseOptions) (*Tree, error) {
+	if max := opts.MaxInputBytes; max > 0 {
+		r = io.LimitReader(r, int64(max)+1)
+	}
+	// TODO: feed the scanner directly from r instead of buffering
+	// the whole input.
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return ParseWithOptions(string(b), opts)
+}
+
 // Parse parses the string buffer to construct an ast
 // representation for expansion.
 func (t *Tree) Parse(buf string) (tree *Tree, err error) {
+	if max := t.opts.MaxInputBytes; max > 0 && len(buf) > max {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrInputTooLarge, max)
+	}
 	t.scanner.init(buf)
+	t.scanner.sigil, t.scanner.lbrack, t.scanner.rbrack = t.opts.delims()
+	t.scanner.ident = t.acceptIdent()
+	t.parsed, t.consumed = nil, 0
+	t.steps = 0
+	t.funcs = 0
 	t.Root, err = t.parseAny()
+	var perr *ParseError
+	if errors.As(err, &perr) {
+		perr.Partial = t.partial()
+		perr.Remainder = buf[t.consumed:]
+	}
+	t.parsed = nil
 	return t, err
 }
 
+// partial returns a tree of the top-level nodes parsed so far.
+func (t *Tree) partial() *Tree {
+	switch len(t.parsed) {
+	case 0:
+		return nil
+	case 1:
+		return &Tree{Root: t.parsed[0]}
+	default:
+		return &Tree{Root: newListNode(t.parsed...)}
+	}
+}
+
+// Clone returns a deep copy of the tree. The nodes of the copy are not
+// shared with t, so either tree can be modified without affecting the
+// other, e.g. to hand a cached tree to concurrent callers.
+func (t *Tree) Clone() *Tree {
+	if t == nil {
+		return nil
+	}
+	return &Tree{Root: cloneNode(t.Root), opts: t.opts}
+}
+
+// Variables returns the names of the variables referenced by the tree,
+// including the ones nested in function arguments. The names are
+// de-duplicated and returned in the order they first appear.
+func (t *Tree) Variables() []string {
+	var names []string
+	seen := make(map[string]bool)
+	Walk(t, func(n Node) bool {
+		if fn, ok := n.(*FuncNode); ok && fn.Param != "" && fn.Op() != OpPrefixNames && !seen[fn.Param] {
+			seen[fn.Param] = true
+			names = append(names, fn.Param)
+		}
+		return true
+	})
+	return names
+}
+
+// Defaults returns the literal default values of the variables referenced
+// with a default function, i.e. ${VAR=word}, ${VAR:=word}, ${VAR-word} or
+// ${VAR:-word}.
+// Defaults which contain nested substitutions are skipped, and only the
+// first default of a variable is returned.
+func (t *Tree) Defaults() map[string]string {
+	defaults := make(map[string]string)
+	Walk(t, func(n Node) bool {
+		fn, ok := n.(*FuncNode)
+		if !ok {
+			return true
+		}
+		switch fn.Name {
+		case "=", ":=", "-", ":-":
+		default:
+			return true
+		}
+		if _, ok := defaults[fn.Param]; ok {
+			return true
+		}
+		var b strings.Builder
+		for _, arg := range fn.Args {
+			text, ok := arg.(*TextNode)
+			if !ok {
+				return true
+			}
+			b.WriteString(text.Value)
+		}
+		defaults[fn.Param] = b.String()
+		return true
+	})
+	return defaults
+}
+
+// IsPlainText reports whether the tree is made of text only, i.e. its
+// root is a single TextNode or it is empty. Such a tree evaluates to
+// its text without looking up any variable.
+func (t *Tree) IsPlainText() bool {
+	if t == nil || t.Root == nil {
+		return true
+	}
+	_, ok := t.Root.(*TextNode)
+	return ok
+}
+
+// HasFunctions reports whether the tree contains a FuncNode with an
+// operator, as opposed to plain variable references like ${VAR}.
+func (t *Tree) HasFunctions() bool {
+	var found bool
+	Walk(t, func(n Node) bool {
+		if fn, ok := n.(*FuncNode); ok && fn.Name != "" {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// Validate returns an error wrapping ErrOperatorNotAllowed for the first
+// function, in source order, whose operation is not in allowed. Plain
+// references like ${VAR} must be allowed with OpNone. It lets callers
+// restrict the operators of templates from untrusted sources.
+func (t *Tree) Validate(allowed OperatorSet) error {
+	var err error
+	Walk(t, func(n Node) bool {
+		if fn, ok := n.(*FuncNode); ok && !allowed.Has(fn.Op()) {
+			err = fmt.Errorf("%w: %q on variable %q", ErrOperatorNotAllowed, fn.Name, fn.Param)
+		}
+		return err == nil
+	})
+	return err
+}
+
+// Cost returns an estimate of the work needed to evaluate the tree, as
+// the sum of the costs of its functions. Plain text costs nothing. It
+// lets callers refuse expensive templates before evaluating them.
+func (t *Tree) Cost() int {
+	if t == nil {
+		return 0
+	}
+	return nodeCost(t.Root)
+}
+
+// Simplify rewrites the tree in place into an equivalent one with fewer
+// nodes, to make repeated expansions faster: the nested lists are
+// flattened into a single list, in which the adjacent text nodes are
+// merged, and the words of the functions are simplified the same way.
+// The expansion of the tree is unchanged, only String may escape fewer
+// dollar signs of the merged text.
+func (t *Tree) Simplify() {
+	if t == nil || t.Root == nil {
+		return
+	}
+	t.Root = simplify(t.Root)
+}
+
 func (t *Tree) parseAny() (Node, error) {
+	if t.ctx != nil {
+		t.steps++
+		if t.steps%ctxCheckInterval == 0 {
+			if err := t.ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	t.scanner.accept = acceptRune
-	t.scanner.mode = scanIdent | scanLbrack | scanEscape
+	t.scanner.mode = scanIdent | scanLbrack | scanEscape | scanArith | scanCmd
 	t.scanner.escapeChars = dollar
+	if t.opts.UnescapeBackslashes {
+		t.scanner.escapeChars |= escapedBackslash
+	}
+	if t.opts.AllowSingleQuoteLiterals {
+		t.scanner.mode |= scanQuote
+	}
+	if t.opts.AllowBareReferences {
+		t.scanner.mode |= scanBare
+	}
 
 	switch t.scanner.scan() {
 	case tokenIdent:
-		left := newTextNode(
+		return t.parseNext(newTextNode(
 			t.scanner.string(),
-		)
-		right, err := t.parseAny()
-		switch {
-		case err != nil:
-			return nil, err
-		case right == empty:
-			return left, nil
-		}
-		return newListNode(left, right), nil
+		))
 	case tokenEOF:
 		return empty, nil
 	case tokenLbrack:
@@ -92,43 +485,156 @@ func (t *Tree) parseAny() (Node, error) {
 		if err != nil {
 			return nil, err
 		}
-
-		right, err := t.parseAny()
-		switch {
-		case err != nil:
+		return t.parseNext(left)
+	case tokenArith:
+		left, err := t.parseArith()
+		if err != nil {
 			return nil, err
-		case right == empty:
-			return left, nil
 		}
-		return newListNode(left, right), nil
+		return t.parseNext(left)
+	case tokenCmd:
+		if !t.opts.AllowCommandSubstitution {
+			return nil, t.error(ErrCommandSubstitutionDisallowed)
+		}
+		left, err := t.parseCmd()
+		if err != nil {
+			return nil, err
+		}
+		return t.parseNext(left)
+	case tokenQuote:
+		left, err := t.parseQuote()
+		if err != nil {
+			return nil, err
+		}
+		return t.parseNext(left)
+	case tokenBare:
+		left, err := t.parseBare()
+		if err != nil {
+			return nil, err
+		}
+		return t.parseNext(left)
 	}
 
-	return nil, ErrBadSubstitution
+	return nil, t.error(ErrBadSubstitution)
+}
+
+// parseNext parses the remainder of the input and returns it in a list
+// following the left node.
+func (t *Tree) parseNext(left Node) (Node, error) {
+	start := t.consumed
+	t.track(left, start)
+	t.parsed = append(t.parsed, left)
+	t.consumed = t.scanner.pos
+	right, err := t.parseAny()
+	switch {
+	case err != nil:
+		return nil, err
+	case right == empty:
+		return left, nil
+	}
+	return t.track(newListNode(left, right), start), nil
+}
+
+// sourceSetter is implemented by the nodes embedding a Span.
+type sourceSetter interface {
+	setSource(start, end int)
+}
+
+// track records the span of the input from start to the current position
+// of the scanner as the source of the node, when tracking the source.
+func (t *Tree) track(n Node, start int) Node {
+	if !t.opts.TrackSource {
+		return n
+	}
+	if s, ok := n.(sourceSetter); ok {
+		s.setSource(start, t.scanner.pos)
+	}
+	return n
+}
+
+// countFunc counts a substitution, and returns an error once there are
+// more than ParseOptions.MaxFunctions.
+func (t *Tree) countFunc() error {
+	t.funcs++
+	if max := t.opts.MaxFunctions; max > 0 && t.funcs > max {
+		return t.error(fmt.Errorf("%w: more than %d", ErrTooManyFunctions, max))
+	}
+	return nil
+}
+
+// parseBare parses the name of a reference without braces following
+// the sigil, e.g. "$HOME", into a plain variable reference.
+func (t *Tree) parseBare() (Node, error) {
+	if err := t.countFunc(); err != nil {
+		return nil, err
+	}
+	t.scanner.accept = t.acceptIdent()
+	if r := t.scanner.peek(); '0' <= r && r <= '9' {
+		// positional parameters are a single digit
+		t.scanner.accept = acceptOneDigit
+	}
+	t.scanner.mode = scanIdent
+
+	if t.scanner.scan() != tokenIdent {
+		return nil, t.error(ErrParseVariableName)
+	}
+	name := t.scanner.string()
+	if err := t.checkIdent(name); err != nil {
+		return nil, err
+	}
+	return &FuncNode{Param: name}, nil
 }
 
 func (t *Tree) parseFunc() (Node, error) {
+	if p := t.opts.CommentPrefix; p != "" && strings.HasPrefix(t.scanner.buf[t.scanner.pos:], p) {
+		return t.parseComment()
+	}
+	if err := t.countFunc(); err != nil {
+		return nil, err
+	}
+
 	// Turn on all escape characters
 	t.scanner.escapeChars = escapeAll
+	if err := t.checkFunction(); err != nil {
+		return nil, err
+	}
 	switch t.scanner.peek() {
 	case '#':
 		return t.parseLenFunc()
+	case '!':
+		return t.parseIndirectFunc()
 	}
 
 	var name string
-	t.scanner.accept = acceptIdent
+	t.scanner.accept = t.acceptIdent()
 	t.scanner.mode = scanIdent
 
 	switch t.scanner.scan() {
 	case tokenIdent:
 		name = t.scanner.string()
 	default:
-		return nil, ErrParseVariableName
+		return nil, t.error(ErrParseVariableName)
+	}
+	if err := t.checkIdent(name); err != nil {
+		return nil, err
+	}
+	if err := t.checkFunction(); err != nil {
+		return nil, paramError(name, err)
+	}
+
+	node, err := t.parseFuncOp(name)
+	if err != nil {
+		return nil, paramError(name, err)
 	}
+	return node, nil
+}
 
+// parses the operator and arguments of the function of the parameter name.
+func (t *Tree) parseFuncOp(name string) (Node, error) {
 	switch t.scanner.peek() {
 	case ':':
 		return t.parseDefaultOrSubstr(name)
-	case '=':
+	case '=', '-', '?', '+':
 		return t.parseDefaultFunc(name)
 	case ',', '^':
 		return t.parseCasingFunc(name)
@@ -138,26 +644,63 @@ func (t *Tree) parseFunc() (Node, error) {
 		return t.parseRemoveFunc(name, acceptHashFunc)
 	case '%':
 		return t.parseRemoveFunc(name, acceptPercentFunc)
+	case '@':
+		return t.parseTransformFunc(name)
 	}
 
-	t.scanner.accept = acceptIdent
+	t.scanner.accept = t.acceptIdent()
 	t.scanner.mode = scanRbrack
 	switch t.scanner.scan() {
 	case tokenRbrack:
 		return newFuncNode(name), nil
 	default:
-		return nil, ErrMissingClosingBrace
+		return nil, t.error(ErrMissingClosingBrace)
+	}
+}
+
+// paramError prefixes the message of err with the name of the parameter
+// whose substitution failed to parse. The ParseError of the root cause
+// is kept, so that errors.Is and errors.As still match it.
+func paramError(name string, err error) error {
+	var perr *ParseError
+	if errors.As(err, &perr) {
+		perr.Err = fmt.Errorf("parameter %q: %w", name, perr.Err)
+		return err
 	}
+	return fmt.Errorf("parameter %q: %w", name, err)
 }
 
 // parse a substitution function parameter.
 func (t *Tree) parseParam(accept acceptFunc, mode byte) (Node, error) {
+	start := t.scanner.pos
+	node, err := t.scanParam(accept, mode)
+	if err != nil {
+		return nil, err
+	}
+	return t.track(node, start), nil
+}
+
+// scanParam scans and parses a substitution function parameter.
+func (t *Tree) scanParam(accept acceptFunc, mode byte) (Node, error) {
 	t.scanner.accept = accept
-	t.scanner.mode = mode | scanLbrack
+	t.scanner.mode = mode | scanLbrack | scanCmd
+	if t.opts.AllowBareReferences {
+		t.scanner.mode |= scanBare
+	}
 	switch t.scanner.scan() {
 	case tokenLbrack:
 		return t.parseFunc()
+	case tokenBare:
+		return t.parseBare()
+	case tokenCmd:
+		if !t.opts.AllowCommandSubstitution {
+			return nil, t.error(ErrCommandSubstitutionDisallowed)
+		}
+		return t.parseCmd()
 	case tokenIdent:
+		if t.scanner.unterminated {
+			return nil, t.error(ErrUnterminatedEscape)
+		}
 		return newTextNode(
 			t.scanner.string(),
 		), nil
@@ -165,8 +708,10 @@ func (t *Tree) parseParam(accept acceptFunc, mode byte) (Node, error) {
 		return newTextNode(
 			t.scanner.string(),
 		), nil
+	case tokenEOF:
+		return nil, t.error(ErrMissingClosingBrace)
 	default:
-		return nil, ErrParseFuncSubstitution
+		return nil, t.error(ErrParseFuncSubstitution)
 	}
 }
 
@@ -195,42 +740,93 @@ func (t *Tree) parseSubstrFunc(name string) (Node, error) {
 	case tokenIdent:
 		node.Name = t.scanner.string()
 	default:
-		return nil, ErrBadSubstitution
+		return nil, t.error(ErrBadSubstitution)
+	}
+	if err := t.requireBash(node.Name); err != nil {
+		return nil, err
+	}
+
+	// ${param:} and ${param::length} have no offset, which is rejected
+	// rather than defaulting to zero
+	switch t.scanner.peek() {
+	case t.scanner.rbrack, ':':
+		t.scanner.accept = acceptOneColon
+		t.scanner.mode = scanIdent | scanRbrack
+		t.scanner.scan()
+		return nil, t.error(fmt.Errorf("%w: %w", ErrParseFuncSubstitution, ErrMissingOffset))
 	}
 
 	// scan arg[1]
 	{
-		param, err := t.parseParam(rejectColonClose, scanIdent)
+		param, err := t.parseSubstrArg()
 		if err != nil {
 			return nil, err
 		}
-
-		// param.Value = t.scanner.string()
 		node.Args = append(node.Args, param)
 	}
 
 	// expect delimiter or close
-	t.scanner.accept = acceptColon
+	t.scanner.accept = acceptOneColon
 	t.scanner.mode = scanIdent | scanRbrack
 	switch t.scanner.scan() {
 	case tokenRbrack:
 		return node, nil
 	case tokenIdent:
 		// no-op
+	case tokenEOF:
+		return nil, t.error(ErrMissingClosingBrace)
 	default:
-		return nil, ErrBadSubstitution
+		return nil, t.error(ErrBadSubstitution)
+	}
+
+	// ${param:offset:} has an empty length, rejected like the offset
+	if t.scanner.peek() == t.scanner.rbrack {
+		t.scanner.mode = scanRbrack
+		t.scanner.scan()
+		return nil, t.error(fmt.Errorf("%w: %w", ErrParseFuncSubstitution, ErrMissingLength))
 	}
 
 	// scan arg[2]
 	{
-		param, err := t.parseParam(acceptNotClosing, scanIdent)
+		param, err := t.parseSubstrArg()
 		if err != nil {
 			return nil, err
 		}
 		node.Args = append(node.Args, param)
 	}
 
-	return node, t.consumeRbrack()
+	// expect close, a third argument like ${param:1:2:3} is rejected
+	t.scanner.accept = acceptOneColon
+	t.scanner.mode = scanIdent | scanRbrack
+	switch t.scanner.scan() {
+	case tokenRbrack:
+		return node, nil
+	case tokenEOF:
+		return nil, t.error(ErrMissingClosingBrace)
+	default:
+		return nil, t.error(ErrParseFuncSubstitution)
+	}
+}
+
+// parseSubstrArg parses the offset or the length of a substring
+// function, which may be made of text and nested substitutions, e.g.
+// ${param:${offset}} or ${param: -${n}}.
+func (t *Tree) parseSubstrArg() (Node, error) {
+	var parts []Node
+	for {
+		param, err := t.parseParam(rejectColonClose, scanIdent)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, param)
+		if r := t.scanner.peek(); r == ':' || r == t.scanner.rbrack || r == eof {
+			break
+		}
+	}
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	return t.track(newListNode(parts...), parts[0].Source().Start), nil
 }
 
 // parses the ${param%word} string function
@@ -247,18 +843,25 @@ func (t *Tree) parseRemoveFunc(name string, accept acceptFunc) (Node, error) {
 	case tokenIdent:
 		node.Name = t.scanner.string()
 	default:
-		return nil, ErrBadSubstitution
+		return nil, t.error(ErrBadSubstitution)
 	}
 
-	// scan arg[1]
-	{
+	// scan arg[1], which may be made of text and nested substitutions
+	var parts []Node
+	for {
 		param, err := t.parseParam(acceptNotClosing, scanIdent)
 		if err != nil {
 			return nil, err
 		}
-
-		// param.Value = t.scanner.string()
-		node.Args = append(node.Args, param)
+		parts = append(parts, param)
+		if t.scanner.peek() == t.scanner.rbrack {
+			break
+		}
+	}
+	if len(parts) == 1 {
+		node.Args = append(node.Args, parts[0])
+	} else {
+		node.Args = append(node.Args, t.track(newListNode(parts...), parts[0].Source().Start))
 	}
 
 	return node, t.consumeRbrack()
@@ -272,17 +875,32 @@ func (t *Tree) parseReplaceFunc(name string) (Node, error) {
 	node := new(FuncNode)
 	node.Param = name
 
+	// the anchor of "/#" and "/%" is part of the name, never of the pattern
 	t.scanner.accept = acceptReplaceFunc
 	t.scanner.mode = scanIdent
 	switch t.scanner.scan() {
 	case tokenIdent:
 		node.Name = t.scanner.string()
+		node.Global = node.Op() == OpReplaceAll
 	default:
-		return nil, ErrBadSubstitution
+		return nil, t.error(ErrBadSubstitution)
+	}
+	if err := t.requireBash(node.Name); err != nil {
+		return nil, err
 	}
 
-	// scan arg[1]
-	{
+	// an empty pattern only makes sense when anchored, where it inserts
+	// the string at the start or the end of the value as in bash
+	switch r := t.scanner.peek(); {
+	case r == '/' && (node.Op() == OpReplacePrefix || node.Op() == OpReplaceSuffix):
+		node.Args = append(node.Args, newTextNode(""))
+	case r == '/', r == t.scanner.rbrack:
+		t.scanner.accept = acceptSlash
+		t.scanner.mode = scanIdent | scanRbrack
+		t.scanner.scan()
+		return nil, t.error(fmt.Errorf("%w: %w", ErrParseFuncSubstitution, ErrMissingPattern))
+	default:
+		// scan arg[1]
 		param, err := t.parseParam(acceptNotSlash, scanIdent|scanEscape)
 		if err != nil {
 			return nil, err
@@ -296,13 +914,15 @@ func (t *Tree) parseReplaceFunc(name string) (Node, error) {
 	switch t.scanner.scan() {
 	case tokenIdent:
 		// no-op
+	case tokenEOF:
+		return nil, t.error(ErrMissingClosingBrace)
 	default:
-		return nil, ErrBadSubstitution
+		return nil, t.error(ErrBadSubstitution)
 	}
 
 	// check for blank string
 	switch t.scanner.peek() {
-	case '}':
+	case t.scanner.rbrack:
 		return node, t.consumeRbrack()
 	}
 
@@ -320,33 +940,45 @@ func (t *Tree) parseReplaceFunc(name string) (Node, error) {
 
 // parses the ${parameter=word} string function
 // parses the ${parameter:=word} string function
+// parses the ${parameter-word} string function
 // parses the ${parameter:-word} string function
+// parses the ${parameter?word} string function
 // parses the ${parameter:?word} string function
+// parses the ${parameter+word} string function
 // parses the ${parameter:+word} string function
 func (t *Tree) parseDefaultFunc(name string) (Node, error) {
 	node := new(FuncNode)
 	node.Param = name
 
+	// the forms without a colon only test whether the parameter is set
 	t.scanner.accept = acceptDefaultFunc
-	if t.scanner.peek() == '=' {
-		t.scanner.accept = acceptOneEqual
+	if t.scanner.peek() != ':' {
+		t.scanner.accept = acceptOneDefaultOp
 	}
 	t.scanner.mode = scanIdent
 	switch t.scanner.scan() {
 	case tokenIdent:
 		node.Name = t.scanner.string()
 	default:
-		return nil, ErrParseDefaultFunction
+		return nil, t.error(ErrParseDefaultFunction)
 	}
 
 	// loop through all possible runes in default param
 	for {
 		// this acts as the break condition. Peek to see if we reached the end
 		switch t.scanner.peek() {
-		case '}':
+		case t.scanner.rbrack:
+			// restore the escape characters of the enclosing function
+			t.scanner.escapeChars = escapeAll
 			return node, t.consumeRbrack()
 		}
-		param, err := t.parseParam(acceptNotClosing, scanIdent)
+		// only allow escaping the closing brace and the dollar sign, as
+		// other backslashes are taken literally in default words
+		t.scanner.escapeChars = rbrace | escapedDollar
+		if t.opts.UnescapeBackslashes {
+			t.scanner.escapeChars |= escapedBackslash
+		}
+		param, err := t.parseParam(acceptNotClosing, scanIdent|scanEscape)
 		if err != nil {
 			return nil, err
 		}
@@ -359,6 +991,10 @@ func (t *Tree) parseDefaultFunc(name string) (Node, error) {
 // parses the ${param,,} string function
 // parses the ${param^} string function
 // parses the ${param^^} string function
+// parses the ${param,pattern} string function
+// parses the ${param,,pattern} string function
+// parses the ${param^pattern} string function
+// parses the ${param^^pattern} string function
 func (t *Tree) parseCasingFunc(name string) (Node, error) {
 	node := new(FuncNode)
 	node.Param = name
@@ -369,13 +1005,64 @@ func (t *Tree) parseCasingFunc(name string) (Node, error) {
 	case tokenIdent:
 		node.Name = t.scanner.string()
 	default:
-		return nil, ErrBadSubstitution
+		return nil, t.error(ErrBadSubstitution)
+	}
+	if err := t.requireBash(node.Name); err != nil {
+		return nil, err
+	}
+
+	// scan the optional pattern
+	if t.scanner.peek() != t.scanner.rbrack {
+		param, err := t.parseParam(acceptNotClosing, scanIdent)
+		if err != nil {
+			return nil, err
+		}
+		node.Args = append(node.Args, param)
+	}
+
+	return node, t.consumeRbrack()
+}
+
+// transformations lists the operator letters of the ${param@operator}
+// transformations defined by bash.
+const transformations = "QEPAKaUuLk"
+
+// parses the ${param@operator} transformation function
+func (t *Tree) parseTransformFunc(name string) (Node, error) {
+	node := new(FuncNode)
+	node.Param = name
+
+	t.scanner.accept = acceptOneAt
+	t.scanner.mode = scanIdent
+	switch t.scanner.scan() {
+	case tokenIdent:
+		node.Name = t.scanner.string()
+	default:
+		return nil, t.error(ErrBadSubstitution)
+	}
+	if err := t.requireBash(node.Name); err != nil {
+		return nil, err
+	}
+
+	// scan the operator letter
+	t.scanner.accept = acceptNotClosing
+	t.scanner.mode = scanIdent
+	switch t.scanner.scan() {
+	case tokenIdent:
+		op := t.scanner.string()
+		if utf8.RuneCountInString(op) != 1 || !strings.Contains(transformations, op) {
+			return nil, t.error(fmt.Errorf("%w %q", ErrUnknownTransformation, op))
+		}
+		node.Args = append(node.Args, t.track(newTextNode(op), t.scanner.offset()))
+	default:
+		return nil, t.error(ErrBadSubstitution)
 	}
 
 	return node, t.consumeRbrack()
 }
 
 // parses the ${#param} string function
+// parses the ${#} special parameter
 func (t *Tree) parseLenFunc() (Node, error) {
 	node := new(FuncNode)
 
@@ -385,27 +1072,279 @@ func (t *Tree) parseLenFunc() (Node, error) {
 	case tokenIdent:
 		node.Name = t.scanner.string()
 	default:
-		return nil, ErrBadSubstitution
+		return nil, t.error(ErrBadSubstitution)
+	}
+
+	// ${#} references the number of positional parameters
+	if t.scanner.peek() == t.scanner.rbrack {
+		return newFuncNode(node.Name), t.consumeRbrack()
+	}
+
+	t.scanner.accept = t.acceptIdent()
+	t.scanner.mode = scanIdent
+	switch t.scanner.scan() {
+	case tokenIdent:
+		node.Param = t.scanner.string()
+	default:
+		return nil, t.error(ErrBadSubstitution)
+	}
+	if err := t.checkIdent(node.Param); err != nil {
+		return nil, err
+	}
+
+	// operators and subscripts cannot follow the name, scan the rune
+	// without accepting it to report its offset
+	switch r := t.scanner.peek(); r {
+	case t.scanner.rbrack, eof:
+	case '[':
+		t.scanner.mode = 0
+		t.scanner.scan()
+		return nil, paramError(node.Param, t.error(fmt.Errorf("%w: array subscripts are not supported", ErrLengthOperand)))
+	default:
+		t.scanner.mode = 0
+		t.scanner.scan()
+		return nil, paramError(node.Param, t.error(fmt.Errorf("%w: unexpected %q", ErrLengthOperand, r)))
+	}
+
+	return node, t.consumeRbrack()
+}
+
+// parses the ${!param} string function
+// parses the ${!prefix*} and ${!prefix@} name listing functions
+func (t *Tree) parseIndirectFunc() (Node, error) {
+	node := new(FuncNode)
+
+	t.scanner.accept = acceptOneBang
+	t.scanner.mode = scanIdent
+	switch t.scanner.scan() {
+	case tokenIdent:
+		node.Name = t.scanner.string()
+	default:
+		return nil, t.error(ErrBadSubstitution)
+	}
+	if err := t.requireBash(node.Name); err != nil {
+		return nil, err
 	}
 
-	t.scanner.accept = acceptIdent
+	t.scanner.accept = t.acceptIdent()
 	t.scanner.mode = scanIdent
 	switch t.scanner.scan() {
 	case tokenIdent:
 		node.Param = t.scanner.string()
 	default:
-		return nil, ErrBadSubstitution
+		return nil, t.error(ErrParseVariableName)
+	}
+	if err := t.checkIdent(node.Param); err != nil {
+		return nil, err
+	}
+
+	// the names of the variables starting with the prefix are listed
+	// when it is followed by "*" or "@", recorded in the name
+	if r := t.scanner.peek(); r == '*' || r == '@' {
+		t.scanner.read()
+		node.Name += string(r)
 	}
 
 	return node, t.consumeRbrack()
 }
 
+// error returns a ParseError wrapping err at the current position of
+// the scanner.
+func (t *Tree) error(err error) error {
+	offset := t.scanner.offset()
+	start, end := offset-contextLen, offset+contextLen
+	prefix, suffix := "...", "..."
+	if start <= 0 {
+		start, prefix = 0, ""
+	}
+	if end >= len(t.scanner.buf) {
+		end, suffix = len(t.scanner.buf), ""
+	}
+	return &ParseError{
+		Err:     err,
+		Offset:  offset,
+		Context: prefix + t.scanner.buf[start:end] + suffix,
+	}
+}
+
+// parses the $((expression)) arithmetic expansion, capturing the raw
+// expression without evaluating it. The substitutions of the expression
+// are parsed too, so that they can be expanded.
+func (t *Tree) parseArith() (Node, error) {
+	start := t.scanner.pos
+	nodes, text, err := t.parseNested(t.scanner.start, "))")
+	switch {
+	case err != nil:
+		return nil, err
+	case text != nil:
+		return text, nil
+	}
+	node := newArithNode(t.scanner.buf[start : t.scanner.pos-len("))")])
+	node.Nodes = nestedNodes(nodes, node.Expr)
+	return node, nil
+}
+
+// parseNested parses the text and substitutions following the opening
+// of an arithmetic expansion or command substitution at offset opener,
+// up to the closing parentheses outside of any nested pair. If they are
+// missing, it fails with ErrMissingClosingParen if RequireClosingParens
+// is set, and otherwise returns the opening and the text following it
+// as literal text, as they are read without the opening.
+func (t *Tree) parseNested(opener int, closing string) ([]Node, *TextNode, error) {
+	accept, mode, escapeChars := t.scanner.accept, t.scanner.mode, t.scanner.escapeChars
+	funcs := t.funcs
+
+	var nodes []Node
+	var text strings.Builder
+	var textStart, textEnd int
+	addText := func(s string, start int) {
+		if text.Len() == 0 {
+			textStart = start
+		}
+		text.WriteString(s)
+		textEnd = t.scanner.pos
+	}
+	flushText := func() {
+		if text.Len() == 0 {
+			return
+		}
+		node := newTextNode(text.String())
+		if t.opts.TrackSource {
+			node.setSource(textStart, textEnd)
+		}
+		nodes = append(nodes, node)
+		text.Reset()
+	}
+
+	depth := 0
+loop:
+	for {
+		// the parentheses end the text, as do the runes the enclosing
+		// text does not accept
+		t.scanner.accept = func(r rune, i int) bool {
+			return r != '(' && r != ')' && accept(r, i)
+		}
+		t.scanner.mode = mode&^(scanArith|scanCmd|scanQuote|scanRbrack) | scanIdent
+		t.scanner.escapeChars = escapeChars
+
+		start := t.scanner.pos
+		var node Node
+		var err error
+		switch t.scanner.scan() {
+		case tokenIdent:
+			addText(t.scanner.string(), start)
+			continue
+		case tokenLbrack:
+			node, err = t.parseFunc()
+		case tokenBare:
+			node, err = t.parseBare()
+		case tokenIllegal:
+			switch rest := t.scanner.buf[start:]; {
+			case rest[0] == '(':
+				depth++
+			case rest[0] == ')' && depth > 0:
+				depth--
+			case strings.HasPrefix(rest, closing):
+				flushText()
+				t.scanner.pos = start + len(closing)
+				t.scanner.accept, t.scanner.mode, t.scanner.escapeChars = accept, mode, escapeChars
+				return nodes, nil, nil
+			case rest[0] != ')':
+				// a rune closing the enclosing substitution
+				break loop
+			}
+			addText(t.scanner.buf[start:t.scanner.pos], start)
+			continue
+		default:
+			// the end of the input
+			break loop
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		flushText()
+		nodes = append(nodes, t.track(node, start))
+	}
+
+	if t.opts.RequireClosingParens {
+		return nil, nil, t.error(ErrMissingClosingParen)
+	}
+	// read the opening again as text, with what follows it
+	t.funcs = funcs
+	t.scanner.pos = opener
+	t.scanner.accept, t.scanner.escapeChars = accept, escapeChars
+	t.scanner.mode = mode &^ (scanArith | scanCmd)
+	t.scanner.scan()
+	node := newTextNode(t.scanner.string())
+	node.Unclosed = true
+	return nil, node, nil
+}
+
+// nestedNodes returns the nodes parsed from the source of an arithmetic
+// expansion or command substitution, or nil if they are the source as
+// it is.
+func nestedNodes(nodes []Node, source string) []Node {
+	if len(nodes) == 0 {
+		return nil
+	}
+	if text, ok := nodes[0].(*TextNode); ok && len(nodes) == 1 && text.Value == source {
+		return nil
+	}
+	return nodes
+}
+
+// parses the $(command) command substitution, capturing the raw
+// command without running it. The substitutions of the command are
+// parsed too, so that they can be expanded.
+func (t *Tree) parseCmd() (Node, error) {
+	start := t.scanner.pos
+	nodes, text, err := t.parseNested(t.scanner.start, ")")
+	switch {
+	case err != nil:
+		return nil, err
+	case text != nil:
+		return text, nil
+	}
+	node := newCmdNode(t.scanner.buf[start : t.scanner.pos-len(")")])
+	node.Nodes = nestedNodes(nodes, node.Command)
+	return node, nil
+}
+
+// parses the 'text' single-quoted literal, capturing the text between
+// the quotes verbatim.
+func (t *Tree) parseQuote() (Node, error) {
+	start := t.scanner.pos
+	for {
+		switch t.scanner.read() {
+		case eof:
+			return nil, t.error(ErrMissingClosingQuote)
+		case '\'':
+			node := newTextNode(t.scanner.buf[start : t.scanner.pos-1])
+			node.Quoted = true
+			return node, nil
+		}
+	}
+}
+
+// parses the ${<prefix>comment} comment up to the closing bracket.
+func (t *Tree) parseComment() (Node, error) {
+	start := t.scanner.pos
+	for {
+		switch t.scanner.read() {
+		case eof:
+			return nil, t.error(ErrMissingClosingBrace)
+		case t.scanner.rbrack:
+			return newCommentNode(t.scanner.buf[start : t.scanner.pos-t.scanner.width]), nil
+		}
+	}
+}
+
 // consumeRbrack consumes a right closing bracket. If a closing
-// bracket token is not consumed an ErrBadSubstitution is returned.
+// bracket token is not consumed an ErrMissingClosingBrace is returned.
 func (t *Tree) consumeRbrack() error {
 	t.scanner.mode = scanRbrack
 	if t.scanner.scan() != tokenRbrack {
-		return ErrBadSubstitution
+		return t.error(ErrMissingClosingBrace)
 	}
 	return nil
 }
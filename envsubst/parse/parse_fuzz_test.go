@@ -0,0 +1,43 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package parse
+
+import (
+	"testing"
+)
+
+func Fuzz_Parse(f *testing.F) {
+	for _, test := range tests {
+		f.Add(test.Text)
+	}
+	f.Add("${VAR/#a/b}")
+	f.Add("${#VAR}")
+	f.Add("${!VAR}")
+	f.Add("${VAR:-a\\}b}")
+	f.Add("${VAR: -2:-1}")
+	f.Add("${VAR^^[a-z]}")
+	f.Add("${VAR/a/b\\")
+	f.Add("$${VAR}${")
+
+	f.Fuzz(func(t *testing.T, data string) {
+		tree, err := Parse(data)
+		if err != nil {
+			return
+		}
+		_ = tree.String()
+	})
+}
@@ -21,6 +21,12 @@ limitations under the License.
 package parse
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -103,6 +109,52 @@ var tests = []struct {
 		},
 	},
 
+	{
+		Text: "${string,,[A-Z]}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ",,",
+			Args: []Node{
+				&TextNode{Value: "[A-Z]"},
+			},
+		},
+	},
+	{
+		Text: "${string^^[aeiou]}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "^^",
+			Args: []Node{
+				&TextNode{Value: "[aeiou]"},
+			},
+		},
+	},
+
+	//
+	// transformation functions
+	//
+
+	{
+		Text: "${string@Q}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "@",
+			Args: []Node{
+				&TextNode{Value: "Q"},
+			},
+		},
+	},
+	{
+		Text: "${string@U}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "@",
+			Args: []Node{
+				&TextNode{Value: "U"},
+			},
+		},
+	},
+
 	//
 	// substring functions
 	//
@@ -128,6 +180,29 @@ var tests = []struct {
 		},
 	},
 
+	{
+		Text: "${string:2:-1}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ":",
+			Args: []Node{
+				&TextNode{Value: "2"},
+				&TextNode{Value: "-1"},
+			},
+		},
+	},
+	{
+		Text: "${string: -2:1}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ":",
+			Args: []Node{
+				&TextNode{Value: " -2"},
+				&TextNode{Value: "1"},
+			},
+		},
+	},
+
 	//
 	// string removal functions
 	//
@@ -171,6 +246,90 @@ var tests = []struct {
 			},
 		},
 	},
+	{
+		Text: "${FILE#${DIR}}",
+		Node: &FuncNode{
+			Param: "FILE",
+			Name:  "#",
+			Args: []Node{
+				&FuncNode{Param: "DIR"},
+			},
+		},
+	},
+	{
+		Text: "${FILE##${DIR}/}",
+		Node: &FuncNode{
+			Param: "FILE",
+			Name:  "##",
+			Args: []Node{
+				&ListNode{
+					Nodes: []Node{
+						&FuncNode{Param: "DIR"},
+						&TextNode{Value: "/"},
+					},
+				},
+			},
+		},
+	},
+	{
+		Text: "${FILE%.${EXT}}",
+		Node: &FuncNode{
+			Param: "FILE",
+			Name:  "%",
+			Args: []Node{
+				&ListNode{
+					Nodes: []Node{
+						&TextNode{Value: "."},
+						&FuncNode{Param: "EXT"},
+					},
+				},
+			},
+		},
+	},
+	{
+		Text: "${FILE%%/${NAME:-tmp}*}",
+		Node: &FuncNode{
+			Param: "FILE",
+			Name:  "%%",
+			Args: []Node{
+				&ListNode{
+					Nodes: []Node{
+						&TextNode{Value: "/"},
+						&FuncNode{
+							Param: "NAME",
+							Name:  ":-",
+							Args:  []Node{&TextNode{Value: "tmp"}},
+						},
+						&TextNode{Value: "*"},
+					},
+				},
+			},
+		},
+	},
+	{
+		Text: "${A%%$$}",
+		Node: &FuncNode{
+			Param: "A",
+			Name:  "%%",
+			Args:  []Node{&TextNode{Value: "$$"}},
+		},
+	},
+	{
+		Text: "${A^^$}",
+		Node: &FuncNode{
+			Param: "A",
+			Name:  "^^",
+			Args:  []Node{&TextNode{Value: "$"}},
+		},
+	},
+	{
+		Text: "${A,$x}",
+		Node: &FuncNode{
+			Param: "A",
+			Name:  ",",
+			Args:  []Node{&TextNode{Value: "$x"}},
+		},
+	},
 
 	//
 	// string replace functions
@@ -189,8 +348,9 @@ var tests = []struct {
 	{
 		Text: "${string//substring/replacement}",
 		Node: &FuncNode{
-			Param: "string",
-			Name:  "//",
+			Param:  "string",
+			Name:   "//",
+			Global: true,
 			Args: []Node{
 				&TextNode{Value: "substring"},
 				&TextNode{Value: "replacement"},
@@ -219,6 +379,62 @@ var tests = []struct {
 			},
 		},
 	},
+	{
+		Text: `${PATH/#\/usr/\/opt}`,
+		Node: &FuncNode{
+			Param: "PATH",
+			Name:  "/#",
+			Args: []Node{
+				&TextNode{Value: "/usr"},
+				&TextNode{Value: "/opt"},
+			},
+		},
+	},
+	{
+		Text: `${PATH/%\/bin/\/sbin}`,
+		Node: &FuncNode{
+			Param: "PATH",
+			Name:  "/%",
+			Args: []Node{
+				&TextNode{Value: "/bin"},
+				&TextNode{Value: "/sbin"},
+			},
+		},
+	},
+	{
+		Text: `${PATH/\$HOME/~}`,
+		Node: &FuncNode{
+			Param: "PATH",
+			Name:  "/",
+			Args: []Node{
+				&TextNode{Value: "$HOME"},
+				&TextNode{Value: "~"},
+			},
+		},
+	},
+	{
+		Text: `${PATH/~/\$HOME}`,
+		Node: &FuncNode{
+			Param: "PATH",
+			Name:  "/",
+			Args: []Node{
+				&TextNode{Value: "~"},
+				&TextNode{Value: "$HOME"},
+			},
+		},
+	},
+	{
+		Text: "${string//#/-}",
+		Node: &FuncNode{
+			Param:  "string",
+			Name:   "//",
+			Global: true,
+			Args: []Node{
+				&TextNode{Value: "#"},
+				&TextNode{Value: "-"},
+			},
+		},
+	},
 
 	//
 	// default value functions
@@ -264,24 +480,278 @@ var tests = []struct {
 		},
 	},
 	{
-		Text: "${string:+default}",
-		Node: &FuncNode{
-			Param: "string",
-			Name:  ":+",
-			Args: []Node{
-				&TextNode{Value: "default"},
-			},
+		Text: "${string:-}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ":-",
+		},
+	},
+	{
+		Text: "${string:=}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ":=",
+		},
+	},
+	{
+		Text: "${string:+}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ":+",
+		},
+	},
+	{
+		Text: "${string=}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "=",
+		},
+	},
+	{
+		Text: "${string:?must be set and non-empty}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ":?",
+			Args: []Node{
+				&TextNode{Value: "must be set and non-empty"},
+			},
+		},
+	},
+	{
+		Text: "${string:?error: not set: retry}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ":?",
+			Args: []Node{
+				&TextNode{Value: "error: not set: retry"},
+			},
+		},
+	},
+	{
+		Text: "${string:?set it or ${DEFAULT}: see docs}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ":?",
+			Args: []Node{
+				&TextNode{Value: "set it or "},
+				&FuncNode{Param: "DEFAULT"},
+				&TextNode{Value: ": see docs"},
+			},
+		},
+	},
+	{
+		Text: "${string:+default}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ":+",
+			Args: []Node{
+				&TextNode{Value: "default"},
+			},
+		},
+	},
+
+	{
+		Text: `${string:-a\}b}`,
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ":-",
+			Args: []Node{
+				&TextNode{Value: "a}b"},
+			},
+		},
+	},
+	{
+		Text: `${string:-a\}`,
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ":-",
+			Args:  []Node{&TextNode{Value: `a\`}},
+		},
+	},
+	{
+		Text: `${string:-C:\\}`,
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ":-",
+			Args:  []Node{&TextNode{Value: `C:\\`}},
+		},
+	},
+	{
+		Text: `${string:=\\}x`,
+		Node: &ListNode{
+			Nodes: []Node{
+				&FuncNode{
+					Param: "string",
+					Name:  ":=",
+					Args:  []Node{&TextNode{Value: `\\`}},
+				},
+				&TextNode{Value: "x"},
+			},
+		},
+	},
+	{
+		Text: `${string:-C:\}${A}`,
+		Node: &ListNode{
+			Nodes: []Node{
+				&FuncNode{
+					Param: "string",
+					Name:  ":-",
+					Args:  []Node{&TextNode{Value: `C:\`}},
+				},
+				&FuncNode{Param: "A"},
+			},
+		},
+	},
+	{
+		Text: `${string:-C:\dir\$$x}`,
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ":-",
+			Args: []Node{
+				&TextNode{Value: `C:\dir$$x`},
+			},
+		},
+	},
+	{
+		Text: `${VAR:-\$HOME}`,
+		Node: &FuncNode{
+			Param: "VAR",
+			Name:  ":-",
+			Args: []Node{
+				&TextNode{Value: "$HOME"},
+			},
+		},
+	},
+	{
+		Text: `${VAR:-\${HOME\}}`,
+		Node: &FuncNode{
+			Param: "VAR",
+			Name:  ":-",
+			Args: []Node{
+				&TextNode{Value: "${HOME}"},
+			},
+		},
+	},
+
+	//
+	// length function
+	//
+	{
+		Text: "${#string}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  "#",
+		},
+	},
+
+	//
+	// positional parameters
+	//
+	{
+		Text: "${1}",
+		Node: &FuncNode{Param: "1"},
+	},
+	{
+		Text: "${10}",
+		Node: &FuncNode{Param: "10"},
+	},
+	{
+		Text: "${1:-default}",
+		Node: &FuncNode{
+			Param: "1",
+			Name:  ":-",
+			Args: []Node{
+				&TextNode{Value: "default"},
+			},
+		},
+	},
+	{
+		Text: "${#}",
+		Node: &FuncNode{Param: "#"},
+	},
+	{
+		Text: "${#1}",
+		Node: &FuncNode{
+			Param: "1",
+			Name:  "#",
+		},
+	},
+
+	//
+	// indirect expansion
+	//
+	{
+		Text: "${!PTR}",
+		Node: &FuncNode{
+			Param: "PTR",
+			Name:  "!",
+		},
+	},
+
+	//
+	// name listing
+	//
+	{
+		Text: "${!CONFIG_*}",
+		Node: &FuncNode{
+			Param: "CONFIG_",
+			Name:  "!*",
+		},
+	},
+	{
+		Text: "${!CONFIG_@}",
+		Node: &FuncNode{
+			Param: "CONFIG_",
+			Name:  "!@",
+		},
+	},
+
+	//
+	// arithmetic expansion
+	//
+	{
+		Text: "$((a+b))",
+		Node: &ArithNode{Expr: "a+b"},
+	},
+	{
+		Text: "n=$(( (a + 1) * ${b} ))!",
+		Node: &ListNode{
+			Nodes: []Node{
+				&TextNode{Value: "n="},
+				&ListNode{
+					Nodes: []Node{
+						&ArithNode{
+							Expr: " (a + 1) * ${b} ",
+							Nodes: []Node{
+								&TextNode{Value: " (a + 1) * "},
+								&FuncNode{Param: "b"},
+								&TextNode{Value: " "},
+							},
+						},
+						&TextNode{Value: "!"},
+					},
+				},
+			},
+		},
+	},
+	{
+		Text: "$$((a+b))",
+		Node: &TextNode{Value: "$((a+b))"}, // should not escape double dollar
+	},
+	{
+		Text: "$(($$ + 1))",
+		Node: &ArithNode{
+			Expr:  "$$ + 1",
+			Nodes: []Node{&TextNode{Value: "$ + 1"}},
 		},
 	},
-
-	//
-	// length function
-	//
 	{
-		Text: "${#string}",
-		Node: &FuncNode{
-			Param: "string",
-			Name:  "#",
+		Text: "$((a) + ${b}",
+		Node: &ListNode{
+			Nodes: []Node{
+				&TextNode{Value: "$((a) + ", Unclosed: true}, // not closed
+				&FuncNode{Param: "b"},
+			},
 		},
 	},
 
@@ -522,10 +992,38 @@ var tests = []struct {
 		},
 	},
 	{
-		Text: "${string//${stringy}/${stringz}}",
+		Text: "${string:-${string}_fallback}",
+		Node: &FuncNode{
+			Param: "string",
+			Name:  ":-",
+			Args: []Node{
+				&FuncNode{Param: "string"},
+				&TextNode{Value: "_fallback"},
+			},
+		},
+	},
+	{
+		Text: "${string:-a${string:-${string}}b}",
 		Node: &FuncNode{
 			Param: "string",
-			Name:  "//",
+			Name:  ":-",
+			Args: []Node{
+				&TextNode{Value: "a"},
+				&FuncNode{
+					Param: "string",
+					Name:  ":-",
+					Args:  []Node{&FuncNode{Param: "string"}},
+				},
+				&TextNode{Value: "b"},
+			},
+		},
+	},
+	{
+		Text: "${string//${stringy}/${stringz}}",
+		Node: &FuncNode{
+			Param:  "string",
+			Name:   "//",
+			Global: true,
 			Args: []Node{
 				&FuncNode{Param: "stringy"},
 				&FuncNode{Param: "stringz"},
@@ -549,3 +1047,715 @@ func TestParse(t *testing.T) {
 		})
 	}
 }
+
+func TestMustParse(t *testing.T) {
+	want, err := Parse("hello ${#string} world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := MustParse("hello ${#string} world")
+	if diff := cmp.Diff(want.Root, got.Root); diff != "" {
+		t.Errorf(diff)
+	}
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Fatal("Expect MustParse to panic on invalid input")
+		}
+		if msg := fmt.Sprint(r); !strings.Contains(msg, ErrParseVariableName.Error()) {
+			t.Errorf("Expect panic message to contain the parse error, got %q", msg)
+		}
+	}()
+	MustParse("${")
+}
+
+func TestParseContext(t *testing.T) {
+	buf := strings.Repeat("a ${b:-c} ", 1000)
+
+	tree, err := ParseContext(context.Background(), buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tree.String(); got != buf {
+		t.Errorf("Want input parsed entirely, got %d bytes", len(got))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ParseContext(ctx, buf); !errors.Is(err, context.Canceled) {
+		t.Errorf("Want error %q, got %v", context.Canceled, err)
+	}
+
+	// cancel the context once the parse started
+	ctx = &cancelAfterContext{Context: context.Background(), calls: 1}
+	if _, err := ParseContext(ctx, buf); !errors.Is(err, context.Canceled) {
+		t.Errorf("Want error %q while parsing, got %v", context.Canceled, err)
+	}
+}
+
+// cancelAfterContext is a context reporting it is cancelled after Err
+// has been called the given number of times.
+type cancelAfterContext struct {
+	context.Context
+	calls int
+}
+
+func (c *cancelAfterContext) Err() error {
+	if c.calls == 0 {
+		return context.Canceled
+	}
+	c.calls--
+	return nil
+}
+
+func TestParseReader(t *testing.T) {
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			want, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, r := range []io.Reader{
+				strings.NewReader(test.Text),
+				bytes.NewBufferString(test.Text),
+			} {
+				got, err := ParseReader(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(want.Root, got.Root); diff != "" {
+					t.Errorf(diff)
+				}
+			}
+		})
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	trees, err := ParseAll("${A}\x00\x00text ${B\x00${C:-x}\x00${D", 0)
+	if len(trees) != 5 {
+		t.Fatalf("Want 5 trees, got %d", len(trees))
+	}
+
+	var got []int
+	for _, err := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var serr *SegmentError
+		if !errors.As(err, &serr) {
+			t.Fatalf("Want SegmentError, got %T", err)
+		}
+		var perr *ParseError
+		if !errors.As(serr, &perr) {
+			t.Errorf("Want ParseError for segment %d, got %v", serr.Index, serr.Err)
+		}
+		got = append(got, serr.Index, serr.Offset)
+	}
+	if diff := cmp.Diff([]int{2, 6, 4, 23}, got); diff != "" {
+		t.Errorf(diff)
+	}
+
+	for i, want := range []Node{&FuncNode{Param: "A"}, empty, nil, &FuncNode{Param: "C", Name: ":-", Args: []Node{&TextNode{Value: "x"}}}, nil} {
+		if want == nil {
+			if trees[i] != nil {
+				t.Errorf("Want nil tree for segment %d", i)
+			}
+			continue
+		}
+		if diff := cmp.Diff(want, trees[i].Root); diff != "" {
+			t.Errorf("segment %d: %s", i, diff)
+		}
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := []struct {
+		Text string
+		Err  error
+	}{
+		{Text: "${!}", Err: ErrParseVariableName},
+		{Text: "${!PTR", Err: ErrMissingClosingBrace},
+		{Text: "${!PTR*", Err: ErrMissingClosingBrace},
+		{Text: "${!PTR*x}", Err: ErrMissingClosingBrace},
+		{Text: "${VAR", Err: ErrMissingClosingBrace},
+		{Text: "${VAR:-x", Err: ErrMissingClosingBrace},
+		{Text: "${VAR:-", Err: ErrMissingClosingBrace},
+		{Text: "${VAR:1", Err: ErrMissingClosingBrace},
+		{Text: "${VAR:1:2", Err: ErrMissingClosingBrace},
+		{Text: "${VAR/a", Err: ErrMissingClosingBrace},
+		{Text: "${VAR/a/b", Err: ErrMissingClosingBrace},
+		{Text: "${VAR#a", Err: ErrMissingClosingBrace},
+		{Text: "${VAR^^", Err: ErrMissingClosingBrace},
+		{Text: "${#VAR", Err: ErrMissingClosingBrace},
+		{Text: "${VAR:-${OTHER}", Err: ErrMissingClosingBrace},
+		{Text: `${FOO/a/b\`, Err: ErrUnterminatedEscape},
+		{Text: `${FOO/a\`, Err: ErrUnterminatedEscape},
+		{Text: `${FOO:-abc\`, Err: ErrUnterminatedEscape},
+		{Text: `${FOO/a/b\\`, Err: ErrMissingClosingBrace},
+		{Text: "${VAR:}", Err: ErrMissingOffset},
+		{Text: "a ${VAR:} b", Err: ErrParseFuncSubstitution},
+		{Text: "$(rm -rf /)", Err: ErrCommandSubstitutionDisallowed},
+		{Text: "a ${b} $(c", Err: ErrCommandSubstitutionDisallowed},
+		{Text: "${a:-$(b)}", Err: ErrCommandSubstitutionDisallowed},
+		{Text: "${VAR@Z}", Err: ErrUnknownTransformation},
+		{Text: "${VAR@QQ}", Err: ErrUnknownTransformation},
+		{Text: "${VAR@}", Err: ErrBadSubstitution},
+		{Text: "${VAR@Q", Err: ErrMissingClosingBrace},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			_, err := Parse(test.Text)
+			if !errors.Is(err, test.Err) {
+				t.Errorf("Want error %q, got %v", test.Err, err)
+			}
+		})
+	}
+}
+
+// TestParse_Degenerate pins the outcome of operators stacked or left
+// without their words.
+func TestParse_Degenerate(t *testing.T) {
+	tests := []struct {
+		Text string
+		Node Node
+		Err  error
+	}{
+		// the word of a default function may start with operator runes
+		{Text: "${VAR:--}", Node: &FuncNode{Param: "VAR", Name: ":-", Args: []Node{&TextNode{Value: "-"}}}},
+		{Text: "${VAR:-:-}", Node: &FuncNode{Param: "VAR", Name: ":-", Args: []Node{&TextNode{Value: ":-"}}}},
+		{Text: "${VAR:=-}", Node: &FuncNode{Param: "VAR", Name: ":=", Args: []Node{&TextNode{Value: "-"}}}},
+		{Text: "${VAR:+-}", Node: &FuncNode{Param: "VAR", Name: ":+", Args: []Node{&TextNode{Value: "-"}}}},
+		{Text: "${VAR:?-}", Node: &FuncNode{Param: "VAR", Name: ":?", Args: []Node{&TextNode{Value: "-"}}}},
+		{Text: "${VAR==}", Node: &FuncNode{Param: "VAR", Name: "=", Args: []Node{&TextNode{Value: "="}}}},
+
+		// an anchored empty pattern inserts the string
+		{Text: "${VAR/#/x}", Node: &FuncNode{Param: "VAR", Name: "/#", Args: []Node{&TextNode{}, &TextNode{Value: "x"}}}},
+		{Text: "${VAR/%/x}", Node: &FuncNode{Param: "VAR", Name: "/%", Args: []Node{&TextNode{}, &TextNode{Value: "x"}}}},
+
+		// other empty patterns are rejected
+		{Text: "${VAR/}", Err: ErrMissingPattern},
+		{Text: "${VAR//}", Err: ErrMissingPattern},
+		{Text: "${VAR///}", Err: ErrMissingPattern},
+		{Text: "${VAR///x}", Err: ErrMissingPattern},
+		{Text: "${VAR/#}", Err: ErrMissingPattern},
+		{Text: "${VAR/%}", Err: ErrMissingPattern},
+
+		// substrings need an offset and a length when delimited
+		{Text: "${VAR:}", Err: ErrMissingOffset},
+		{Text: "${VAR::}", Err: ErrMissingOffset},
+		{Text: "${VAR::2}", Err: ErrMissingOffset},
+		{Text: "${VAR:1:}", Err: ErrMissingLength},
+		{Text: "${VAR:1::2}", Err: ErrParseFuncSubstitution},
+		{Text: "${VAR:1:2:3}", Err: ErrParseFuncSubstitution},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if test.Err != nil {
+				if !errors.Is(err, test.Err) {
+					t.Errorf("Want error %q, got %v", test.Err, err)
+				}
+				if !errors.Is(err, ErrParseFuncSubstitution) {
+					t.Errorf("Want error %q, got %v", ErrParseFuncSubstitution, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Node, tree.Root); diff != "" {
+				t.Errorf(diff)
+			}
+			if got := tree.String(); got != test.Text {
+				t.Errorf("Want %q rendered unchanged, got %q", test.Text, got)
+			}
+		})
+	}
+}
+
+func TestParse_Length(t *testing.T) {
+	tests := []struct {
+		Text    string
+		Node    Node
+		Err     error
+		Message string
+	}{
+		{Text: "${#VAR}", Node: &FuncNode{Param: "VAR", Name: "#"}},
+		{Text: "${#}", Node: &FuncNode{Param: "#"}},
+		{
+			Text:    "${#VAR:0:3}",
+			Err:     ErrLengthOperand,
+			Message: `parameter "VAR": length only applies to a parameter name: unexpected ':' at offset 6: "${#VAR:0:3}"`,
+		},
+		{
+			Text:    "${#VAR:-x}",
+			Err:     ErrLengthOperand,
+			Message: `parameter "VAR": length only applies to a parameter name: unexpected ':' at offset 6: "${#VAR:-x}"`,
+		},
+		{
+			Text:    "${#VAR[@]}",
+			Err:     ErrLengthOperand,
+			Message: `parameter "VAR": length only applies to a parameter name: array subscripts are not supported at offset 6: "${#VAR[@]}"`,
+		},
+		{Text: "${#VAR", Err: ErrMissingClosingBrace},
+		{Text: "${##}", Err: ErrBadSubstitution},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if test.Err != nil {
+				if !errors.Is(err, test.Err) {
+					t.Fatalf("Want error %q, got %v", test.Err, err)
+				}
+				if test.Message != "" && err.Error() != test.Message {
+					t.Errorf("Want error message %q, got %q", test.Message, err.Error())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Node, tree.Root); diff != "" {
+				t.Errorf(diff)
+			}
+		})
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tests := []struct {
+		Text    string
+		Err     error
+		Offset  int
+		Message string
+	}{
+		{
+			Text:    "${FOO:}",
+			Err:     ErrParseFuncSubstitution,
+			Offset:  6,
+			Message: `parameter "FOO": unable to parse substitution within function: missing substring offset at offset 6: "${FOO:}"`,
+		},
+		{
+			Text:    "some long prefix ${FOO:} and a long suffix",
+			Err:     ErrParseFuncSubstitution,
+			Offset:  23,
+			Message: `parameter "FOO": unable to parse substitution within function: missing substring offset at offset 23: "...fix ${FOO:} and a lo..."`,
+		},
+		{
+			Text:    `${a/\/b/c`,
+			Err:     ErrMissingClosingBrace,
+			Offset:  9,
+			Message: `parameter "a": missing closing brace at offset 9: "${a/\\/b/c"`,
+		},
+		{
+			Text:    "${FOO:-${BAR}",
+			Err:     ErrMissingClosingBrace,
+			Offset:  13,
+			Message: `parameter "FOO": missing closing brace at offset 13: "...OO:-${BAR}"`,
+		},
+		{
+			Text:    "${FOO:-${BAR:}}",
+			Err:     ErrMissingOffset,
+			Offset:  13,
+			Message: `parameter "FOO": parameter "BAR": unable to parse substitution within function: missing substring offset at offset 13: "...OO:-${BAR:}}"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			_, err := Parse(test.Text)
+			if !errors.Is(err, test.Err) {
+				t.Fatalf("Want error %q, got %v", test.Err, err)
+			}
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("Want ParseError, got %T", err)
+			}
+			if perr.Offset != test.Offset {
+				t.Errorf("Want offset %d, got %d", test.Offset, perr.Offset)
+			}
+			if err.Error() != test.Message {
+				t.Errorf("Want message %s, got %s", test.Message, err.Error())
+			}
+		})
+	}
+}
+
+func TestParseError_Partial(t *testing.T) {
+	tests := []struct {
+		Text      string
+		Partial   Node
+		Remainder string
+	}{
+		{
+			Text:      "hello ${BAD",
+			Partial:   &TextNode{Value: "hello "},
+			Remainder: "${BAD",
+		},
+		{
+			Text: "a ${b} c ${d:-x",
+			Partial: &ListNode{
+				Nodes: []Node{
+					&TextNode{Value: "a "},
+					&FuncNode{Param: "b"},
+					&TextNode{Value: " c "},
+				},
+			},
+			Remainder: "${d:-x",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			_, err := Parse(test.Text)
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("Want ParseError, got %v", err)
+			}
+			if perr.Partial == nil {
+				t.Fatal("Want partial tree, got nil")
+			}
+			if diff := cmp.Diff(test.Partial, perr.Partial.Root); diff != "" {
+				t.Errorf(diff)
+			}
+			if perr.Remainder != test.Remainder {
+				t.Errorf("Want remainder %q, got %q", test.Remainder, perr.Remainder)
+			}
+		})
+	}
+
+	_, err := Parse("${BAD")
+	var perr *ParseError
+	if !errors.As(err, &perr) {
+		t.Fatalf("Want ParseError, got %v", err)
+	}
+	if perr.Partial != nil || perr.Remainder != "${BAD" {
+		t.Errorf("Want no partial tree and the whole input as remainder, got %v and %q", perr.Partial, perr.Remainder)
+	}
+}
+
+func TestParseError_Position(t *testing.T) {
+	tests := []struct {
+		Text string
+		Line int
+		Col  int
+	}{
+		{Text: "${FOO:}", Line: 1, Col: 7},
+		{Text: "a: b\nc: ${FOO:}", Line: 2, Col: 10},
+		{Text: "a: b\r\nc: ${FOO:}", Line: 2, Col: 10},
+		{Text: "a\n\nb\n\tc: ${FOO:}\nd", Line: 4, Col: 11},
+		{Text: "é\nüñ ${FOO:}", Line: 2, Col: 10},
+		{Text: "a\n${FOO", Line: 2, Col: 6},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			_, err := Parse(test.Text)
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("Want ParseError, got %v", err)
+			}
+			line, col := perr.Position(test.Text)
+			if line != test.Line || col != test.Col {
+				t.Errorf("Want position %d:%d, got %d:%d", test.Line, test.Col, line, col)
+			}
+		})
+	}
+}
+
+func TestTree_Variables(t *testing.T) {
+	tests := []struct {
+		Text string
+		Want []string
+	}{
+		{Text: "text", Want: nil},
+		{Text: "${FOO:-bar}${BAZ}", Want: []string{"FOO", "BAZ"}},
+		{Text: "${FOO:-${BAR}}", Want: []string{"FOO", "BAR"}},
+		{Text: "${FOO} ${#FOO} ${FOO,,}", Want: []string{"FOO"}},
+		{Text: "${A:${B}:${C^^}} ${B//x/${D}}", Want: []string{"A", "B", "C", "D"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Want, tree.Variables()); diff != "" {
+				t.Errorf(diff)
+			}
+		})
+	}
+}
+
+func TestTree_Defaults(t *testing.T) {
+	tests := []struct {
+		Text string
+		Want map[string]string
+	}{
+		{Text: "text", Want: map[string]string{}},
+		{Text: "${A:-x}${B:=y}${C}", Want: map[string]string{"A": "x", "B": "y"}},
+		{Text: "${A=prefix-x}${A:-y}", Want: map[string]string{"A": "prefix-x"}},
+		{Text: "${A:-${B:-z}}", Want: map[string]string{"B": "z"}},
+		{Text: "${A:-x${B}}", Want: map[string]string{}},
+		{Text: "${A:-}${B:=}", Want: map[string]string{"A": "", "B": ""}},
+		{Text: "${A:?x}${B:+y}${C/a/b}", Want: map[string]string{}},
+		{Text: "${A-x}${B?y}${C+z}", Want: map[string]string{"A": "x"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Want, tree.Defaults()); diff != "" {
+				t.Errorf(diff)
+			}
+		})
+	}
+}
+
+func TestTree_Predicates(t *testing.T) {
+	tests := []struct {
+		Text         string
+		PlainText    bool
+		HasFunctions bool
+	}{
+		{Text: "", PlainText: true},
+		{Text: "plain text", PlainText: true},
+		{Text: "${VAR}"},
+		{Text: "a ${VAR} b"},
+		{Text: "${VAR:-x}", HasFunctions: true},
+		{Text: "${A:-${B}} ${C}", HasFunctions: true},
+		{Text: "${A} ${B,,}", HasFunctions: true},
+		{Text: "$((1 + 2))"},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tree.IsPlainText(); got != test.PlainText {
+				t.Errorf("Want IsPlainText %v, got %v", test.PlainText, got)
+			}
+			if got := tree.HasFunctions(); got != test.HasFunctions {
+				t.Errorf("Want HasFunctions %v, got %v", test.HasFunctions, got)
+			}
+		})
+	}
+
+	var tree *Tree
+	if !tree.IsPlainText() || tree.HasFunctions() {
+		t.Errorf("Want a nil tree to be plain text without functions")
+	}
+}
+
+func TestParse_Whitespace(t *testing.T) {
+	const text = "name: ${NAME}\r\n" +
+		"value:\u00a0${VALUE:-a\r\nb\u00a0c}\r\n" +
+		"\u2003\tend\r\n"
+	tree, err := Parse(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := newListNode(
+		newTextNode("name: "),
+		newListNode(
+			&FuncNode{Param: "NAME"},
+			newListNode(
+				newTextNode("\r\nvalue:\u00a0"),
+				newListNode(
+					&FuncNode{Param: "VALUE", Name: ":-", Args: []Node{newTextNode("a\r\nb\u00a0c")}},
+					newTextNode("\r\n\u2003\tend\r\n"),
+				),
+			),
+		),
+	)
+	if diff := cmp.Diff(want, tree.Root); diff != "" {
+		t.Errorf(diff)
+	}
+	if got := tree.String(); got != text {
+		t.Errorf("Want %q rendered unchanged, got %q", text, got)
+	}
+
+	got, err := tree.Expand(func(name string) (string, bool) {
+		return map[string]string{"NAME": "n"}[name], name == "NAME"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "name: n\r\nvalue:\u00a0a\r\nb\u00a0c\r\n\u2003\tend\r\n"; got != want {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+}
+
+func TestParse_SubstrNestedArgs(t *testing.T) {
+	tests := []struct {
+		Text string
+		Node Node
+		Want string
+	}{
+		{
+			Text: "${VAR:${START}:${COUNT}}",
+			Node: &FuncNode{Param: "VAR", Name: ":", Args: []Node{
+				&FuncNode{Param: "START"},
+				&FuncNode{Param: "COUNT"},
+			}},
+			Want: "ell",
+		},
+		{
+			Text: "${VAR:${START:-0}:${#COUNT}}",
+			Node: &FuncNode{Param: "VAR", Name: ":", Args: []Node{
+				&FuncNode{Param: "START", Name: ":-", Args: []Node{newTextNode("0")}},
+				&FuncNode{Param: "COUNT", Name: "#"},
+			}},
+			Want: "e",
+		},
+		{
+			Text: "${VAR: -${COUNT}}",
+			Node: &FuncNode{Param: "VAR", Name: ":", Args: []Node{
+				newListNode(newTextNode(" -"), &FuncNode{Param: "COUNT"}),
+			}},
+			Want: "llo",
+		},
+		{
+			Text: "${VAR:${START}${COUNT}:1}",
+			Node: &FuncNode{Param: "VAR", Name: ":", Args: []Node{
+				newListNode(&FuncNode{Param: "START"}, &FuncNode{Param: "COUNT"}),
+				newTextNode("1"),
+			}},
+			Want: "",
+		},
+	}
+	vars := map[string]string{"VAR": "hello", "START": "1", "COUNT": "3"}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Node, tree.Root); diff != "" {
+				t.Errorf(diff)
+			}
+			if got := tree.String(); got != test.Text {
+				t.Errorf("Want %q rendered unchanged, got %q", test.Text, got)
+			}
+			got, err := tree.Expand(func(name string) (string, bool) {
+				v, ok := vars[name]
+				return v, ok
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.Want {
+				t.Errorf("Want %q expanded to %q, got %q", test.Text, test.Want, got)
+			}
+		})
+	}
+}
+
+func TestTree_Validate(t *testing.T) {
+	allowed := NewOperatorSet(OpNone, OpDefaultIfEmpty)
+	tests := []struct {
+		Text    string
+		Message string
+	}{
+		{Text: "plain text"},
+		{Text: "${A} ${B:-default}"},
+		{Text: "${A:-${B:-${C}}}"},
+		{Text: "${A} ${B//a/b}", Message: `operator not allowed: "//" on variable "B"`},
+		{Text: "${A:-${B,,}}", Message: `operator not allowed: ",," on variable "B"`},
+		{Text: "${#A} ${B%x}", Message: `operator not allowed: "#" on variable "A"`},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tree.Validate(allowed)
+			if test.Message == "" {
+				if err != nil {
+					t.Errorf("Want %q valid, got error %v", test.Text, err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrOperatorNotAllowed) {
+				t.Fatalf("Want error %q, got %v", ErrOperatorNotAllowed, err)
+			}
+			if err.Error() != test.Message {
+				t.Errorf("Want error message %q, got %q", test.Message, err.Error())
+			}
+		})
+	}
+
+	tree := MustParse("${A}")
+	if err := tree.Validate(NewOperatorSet()); !errors.Is(err, ErrOperatorNotAllowed) {
+		t.Errorf("Want plain references rejected without OpNone, got %v", err)
+	}
+}
+
+func TestTree_Cost(t *testing.T) {
+	tests := []struct {
+		Text string
+		Want int
+	}{
+		{Text: "plain text", Want: 0},
+		{Text: "${A}", Want: 1},
+		{Text: "${A} ${B}", Want: 2},
+		{Text: "${A:-x}", Want: 2},
+		{Text: "${A:-${B}}", Want: 3},
+		{Text: "${A:-${B:-${C}}}", Want: 5},
+		{Text: "${A/x/y}", Want: 11},
+		{Text: "${A//x/${B/y/z}}", Want: 22},
+		{Text: "$((1 + 2))", Want: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.Text, func(t *testing.T) {
+			tree, err := Parse(test.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tree.Cost(); got != test.Want {
+				t.Errorf("Want cost %d, got %d", test.Want, got)
+			}
+		})
+	}
+}
+
+func TestTree_Cost_Grows(t *testing.T) {
+	texts := []string{
+		"${A}",
+		"${A:-${B}}",
+		"${A:-${B:-${C}}}",
+		"${A:-${B//x/y}}",
+		"${A//x/${B//x/y}}",
+	}
+	var prev int
+	for _, text := range texts {
+		got := MustParse(text).Cost()
+		if got <= prev {
+			t.Errorf("Want cost of %q above %d, got %d", text, prev, got)
+		}
+		prev = got
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		text string
+	}{
+		{name: "text", text: strings.Repeat("plain text without any substitution\n", 100)},
+		{name: "simple", text: strings.Repeat("key: ${VAR}\n", 100)},
+		{name: "nested", text: strings.Repeat("${A:-${B:-${C:-${D:-default}}}}\n", 100)},
+		{name: "replace", text: strings.Repeat(`${PATH//\/usr\/bin/\/opt\/bin} ${PATH/#\/usr/\/opt}`+"\n", 100)},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Parse(bm.text); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -21,6 +21,7 @@ limitations under the License.
 package parse
 
 import (
+	"strings"
 	"unicode"
 	"unicode/utf8"
 )
@@ -44,6 +45,9 @@ const (
 	tokenLbrack
 	tokenRbrack
 	tokenQuote
+	tokenArith
+	tokenCmd
+	tokenBare
 )
 
 // predefined mode bits to control recognition of tokens.
@@ -52,13 +56,20 @@ const (
 	scanLbrack
 	scanRbrack
 	scanEscape
+	scanArith
+	scanCmd
+	scanQuote
+	scanBare
 )
 
 // predefined mode bits to control escape tokens.
 const (
 	dollar byte = 1 << iota
 	backslash
-	escapeAll = dollar | backslash
+	rbrace
+	escapedDollar
+	escapedBackslash
+	escapeAll = dollar | backslash | escapedDollar
 )
 
 // returns true if rune is accepted.
@@ -74,6 +85,22 @@ type scanner struct {
 	mode        byte
 	escapeChars byte
 
+	// skips holds the positions of the escape characters skipped
+	// in the current token.
+	skips []int
+	// tok is reused to build the tokens containing escape characters.
+	tok []byte
+	// unterminated is set when an escape character is the
+	// last rune of the buffer.
+	unterminated bool
+
+	// sigil and lbrack open a substitution, rbrack closes it.
+	sigil, lbrack, rbrack rune
+
+	// ident accepts the first rune of the name of a reference without
+	// braces, recognized in scanBare mode.
+	ident acceptFunc
+
 	accept acceptFunc
 }
 
@@ -83,7 +110,10 @@ func (s *scanner) init(buf string) {
 	s.pos = 0
 	s.start = 0
 	s.width = 0
+	s.skips = s.skips[:0]
+	s.unterminated = false
 	s.accept = nil
+	s.sigil, s.lbrack, s.rbrack = '$', '{', '}'
 }
 
 // read returns the next unicode character. It returns eof at
@@ -103,12 +133,23 @@ func (s *scanner) unread() {
 	s.pos -= s.width
 }
 
-// skip skips over the curring unicode character in the buffer
-// by slicing and removing from the buffer.
+// skip skips over the current escape character in the buffer
+// by recording its position and consuming the escaped character.
 func (s *scanner) skip() {
-	l := s.buf[:s.pos-1]
-	r := s.buf[s.pos:]
-	s.buf = l + r
+	s.skips = append(s.skips, s.pos-s.width)
+	s.read()
+}
+
+// index returns the number of bytes of the current token, excluding
+// the skipped escape characters.
+func (s *scanner) index() int {
+	return s.pos - s.start - len(s.skips)
+}
+
+// offset returns the byte offset in the buffer of the most recently
+// scanned token.
+func (s *scanner) offset() int {
+	return s.start
 }
 
 // peek returns the next unicode character in the buffer without
@@ -123,7 +164,17 @@ func (s *scanner) peek() rune {
 // string returns the string corresponding to the most recently
 // scanned token. Valid after calling scan().
 func (s *scanner) string() string {
-	return s.buf[s.start:s.pos]
+	if len(s.skips) == 0 {
+		return s.buf[s.start:s.pos]
+	}
+	s.tok = s.tok[:0]
+	prev := s.start
+	for _, i := range s.skips {
+		s.tok = append(s.tok, s.buf[prev:i]...)
+		prev = i + 1
+	}
+	s.tok = append(s.tok, s.buf[prev:s.pos]...)
+	return string(s.tok)
 }
 
 // tests if the bit exists for a given character bit
@@ -135,14 +186,23 @@ func (s *scanner) shouldEscape(character byte) bool {
 // returns it. It returns EOF at the end of the source.
 func (s *scanner) scan() token {
 	s.start = s.pos
+	s.skips = s.skips[:0]
 	r := s.read()
 	switch {
 	case r == eof:
 		return tokenEOF
 	case s.scanLbrack(r):
 		return tokenLbrack
+	case s.scanArith(r):
+		return tokenArith
+	case s.scanCmd(r):
+		return tokenCmd
+	case s.scanQuote(r):
+		return tokenQuote
 	case s.scanRbrack(r):
 		return tokenRbrack
+	case s.scanBare(r):
+		return tokenBare
 	case s.scanIdent(r):
 		return tokenIdent
 	}
@@ -157,7 +217,7 @@ func (s *scanner) scanIdent(r rune) bool {
 	}
 	if s.scanEscaped(r) {
 		s.skip()
-	} else if !s.accept(r, s.pos-s.start) {
+	} else if !s.accept(s.canonical(r), s.index()) {
 		return false
 	}
 loop:
@@ -169,6 +229,18 @@ loop:
 			break loop
 		case s.scanLbrack(r):
 			s.unread()
+			s.pos -= utf8.RuneLen(r)
+			break loop
+		case s.scanArith(r):
+			s.pos -= len("$((")
+			break loop
+		case s.scanCmd(r):
+			s.pos -= len("$(")
+			break loop
+		case s.scanQuote(r):
+			s.unread()
+			break loop
+		case s.scanBare(r):
 			s.unread()
 			break loop
 		}
@@ -176,7 +248,7 @@ loop:
 			s.skip()
 			continue
 		}
-		if !s.accept(r, s.pos-s.start) {
+		if !s.accept(s.canonical(r), s.index()) {
 			s.unread()
 			break loop
 		}
@@ -190,8 +262,8 @@ func (s *scanner) scanLbrack(r rune) bool {
 	if s.mode&scanLbrack == 0 {
 		return false
 	}
-	if r == '$' {
-		if s.read() == '{' {
+	if r == s.sigil {
+		if s.read() == s.lbrack {
 			return true
 		}
 		s.unread()
@@ -199,13 +271,59 @@ func (s *scanner) scanLbrack(r rune) bool {
 	return false
 }
 
+// scanArith reads the next token or Unicode character from source
+// and returns true if the opening of an arithmetic expansion is
+// encountered.
+func (s *scanner) scanArith(r rune) bool {
+	if s.mode&scanArith == 0 {
+		return false
+	}
+	if r == '$' && s.sigil == '$' && strings.HasPrefix(s.buf[s.pos:], "((") {
+		s.pos += len("((")
+		return true
+	}
+	return false
+}
+
+// scanCmd reads the next token or Unicode character from source
+// and returns true if the opening of a command substitution is
+// encountered.
+func (s *scanner) scanCmd(r rune) bool {
+	if s.mode&scanCmd == 0 {
+		return false
+	}
+	if r == '$' && s.sigil == '$' && strings.HasPrefix(s.buf[s.pos:], "(") {
+		s.pos += len("(")
+		return true
+	}
+	return false
+}
+
+// scanQuote reads the next token or Unicode character from source
+// and returns true if a single quote is encountered.
+func (s *scanner) scanQuote(r rune) bool {
+	if s.mode&scanQuote == 0 {
+		return false
+	}
+	return r == '\''
+}
+
+// scanBare returns true if the rune is the sigil opening a reference
+// without braces, i.e. it is followed by the start of a name.
+func (s *scanner) scanBare(r rune) bool {
+	if s.mode&scanBare == 0 {
+		return false
+	}
+	return r == s.sigil && s.ident(s.peek(), 1)
+}
+
 // scanRbrack reads the next token or Unicode character from source
 // and returns true if the closing bracket is encountered.
 func (s *scanner) scanRbrack(r rune) bool {
 	if s.mode&scanRbrack == 0 {
 		return false
 	}
-	return r == '}'
+	return r == s.rbrack
 }
 
 // scanEscaped reads the next token or Unicode character from source
@@ -214,8 +332,25 @@ func (s *scanner) scanEscaped(r rune) bool {
 	if s.mode&scanEscape == 0 {
 		return false
 	}
-	if r == '$' && s.shouldEscape(dollar) {
-		if s.peek() == '$' {
+	if r == '\\' && (s.shouldEscape(backslash) || s.shouldEscape(rbrace) || s.shouldEscape(escapedDollar)) {
+		if s.peek() == eof {
+			// the escape character is the last rune of the buffer
+			s.unterminated = true
+			return false
+		}
+	}
+	if r == s.sigil && s.shouldEscape(dollar) {
+		if s.peek() == s.sigil {
+			return true
+		}
+	}
+	if r == '\\' && s.shouldEscape(escapedDollar) {
+		if s.peek() == s.sigil {
+			return true
+		}
+	}
+	if r == '\\' && s.shouldEscape(escapedBackslash) {
+		if s.peek() == '\\' {
 			return true
 		}
 	}
@@ -227,10 +362,62 @@ func (s *scanner) scanEscaped(r rune) bool {
 			return false
 		}
 	}
+	if r == '\\' && s.shouldEscape(rbrace) {
+		if s.peek() == s.rbrack && s.closedLater() {
+			return true
+		}
+	}
+
+	return false
+}
 
+// closedLater reports whether a closing delimiter matching no opening
+// one follows the next rune, so that the next rune is not the one
+// closing the substitution being scanned. Otherwise, a backslash before
+// it is taken literally, e.g. in "${DIR:-C:\\}".
+func (s *scanner) closedLater() bool {
+	rest := s.buf[s.pos:]
+	_, i := utf8.DecodeRuneInString(rest)
+	depth := 0
+	for i < len(rest) {
+		r, w := utf8.DecodeRuneInString(rest[i:])
+		i += w
+		switch r {
+		case s.sigil:
+			next, w := utf8.DecodeRuneInString(rest[i:])
+			switch next {
+			case s.sigil:
+				i += w
+			case s.lbrack:
+				i += w
+				depth++
+			}
+		case s.rbrack:
+			if depth == 0 {
+				return true
+			}
+			depth--
+		}
+	}
 	return false
 }
 
+// canonical maps the closing delimiter to '}', the one the accept
+// functions are written for, and a literal '}' to a rune they have
+// no special handling for.
+func (s *scanner) canonical(r rune) rune {
+	if s.rbrack == '}' {
+		return r
+	}
+	switch r {
+	case s.rbrack:
+		return '}'
+	case '}':
+		return utf8.RuneError
+	}
+	return r
+}
+
 //
 // scanner functions accept or reject runes.
 //
@@ -243,14 +430,22 @@ func acceptIdent(r rune, i int) bool {
 	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
 }
 
-func acceptColon(r rune, i int) bool {
-	return r == ':'
+func acceptOneDigit(r rune, i int) bool {
+	return i == 1 && '0' <= r && r <= '9'
 }
 
 func acceptOneHash(r rune, i int) bool {
 	return r == '#' && i == 1
 }
 
+func acceptOneBang(r rune, i int) bool {
+	return r == '!' && i == 1
+}
+
+func acceptOneAt(r rune, i int) bool {
+	return r == '@' && i == 1
+}
+
 func acceptNone(r rune, i int) bool {
 	return false
 }
@@ -289,8 +484,8 @@ func acceptReplaceFunc(r rune, i int) bool {
 	}
 }
 
-func acceptOneEqual(r rune, i int) bool {
-	return i == 1 && r == '='
+func acceptOneDefaultOp(r rune, i int) bool {
+	return i == 1 && (r == '=' || r == '-' || r == '?' || r == '+')
 }
 
 func acceptOneColon(r rune, i int) bool {
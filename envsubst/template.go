@@ -46,10 +46,14 @@ type Template struct {
 }
 
 // Parse creates a new shell format template and parses the template
-// definition from string s.
+// definition from string s. Command substitutions, such as the
+// Kubernetes "$(VAR)" dependent environment variables, are kept as
+// literal text.
 func Parse(s string) (t *Template, err error) {
 	t = new(Template)
-	t.tree, err = parse.Parse(s)
+	t.tree, err = parse.ParseWithOptions(s, parse.ParseOptions{
+		AllowCommandSubstitution: true,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -88,6 +92,12 @@ func (t *Template) eval(s *state) (err error) {
 		err = t.evalFunc(s, node)
 	case *parse.ListNode:
 		err = t.evalList(s, node)
+	case *parse.ArithNode:
+		err = t.evalArith(s, node)
+	case *parse.CmdNode:
+		err = t.evalCmd(s, node)
+	case *parse.CommentNode:
+		// comments expand to nothing
 	}
 	return err
 }
@@ -97,6 +107,41 @@ func (t *Template) evalText(s *state, node *parse.TextNode) error {
 	return err
 }
 
+// evalArith writes the arithmetic expansion unevaluated, expanding the
+// substitutions it contains.
+func (t *Template) evalArith(s *state, node *parse.ArithNode) error {
+	if node.Nodes == nil {
+		_, err := io.WriteString(s.writer, node.String())
+		return err
+	}
+	return t.evalNested(s, "$((", node.Nodes, "))")
+}
+
+// evalCmd writes the command substitution without running the command,
+// expanding the substitutions it contains.
+func (t *Template) evalCmd(s *state, node *parse.CmdNode) error {
+	if node.Nodes == nil {
+		_, err := io.WriteString(s.writer, node.String())
+		return err
+	}
+	return t.evalNested(s, "$(", node.Nodes, ")")
+}
+
+// evalNested writes the nodes between the open and close delimiters.
+func (t *Template) evalNested(s *state, open string, nodes []parse.Node, close string) error {
+	if _, err := io.WriteString(s.writer, open); err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		s.node = n
+		if err := t.eval(s); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(s.writer, close)
+	return err
+}
+
 func (t *Template) evalList(s *state, node *parse.ListNode) (err error) {
 	for _, n := range node.Nodes {
 		s.node = n
@@ -129,11 +174,31 @@ func (t *Template) evalFunc(s *state, node *parse.FuncNode) error {
 	s.writer = w
 	s.node = node
 
+	// the names of the variables cannot be listed from the mapping
+	if node.Op() == parse.OpPrefixNames {
+		return nil
+	}
+
 	v, exists := s.mapper(node.Param)
 
+	// resolve the indirect reference to the variable it names
+	if node.Name == "!" {
+		if !exists {
+			return fmt.Errorf("%w: %q", errVarNotSet, node.Param)
+		}
+		v, exists = s.mapper(v)
+		if !exists {
+			return fmt.Errorf("%w: %q", errVarNotSet, v)
+		}
+	}
+
 	if node.Name == "" && !exists {
 		return fmt.Errorf("%w: %q", errVarNotSet, node.Param)
 	}
+	if node.Name == "@" {
+		// the "A" transformation renders an assignment to the parameter
+		args = append(args, node.Param)
+	}
 	fn := lookupFunc(node.Name, len(args))
 
 	_, err := io.WriteString(s.writer, fn(v, args...))
@@ -169,6 +234,8 @@ func lookupFunc(name string, args int) substituteFunc {
 		return replacePrefix
 	case "/%":
 		return replaceSuffix
+	case "@":
+		return transform
 	case "/":
 		return replaceFirst
 	case "//":
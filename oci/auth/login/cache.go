@@ -17,28 +17,826 @@ limitations under the License.
 package login
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/fluxcd/pkg/cache"
 )
 
-func cacheObject[T authn.Authenticator](store cache.Expirable[cache.StoreObject[T]], auth T, key string, expiresAt time.Time) error {
+// anonymousTTL is the minimum time anonymous access to a registry is
+// cached for, as it does not expire like credentials do.
+const anonymousTTL = 24 * time.Hour
+
+// cacheOptions holds the options of cacheObject.
+type cacheOptions struct {
+	jitter float64
+	rng    *rand.Rand
+	maxTTL time.Duration
+
+	shouldCache func(authn.Authenticator) bool
+	metrics     CacheMetrics
+}
+
+// cacheOption sets an option of cacheObject.
+type cacheOption func(*cacheOptions)
+
+// withJitter spreads the expiration of the cached objects randomly by up
+// to ±fraction of their time to live, e.g. 0.1 for ±10%, so that objects
+// cached together do not expire all at once. rng is used to draw the
+// jitter if not nil, for deterministic expirations.
+func withJitter(fraction float64, rng *rand.Rand) cacheOption {
+	return func(o *cacheOptions) {
+		o.jitter = fraction
+		o.rng = rng
+	}
+}
+
+// withMaxTTL clamps the expiration of the cached objects to maxTTL from
+// now, for the credentials which would otherwise be cached for too long.
+// A maxTTL of zero does not clamp the expiration.
+func withMaxTTL(maxTTL time.Duration) cacheOption {
+	return func(o *cacheOptions) {
+		o.maxTTL = maxTTL
+	}
+}
+
+// withCachePredicate caches only the objects for which shouldCache
+// returns true, e.g. to skip the static credentials which never expire.
+// cacheObject returns without error for the others, and the object
+// previously cached under their key is left as it is.
+func withCachePredicate(shouldCache func(authn.Authenticator) bool) cacheOption {
+	return func(o *cacheOptions) {
+		o.shouldCache = shouldCache
+	}
+}
+
+// withMetrics records the objects cached with metrics, if not nil.
+func withMetrics(metrics CacheMetrics) cacheOption {
+	return func(o *cacheOptions) {
+		o.metrics = metrics
+	}
+}
+
+func cacheObject[T authn.Authenticator](store cache.Expirable[cache.StoreObject[T]], auth T, key string, expiresAt time.Time, opts ...cacheOption) error {
+	var o cacheOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.shouldCache != nil && !o.shouldCache(auth) {
+		return nil
+	}
+
+	now := clockOf(store).Now()
+	if isAnonymous(auth) {
+		if anonymousExpiresAt := now.Add(anonymousTTL); anonymousExpiresAt.After(expiresAt) {
+			expiresAt = anonymousExpiresAt
+		}
+	}
+	if o.jitter > 0 {
+		expiresAt = jitterExpiration(now, expiresAt, o.jitter, o.rng)
+	}
+	if o.maxTTL > 0 {
+		if maxExpiresAt := now.Add(o.maxTTL); expiresAt.After(maxExpiresAt) {
+			expiresAt = maxExpiresAt
+		}
+	}
+
 	obj := cache.StoreObject[T]{
 		Object: auth,
 		Key:    key,
 	}
 
-	err := store.Set(obj)
-	if err != nil {
-		return err
+	if err := store.Set(obj); err != nil {
+		return &CacheObjectError{Key: key, Step: "Set", Err: err}
 	}
+	if err := store.SetExpiration(obj, expiresAt); err != nil {
+		// remove the object, so that it is not cached without expiration
+		if delErr := store.Delete(obj); delErr != nil {
+			err = errors.Join(err, delErr)
+		}
+		return &CacheObjectError{Key: key, Step: "SetExpiration", Err: err}
+	}
+	if o.metrics != nil {
+		o.metrics.IncSet(key)
+	}
+	return nil
+}
+
+// CacheObjectError is returned when caching credentials fails.
+type CacheObjectError struct {
+	// Key is the cache key of the credentials.
+	Key string
+	// Step is the store operation which failed, Set or SetExpiration.
+	Step string
+	// Err is the error of the store.
+	Err error
+}
+
+// Error returns Err prefixed with the step which failed.
+func (e *CacheObjectError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.Step, e.Err)
+}
+
+// Unwrap returns the error of the store.
+func (e *CacheObjectError) Unwrap() error {
+	return e.Err
+}
+
+// jitterExpiration moves expiresAt randomly by up to ±fraction of the
+// time left from now until it.
+func jitterExpiration(now, expiresAt time.Time, fraction float64, rng *rand.Rand) time.Time {
+	ttl := expiresAt.Sub(now)
+	if ttl <= 0 {
+		return expiresAt
+	}
+	r := rand.Float64()
+	if rng != nil {
+		r = rng.Float64()
+	}
+	return expiresAt.Add(time.Duration(float64(ttl) * fraction * (2*r - 1)))
+}
 
-	return store.SetExpiration(obj, expiresAt)
+// CacheKey returns the key of the credentials of the repository repo
+// hosted by the registry host, so that the same repository path on two
+// registries does not resolve to the same cache entry.
+func CacheKey(host, repo string) string {
+	return host + "/" + strings.TrimPrefix(repo, "/")
 }
 
+// Clock tells the current time to the cache helpers. They use the clock
+// of the store, set with cache.WithClock, so that they agree with it on
+// the expiration of the objects.
+type Clock = cache.Clock
+
+// realClock is the Clock of the system.
+type realClock struct{}
+
+// Now returns time.Now().
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// clockOf returns the clock of the store, or the system clock if the
+// store does not tell the time with a Clock.
+func clockOf(store any) Clock {
+	if s, ok := store.(interface{ Clock() cache.Clock }); ok {
+		return s.Clock()
+	}
+	return realClock{}
+}
+
+// getObjectFromCache returns a copy of the object stored under key, so that
+// callers sharing a cached authenticator cannot affect each other.
 func getObjectFromCache[T authn.Authenticator](cache cache.Expirable[cache.StoreObject[T]], key string) (T, bool, error) {
 	val, exists, err := cache.GetByKey(key)
-	return val.Object, exists, err
+	return copyObject(val), exists, err
+}
+
+// copyObject returns a copy of the object of val.
+func copyObject[T authn.Authenticator](val cache.StoreObject[T]) T {
+	if isAnonymous(val.Object) {
+		// authn.Anonymous is immutable and shared, there is nothing to copy
+		return val.Object
+	}
+	return val.Clone().Object
+}
+
+// cacheStatus is the outcome of a lookup of getObjectFromCacheWithStatus.
+type cacheStatus int
+
+const (
+	// cacheMiss means the object was never cached, or was removed.
+	cacheMiss cacheStatus = iota
+	// cacheHit means the object is cached and has not expired.
+	cacheHit
+	// cacheExpired means the object has expired but is still retained
+	// by the cache.
+	cacheExpired
+)
+
+// String returns the name of the status.
+func (s cacheStatus) String() string {
+	switch s {
+	case cacheHit:
+		return "Hit"
+	case cacheExpired:
+		return "Expired"
+	default:
+		return "Miss"
+	}
+}
+
+// expiredObjectsGetter is implemented by the stores retaining expired
+// objects, like cache.Cache.
+type expiredObjectsGetter[T any] interface {
+	PeekByKey(key string) (item T, expiresAt time.Time, exists bool, err error)
+}
+
+// getObjectFromCacheWithStatus is like getObjectFromCache but also
+// returns the expired objects retained by the store, so that callers can
+// serve them while fetching new ones. Stores that do not retain expired
+// objects report them as missing.
+func getObjectFromCacheWithStatus[T authn.Authenticator](store cache.Expirable[cache.StoreObject[T]], key string) (T, cacheStatus, error) {
+	getter, ok := store.(expiredObjectsGetter[cache.StoreObject[T]])
+	if !ok {
+		obj, exists, err := getObjectFromCache(store, key)
+		if err != nil || !exists {
+			return obj, cacheMiss, err
+		}
+		return obj, cacheHit, nil
+	}
+
+	val, expiresAt, exists, err := getter.PeekByKey(key)
+	if err != nil || !exists {
+		var zero T
+		return zero, cacheMiss, err
+	}
+	if expiresAt.Before(clockOf(store).Now()) {
+		return copyObject(val), cacheExpired, nil
+	}
+	return copyObject(val), cacheHit, nil
+}
+
+// cacheSharedObject caches auth in a store shared by several
+// authenticator types, e.g. the credentials of all the providers of a
+// controller, like cacheObject does.
+func cacheSharedObject[T authn.Authenticator](store cache.Expirable[cache.StoreObject[authn.Authenticator]], auth T, key string, expiresAt time.Time, opts ...cacheOption) error {
+	return cacheObject[authn.Authenticator](store, auth, key, expiresAt, opts...)
+}
+
+// getSharedObjectFromCache is like getObjectFromCache for a store shared
+// by several authenticator types. It returns an error if the object
+// stored under key is not a T.
+func getSharedObjectFromCache[T authn.Authenticator](store cache.Expirable[cache.StoreObject[authn.Authenticator]], key string) (T, bool, error) {
+	var zero T
+	val, exists, err := getObjectFromCache(store, key)
+	if err != nil || !exists {
+		return zero, exists, err
+	}
+	obj, ok := val.(T)
+	if !ok {
+		return zero, false, fmt.Errorf("credentials cached under %s are of type %T, not %T", key, val, zero)
+	}
+	return obj, true, nil
+}
+
+// expiredObjectsDeleter is implemented by the stores which can remove an
+// expired object atomically, like cache.Cache.
+type expiredObjectsDeleter interface {
+	DeleteIfExpired(key string, t time.Time) (bool, error)
+}
+
+// getObjectFromCacheOrEvict is like getObjectFromCache but first removes
+// the object stored under key if it has expired, reclaiming its space
+// without waiting for the cleanup of the store. Stores which cannot
+// remove expired objects atomically keep them until their cleanup.
+func getObjectFromCacheOrEvict[T authn.Authenticator](store cache.Expirable[cache.StoreObject[T]], key string) (T, bool, error) {
+	if deleter, ok := store.(expiredObjectsDeleter); ok {
+		removed, err := deleter.DeleteIfExpired(key, clockOf(store).Now())
+		if err != nil || removed {
+			var zero T
+			return zero, false, err
+		}
+	}
+	return getObjectFromCache(store, key)
+}
+
+// getObjectsFromCache looks up the objects stored under keys, and returns
+// copies of the ones found. The keys of the objects not in the cache are
+// mapped to cache.ErrNotFound in the returned errors, along with the keys
+// whose lookup failed.
+func getObjectsFromCache[T authn.Authenticator](store cache.Expirable[cache.StoreObject[T]], keys []string) (map[string]T, map[string]error) {
+	objs := make(map[string]T, len(keys))
+	errs := make(map[string]error)
+	for _, key := range keys {
+		obj, exists, err := getObjectFromCache(store, key)
+		switch {
+		case err != nil:
+			errs[key] = err
+		case !exists:
+			errs[key] = cache.ErrNotFound
+		default:
+			objs[key] = obj
+		}
+	}
+	return objs, errs
+}
+
+// isAnonymous returns true if auth is authn.Anonymous.
+func isAnonymous[T authn.Authenticator](auth T) bool {
+	return authn.Authenticator(auth) == authn.Anonymous
+}
+
+// getObjectFromCacheWithFreshness is like getObjectFromCache but also
+// reports whether the object is stale, i.e. expires within refreshWindow,
+// so that the caller can refresh it before it expires.
+func getObjectFromCacheWithFreshness[T authn.Authenticator](store cache.Expirable[cache.StoreObject[T]], key string, refreshWindow time.Duration) (val T, exists, stale bool, err error) {
+	obj, exists, err := store.GetByKey(key)
+	if err != nil || !exists {
+		return val, false, false, err
+	}
+	expiresAt, err := store.GetExpiration(obj)
+	if err != nil {
+		return val, false, false, err
+	}
+	stale = !expiresAt.After(clockOf(store).Now().Add(refreshWindow))
+	return obj.Clone().Object, true, stale, nil
+}
+
+// getObjectTTL returns the time left until the object stored under key
+// expires. It returns false if the object is not in the cache or has
+// expired, and on cache errors.
+func getObjectTTL[T authn.Authenticator](store cache.Expirable[cache.StoreObject[T]], key string) (time.Duration, bool) {
+	obj, exists, err := store.GetByKey(key)
+	if err != nil || !exists {
+		return 0, false
+	}
+	expiresAt, err := store.GetExpiration(obj)
+	if err != nil || expiresAt.IsZero() {
+		return 0, false
+	}
+	ttl := expiresAt.Sub(clockOf(store).Now())
+	if ttl <= 0 {
+		return 0, false
+	}
+	return ttl, true
+}
+
+// fetchGroups holds the singleflight.Group deduplicating the concurrent
+// fetches of getOrFetchObject in each store, so that the fetches of the
+// same key in different stores do not share a loader call.
+var fetchGroups sync.Map
+
+// fetchGroup returns the singleflight.Group of the store. The stores are
+// told apart by identity, as they are pointers.
+func fetchGroup(store any) *singleflight.Group {
+	if g, ok := fetchGroups.Load(store); ok {
+		return g.(*singleflight.Group)
+	}
+	g, _ := fetchGroups.LoadOrStore(store, new(singleflight.Group))
+	return g.(*singleflight.Group)
+}
+
+// fetchOptions holds the options of getOrFetchObject.
+type fetchOptions struct {
+	fallback     bool
+	onCacheError func(key string, err error)
+}
+
+// fetchOption sets an option of getOrFetchObject.
+type fetchOption func(*fetchOptions)
+
+// withCacheFallback treats the errors of the cache as misses, so that
+// the objects are fetched with the loader while the cache is unavailable,
+// and ignores the errors caching them. The errors are passed to
+// onCacheError if not nil, e.g. to log them.
+func withCacheFallback(onCacheError func(key string, err error)) fetchOption {
+	return func(o *fetchOptions) {
+		o.fallback = true
+		o.onCacheError = onCacheError
+	}
+}
+
+// cacheError returns err, or nil after reporting it if the cache errors
+// are ignored.
+func (o *fetchOptions) cacheError(key string, err error) error {
+	if err == nil || !o.fallback {
+		return err
+	}
+	if o.onCacheError != nil {
+		o.onCacheError(key, err)
+	}
+	return nil
+}
+
+// getOrFetchObject returns a copy of the object stored under key. On a
+// cache miss, it calls loader and caches the returned object until the
+// returned expiration time. Concurrent misses for the same key in the
+// same store share a single loader call.
+func getOrFetchObject[T authn.Authenticator](store cache.Expirable[cache.StoreObject[T]], key string, loader func() (T, time.Time, error), opts ...fetchOption) (T, error) {
+	var o fetchOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	obj, exists, err := getObjectFromCache(store, key)
+	if err = o.cacheError(key, err); err != nil || exists {
+		return obj, err
+	}
+
+	v, err, _ := fetchGroup(store).Do(key, func() (any, error) {
+		// the object may have been cached by a fetch that completed
+		// since the lookup above
+		obj, exists, err := getObjectFromCache(store, key)
+		if err = o.cacheError(key, err); err != nil {
+			return nil, err
+		}
+		if exists {
+			return obj, nil
+		}
+		obj, expiresAt, err := loader()
+		if err != nil {
+			return nil, err
+		}
+		if err := o.cacheError(key, cacheObject(store, obj, key, expiresAt)); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	})
+	var zero T
+	if err != nil {
+		return zero, err
+	}
+	obj, ok := v.(T)
+	if !ok {
+		return zero, fmt.Errorf("credentials fetched for %s are of type %T, not %T", key, v, zero)
+	}
+	// the fetched object is shared by all the callers
+	return cache.StoreObject[T]{Object: obj}.Clone().Object, nil
+}
+
+// errCachedAuthFailure is wrapped by the authentication errors returned
+// from the cache, to tell them apart from the errors of the cache itself.
+var errCachedAuthFailure = errors.New("cached authentication failure")
+
+// authError is an authenticator standing for a failed authentication
+// in the cache.
+type authError struct {
+	err error
+}
+
+// Authorization returns the error of the failed authentication.
+func (a *authError) Authorization() (*authn.AuthConfig, error) {
+	return nil, a.err
+}
+
+// cacheAuthError caches the failure of an authentication for ttl, which
+// is typically much shorter than the expiration of credentials.
+func cacheAuthError(store cache.Expirable[cache.StoreObject[authn.Authenticator]], key string, err error, ttl time.Duration) error {
+	return cacheObject[authn.Authenticator](store, &authError{err: err}, key, clockOf(store).Now().Add(ttl))
+}
+
+// getAuthFromCache is like getObjectFromCache but returns the cached
+// authentication failure, wrapped with errCachedAuthFailure, when the
+// authentication failed for key.
+func getAuthFromCache(store cache.Expirable[cache.StoreObject[authn.Authenticator]], key string) (authn.Authenticator, bool, error) {
+	auth, exists, err := getObjectFromCache(store, key)
+	if err != nil || !exists {
+		return nil, false, err
+	}
+	if authErr, ok := auth.(*authError); ok {
+		return nil, true, fmt.Errorf("%w: %w", errCachedAuthFailure, authErr.err)
+	}
+	return auth, true, nil
+}
+
+// getOrFetchAuth is like getOrFetchObject but also caches the errors
+// of loader for negativeTTL, returning them without calling loader
+// again until they expire.
+func getOrFetchAuth(store cache.Expirable[cache.StoreObject[authn.Authenticator]], key string, negativeTTL time.Duration,
+	loader func() (authn.Authenticator, time.Time, error)) (authn.Authenticator, error) {
+	auth, exists, err := getAuthFromCache(store, key)
+	if err != nil || exists {
+		return auth, err
+	}
+
+	auth, err = getOrFetchObject(store, key, loader)
+	if err != nil {
+		if cacheErr := cacheAuthError(store, key, err, negativeTTL); cacheErr != nil {
+			return nil, errors.Join(err, cacheErr)
+		}
+		return nil, err
+	}
+	return auth, nil
+}
+
+// CacheMetrics collects the metrics of the credentials cache. The key
+// given to its methods is the cache key, see CacheKey.
+type CacheMetrics interface {
+	// IncHit is called when credentials are found in the cache.
+	IncHit(key string)
+	// IncMiss is called when credentials are not found in the cache.
+	IncMiss(key string)
+	// IncSet is called when credentials are stored in the cache.
+	IncSet(key string)
+}
+
+// getObjectFromCacheWithMetrics is like getObjectFromCache but records
+// the hit or miss with metrics, if not nil.
+func getObjectFromCacheWithMetrics[T authn.Authenticator](store cache.Expirable[cache.StoreObject[T]], key string, metrics CacheMetrics) (T, bool, error) {
+	obj, exists, err := getObjectFromCache(store, key)
+	if err != nil || metrics == nil {
+		return obj, exists, err
+	}
+	if exists {
+		metrics.IncHit(key)
+	} else {
+		metrics.IncMiss(key)
+	}
+	return obj, exists, nil
+}
+
+// cacheObjectWithMetrics is like cacheObject but records the set with
+// metrics, if not nil.
+func cacheObjectWithMetrics[T authn.Authenticator](store cache.Expirable[cache.StoreObject[T]], auth T, key string, expiresAt time.Time, metrics CacheMetrics) error {
+	return cacheObject(store, auth, key, expiresAt, withMetrics(metrics))
+}
+
+// getObjectFromCacheContext is like getObjectFromCache but returns
+// ctx.Err() without looking up the object if the context is done.
+func getObjectFromCacheContext[T authn.Authenticator](ctx context.Context, store cache.Expirable[cache.StoreObject[T]], key string) (T, bool, error) {
+	type result struct {
+		obj    T
+		exists bool
+	}
+	res, err := runWithContext(ctx, func() (result, error) {
+		obj, exists, err := getObjectFromCache(store, key)
+		return result{obj, exists}, err
+	})
+	return res.obj, res.exists, err
+}
+
+// cacheObjectContext is like cacheObject but returns ctx.Err() without
+// caching the object if the context is done.
+func cacheObjectContext[T authn.Authenticator](ctx context.Context, store cache.Expirable[cache.StoreObject[T]], auth T, key string, expiresAt time.Time) error {
+	_, err := runWithContext(ctx, func() (struct{}, error) {
+		return struct{}{}, cacheObject(store, auth, key, expiresAt)
+	})
+	return err
+}
+
+// runWithContext returns ctx.Err() if the context is done, and runs fn
+// and returns its result otherwise. The stores take no context, so fn
+// cannot be interrupted: its result is returned once it has run, even if
+// the context is done meanwhile, so that callers are not told that a
+// store operation which completed did not happen.
+func runWithContext[R any](ctx context.Context, fn func() (R, error)) (R, error) {
+	if err := ctx.Err(); err != nil {
+		var zero R
+		return zero, err
+	}
+	return fn()
+}
+
+// TokenResponse holds the lifetime of a token returned by a registry, as
+// found in the expires_in and issued_at fields of its token responses.
+type TokenResponse struct {
+	// ExpiresIn is the lifetime of the token in seconds.
+	ExpiresIn int64 `json:"expires_in"`
+	// IssuedAt is the time the token was issued at. The current time
+	// is used when zero.
+	IssuedAt time.Time `json:"issued_at"`
+}
+
+// tokenExpiresAt returns the expiration time of the token, brought
+// forward by margin to account for clock skew and request latency. The
+// token is issued now when its issue time is unknown.
+func tokenExpiresAt(now time.Time, token TokenResponse, margin time.Duration) time.Time {
+	issuedAt := token.IssuedAt
+	if issuedAt.IsZero() {
+		issuedAt = now
+	}
+	return issuedAt.Add(time.Duration(token.ExpiresIn)*time.Second - margin)
+}
+
+// CacheObjectWithTokenExpiry caches auth under key until the token it was
+// created from expires, brought forward by margin to account for clock
+// skew and request latency, rather than for a fixed time to live. The
+// lifetime of the token starts at its issue time, or when it is cached
+// if unknown. Anonymous credentials are cached for at least a day. It
+// returns a *CacheObjectError if the store fails.
+func CacheObjectWithTokenExpiry[T authn.Authenticator](store cache.Expirable[cache.StoreObject[T]], auth T, key string, token TokenResponse, margin time.Duration) error {
+	return cacheObject(store, auth, key, tokenExpiresAt(clockOf(store).Now(), token, margin))
+}
+
+// acrTokenClaims holds the expiration claims of an ACR token.
+type acrTokenClaims struct {
+	// Exp is the expiration time of the token in seconds since the epoch.
+	Exp json.Number `json:"exp"`
+	// ExpiresOn is used in place of Exp when it is missing.
+	ExpiresOn json.Number `json:"expires_on"`
+}
+
+// acrTokenExpiresAt returns the expiration time of an ACR refresh or
+// access token, read from the claims of the JWT without verifying its
+// signature, and brought forward by margin like tokenExpiresAt.
+func acrTokenExpiresAt(token string, margin time.Duration) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errors.New("failed to parse ACR token: not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to decode ACR token claims: %w", err)
+	}
+	var claims acrTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, fmt.Errorf("failed to decode ACR token claims: %w", err)
+	}
+	exp := claims.Exp
+	if exp == "" {
+		exp = claims.ExpiresOn
+	}
+	if exp == "" {
+		return time.Time{}, errors.New("failed to parse ACR token: missing exp claim")
+	}
+	seconds, err := exp.Int64()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse ACR token expiration: %w", err)
+	}
+	return time.Unix(seconds, 0).Add(-margin), nil
+}
+
+// cacheObjectWithACRToken is like cacheObject but expires the object
+// with the ACR token it was created from, see acrTokenExpiresAt.
+func cacheObjectWithACRToken[T authn.Authenticator](store cache.Expirable[cache.StoreObject[T]], auth T, key, token string, margin time.Duration, opts ...cacheOption) error {
+	expiresAt, err := acrTokenExpiresAt(token, margin)
+	if err != nil {
+		return err
+	}
+	return cacheObject(store, auth, key, expiresAt, opts...)
+}
+
+// ecrTokenLifetime is the lifetime of the ECR authorization tokens.
+const ecrTokenLifetime = 12 * time.Hour
+
+// ecrTokenExpiresAt returns the expiration time of an ECR authorization
+// token expiring at expiresAt, or ecrTokenLifetime from now when unknown,
+// brought forward by margin like tokenExpiresAt.
+func ecrTokenExpiresAt(now, expiresAt time.Time, margin time.Duration) time.Time {
+	if expiresAt.IsZero() {
+		expiresAt = now.Add(ecrTokenLifetime)
+	}
+	return expiresAt.Add(-margin)
+}
+
+// cacheObjectWithECRToken is like cacheObject but expires the object
+// with the ECR authorization token it was created from, see
+// ecrTokenExpiresAt.
+func cacheObjectWithECRToken[T authn.Authenticator](store cache.Expirable[cache.StoreObject[T]], auth T, key string, expiresAt time.Time, margin time.Duration, opts ...cacheOption) error {
+	return cacheObject(store, auth, key, ecrTokenExpiresAt(clockOf(store).Now(), expiresAt, margin), opts...)
+}
+
+// prefetchConcurrency is the maximum number of credentials fetched in
+// parallel by PrefetchCredentials.
+const prefetchConcurrency = 10
+
+// PrefetchCredentials warms the cache with the credentials of the given
+// keys, calling loader concurrently for the keys which are not cached
+// yet. The errors of all the keys are returned joined together.
+func PrefetchCredentials(ctx context.Context, store cache.Expirable[cache.StoreObject[authn.Authenticator]], keys []string,
+	loader func(ctx context.Context, key string) (authn.Authenticator, time.Time, error)) error {
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+	addErr := func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	}
+
+	var g errgroup.Group
+	g.SetLimit(prefetchConcurrency)
+	for _, key := range keys {
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				addErr(fmt.Errorf("failed to prefetch credentials for %s: %w", key, err))
+				return nil
+			}
+			_, exists, err := getObjectFromCache(store, key)
+			if err != nil {
+				addErr(fmt.Errorf("failed to get credentials for %s from cache: %w", key, err))
+				return nil
+			}
+			if exists {
+				return nil
+			}
+			auth, expiresAt, err := loader(ctx, key)
+			if err != nil {
+				addErr(fmt.Errorf("failed to prefetch credentials for %s: %w", key, err))
+				return nil
+			}
+			if err := cacheObject(store, auth, key, expiresAt); err != nil {
+				addErr(fmt.Errorf("failed to cache credentials for %s: %w", key, err))
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+	return errors.Join(errs...)
+}
+
+// ErrStatsUnsupported is returned by GetCacheStats for the stores which
+// cannot enumerate their entries with their expiration.
+var ErrStatsUnsupported = errors.New("cache stats not supported by the store")
+
+// CacheStats is a point-in-time snapshot of a credentials cache.
+type CacheStats struct {
+	// Entries is the number of credentials in the cache, including the
+	// expired ones.
+	Entries int
+	// Expired is the number of credentials which expired but have not
+	// been evicted yet.
+	Expired int
+	// ApproxBytes is an approximation of the memory held by the keys and
+	// the credentials, see authSize.
+	ApproxBytes int
+}
+
+// GetCacheStats returns a snapshot of the entries of store, for exposing
+// them as metrics. It fails with ErrStatsUnsupported for the stores which
+// do not retain expired objects like cache.Cache does.
+func GetCacheStats[T authn.Authenticator](store cache.Expirable[cache.StoreObject[T]]) (CacheStats, error) {
+	var stats CacheStats
+	getter, ok := store.(expiredObjectsGetter[cache.StoreObject[T]])
+	if !ok {
+		return stats, ErrStatsUnsupported
+	}
+	keys, err := store.ListKeys()
+	if err != nil {
+		return stats, fmt.Errorf("failed to list cache keys: %w", err)
+	}
+
+	t := clockOf(store).Now()
+	for _, key := range keys {
+		val, expiresAt, exists, err := getter.PeekByKey(key)
+		if err != nil {
+			return stats, err
+		}
+		if !exists {
+			// deleted since the keys were listed
+			continue
+		}
+		stats.Entries++
+		if expiresAt.Before(t) {
+			stats.Expired++
+		}
+		stats.ApproxBytes += len(key) + authSize(val.Object)
+	}
+	return stats, nil
+}
+
+// authOverhead is the approximate size of the credentials whose secrets
+// are not known, e.g. the tokens of the cloud providers.
+const authOverhead = 256
+
+// authSize returns the approximate size of the credentials of auth. It
+// does not call Authorization, which may fetch a token, so only the
+// secrets of the basic and bearer authenticators are counted, and the
+// other credentials but anonymous ones are assumed to be authOverhead
+// bytes.
+func authSize(auth authn.Authenticator) int {
+	if isAnonymous(auth) {
+		return 0
+	}
+	switch a := any(auth).(type) {
+	case *authn.Basic:
+		return len(a.Username) + len(a.Password)
+	case *authn.Bearer:
+		return len(a.Token)
+	}
+	return authOverhead
+}
+
+// InvalidateByPrefix removes from the store all the objects whose key
+// starts with prefix, e.g. all the credentials of a registry host, and
+// returns the number of objects removed. The store must be able to
+// list its keys.
+func InvalidateByPrefix[T any](store cache.Store[cache.StoreObject[T]], prefix string) (int, error) {
+	keys, err := store.ListKeys()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list cache keys: %w", err)
+	}
+
+	var removed int
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		obj, exists, err := store.GetByKey(key)
+		if err != nil {
+			return removed, err
+		}
+		if !exists {
+			// already expired
+			continue
+		}
+		if err := store.Delete(obj); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
 }
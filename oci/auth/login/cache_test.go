@@ -0,0 +1,1190 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/pkg/cache"
+)
+
+// cloneableAuth is an authenticator implementing cache.Cloner.
+type cloneableAuth struct {
+	config authn.AuthConfig
+}
+
+func (a *cloneableAuth) Authorization() (*authn.AuthConfig, error) {
+	return &a.config, nil
+}
+
+func (a *cloneableAuth) Clone() authn.Authenticator {
+	c := *a
+	return &c
+}
+
+// countingAuth is an authenticator counting the calls to Authorization.
+type countingAuth struct {
+	calls int
+}
+
+func (a *countingAuth) Authorization() (*authn.AuthConfig, error) {
+	a.calls++
+	return &authn.AuthConfig{}, nil
+}
+
+// fakeClock is a Clock whose time is set by the tests.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// withFakeClock returns the store option telling the time with a fake
+// clock set to start, and the clock.
+func withFakeClock(start time.Time) (cache.Options[cache.StoreObject[authn.Authenticator]], *fakeClock) {
+	fc := &fakeClock{now: start}
+	return cache.WithClock[cache.StoreObject[authn.Authenticator]](fc), fc
+}
+
+func newAuthCache(g *WithT, opts ...cache.Options[cache.StoreObject[authn.Authenticator]]) *cache.Cache[cache.StoreObject[authn.Authenticator]] {
+	opts = append([]cache.Options[cache.StoreObject[authn.Authenticator]]{
+		cache.WithCleanupInterval[cache.StoreObject[authn.Authenticator]](1 * time.Second),
+	}, opts...)
+	c, err := cache.New(5, cache.StoreObjectKeyFunc, opts...)
+	g.Expect(err).ToNot(HaveOccurred())
+	return c
+}
+
+func TestGetObjectFromCache_Concurrent(t *testing.T) {
+	const concurrency = 50
+	g := NewWithT(t)
+	c := newAuthCache(g)
+
+	auth := &cloneableAuth{config: authn.AuthConfig{Username: "user", Password: "pass"}}
+	err := cacheObject[authn.Authenticator](c, auth, "registry", time.Now().Add(time.Hour))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	var wg sync.WaitGroup
+	run := make(chan bool)
+	passwords := make(chan string, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-run
+			got, exists, err := getObjectFromCache(c, "registry")
+			if err != nil || !exists {
+				passwords <- ""
+				return
+			}
+			config, _ := got.Authorization()
+			passwords <- config.Password
+			config.Password = "modified"
+		}()
+	}
+	close(run)
+	wg.Wait()
+	close(passwords)
+
+	for password := range passwords {
+		g.Expect(password).To(Equal("pass"))
+	}
+	g.Expect(auth.config.Password).To(Equal("pass"))
+}
+
+func TestGetOrFetchObject(t *testing.T) {
+	t.Run("calls loader once for concurrent misses", func(t *testing.T) {
+		const concurrency = 50
+		g := NewWithT(t)
+		c := newAuthCache(g)
+
+		var calls atomic.Int32
+		loader := func() (authn.Authenticator, time.Time, error) {
+			calls.Add(1)
+			time.Sleep(50 * time.Millisecond)
+			return &cloneableAuth{config: authn.AuthConfig{Password: "pass"}}, time.Now().Add(time.Hour), nil
+		}
+
+		var wg sync.WaitGroup
+		run := make(chan bool)
+		errs := make(chan error, concurrency)
+		for i := 0; i < concurrency; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-run
+				_, err := getOrFetchObject(c, "registry", loader)
+				errs <- err
+			}()
+		}
+		close(run)
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			g.Expect(err).ToNot(HaveOccurred())
+		}
+		g.Expect(calls.Load()).To(Equal(int32(1)))
+
+		auth, exists, err := getObjectFromCache(c, "registry")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(exists).To(BeTrue())
+		config, err := auth.Authorization()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(config.Password).To(Equal("pass"))
+	})
+
+	t.Run("returns cached object without calling loader", func(t *testing.T) {
+		g := NewWithT(t)
+		c := newAuthCache(g)
+		err := cacheObject[authn.Authenticator](c, authn.Anonymous, "registry", time.Now().Add(time.Hour))
+		g.Expect(err).ToNot(HaveOccurred())
+
+		auth, err := getOrFetchObject(c, "registry", func() (authn.Authenticator, time.Time, error) {
+			t.Error("loader called for a cached object")
+			return nil, time.Time{}, nil
+		})
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(auth).To(Equal(authn.Anonymous))
+	})
+
+	t.Run("does not cache loader errors", func(t *testing.T) {
+		g := NewWithT(t)
+		c := newAuthCache(g)
+		loaderErr := errors.New("unauthorized")
+
+		_, err := getOrFetchObject(c, "registry", func() (authn.Authenticator, time.Time, error) {
+			return nil, time.Time{}, loaderErr
+		})
+		g.Expect(err).To(MatchError(loaderErr))
+
+		_, exists, err := getObjectFromCache(c, "registry")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(exists).To(BeFalse())
+	})
+
+	t.Run("does not share loader calls between stores", func(t *testing.T) {
+		g := NewWithT(t)
+		c1, c2 := newAuthCache(g), newAuthCache(g)
+
+		// both loaders run at the same time, for the same key
+		var started sync.WaitGroup
+		started.Add(2)
+		loader := func(password string) func() (authn.Authenticator, time.Time, error) {
+			return func() (authn.Authenticator, time.Time, error) {
+				started.Done()
+				started.Wait()
+				return &cloneableAuth{config: authn.AuthConfig{Password: password}}, time.Now().Add(time.Hour), nil
+			}
+		}
+
+		var wg sync.WaitGroup
+		auths := make([]authn.Authenticator, 2)
+		errs := make([]error, 2)
+		for i, c := range []*cache.Cache[cache.StoreObject[authn.Authenticator]]{c1, c2} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				auths[i], errs[i] = getOrFetchObject(c, "registry", loader(fmt.Sprintf("pass%d", i)))
+			}()
+		}
+		wg.Wait()
+
+		for i := range auths {
+			g.Expect(errs[i]).ToNot(HaveOccurred())
+			config, err := auths[i].Authorization()
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(config.Password).To(Equal(fmt.Sprintf("pass%d", i)))
+		}
+	})
+
+	t.Run("returns an error for a nil object", func(t *testing.T) {
+		g := NewWithT(t)
+		c := newAuthCache(g)
+
+		_, err := getOrFetchObject(c, "registry", func() (authn.Authenticator, time.Time, error) {
+			return nil, time.Now().Add(time.Hour), nil
+		})
+		g.Expect(err).To(HaveOccurred())
+	})
+}
+
+// unavailableStore is a store whose reads and writes fail.
+type unavailableStore struct {
+	cache.Expirable[cache.StoreObject[authn.Authenticator]]
+}
+
+var errUnavailable = errors.New("cache unavailable")
+
+func (unavailableStore) GetByKey(string) (cache.StoreObject[authn.Authenticator], bool, error) {
+	return cache.StoreObject[authn.Authenticator]{}, false, errUnavailable
+}
+
+func (unavailableStore) Set(cache.StoreObject[authn.Authenticator]) error {
+	return errUnavailable
+}
+
+func TestGetOrFetchObject_WithCacheFallback(t *testing.T) {
+	g := NewWithT(t)
+	store := unavailableStore{newAuthCache(g)}
+
+	var calls int
+	loader := func() (authn.Authenticator, time.Time, error) {
+		calls++
+		return &cloneableAuth{config: authn.AuthConfig{Password: "pass"}}, time.Now().Add(time.Hour), nil
+	}
+
+	_, err := getOrFetchObject[authn.Authenticator](store, "registry", loader)
+	g.Expect(err).To(MatchError(errUnavailable))
+	g.Expect(calls).To(BeZero())
+
+	var cacheErrs []error
+	auth, err := getOrFetchObject[authn.Authenticator](store, "registry", loader, withCacheFallback(func(key string, err error) {
+		g.Expect(key).To(Equal("registry"))
+		cacheErrs = append(cacheErrs, err)
+	}))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(calls).To(Equal(1))
+	config, err := auth.Authorization()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(config.Password).To(Equal("pass"))
+	// the two lookups and the write failed
+	g.Expect(cacheErrs).To(HaveLen(3))
+	for _, err := range cacheErrs {
+		g.Expect(err).To(MatchError(errUnavailable))
+	}
+
+	// the errors are ignored without callback
+	_, err = getOrFetchObject[authn.Authenticator](store, "registry", loader, withCacheFallback(nil))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(calls).To(Equal(2))
+
+	// the errors of the loader are still returned
+	_, err = getOrFetchObject[authn.Authenticator](store, "registry", func() (authn.Authenticator, time.Time, error) {
+		return nil, time.Time{}, errors.New("denied")
+	}, withCacheFallback(nil))
+	g.Expect(err).To(MatchError("denied"))
+}
+
+func TestGetObjectFromCacheWithFreshness(t *testing.T) {
+	g := NewWithT(t)
+	start := time.Now()
+	clockOpt, fc := withFakeClock(start)
+	c := newAuthCache(g, clockOpt)
+	auth := &cloneableAuth{config: authn.AuthConfig{Password: "pass"}}
+
+	err := cacheObject[authn.Authenticator](c, auth, "registry", start.Add(10*time.Minute))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		stale   bool
+	}{
+		{name: "before the refresh window", elapsed: 0, stale: false},
+		{name: "right before the refresh window", elapsed: 7*time.Minute + 59*time.Second, stale: false},
+		{name: "within the refresh window", elapsed: 8*time.Minute + time.Second, stale: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			fc.Set(start.Add(tt.elapsed))
+
+			got, exists, stale, err := getObjectFromCacheWithFreshness(c, "registry", 2*time.Minute)
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(exists).To(BeTrue())
+			g.Expect(stale).To(Equal(tt.stale))
+			g.Expect(got).To(Equal(auth))
+		})
+	}
+
+	_, exists, stale, err := getObjectFromCacheWithFreshness(c, "missing", 2*time.Minute)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeFalse())
+	g.Expect(stale).To(BeFalse())
+}
+
+func TestCacheKey(t *testing.T) {
+	g := NewWithT(t)
+
+	ghcr := CacheKey("ghcr.io", "org/app")
+	docker := CacheKey("docker.io", "org/app")
+	g.Expect(ghcr).To(Equal("ghcr.io/org/app"))
+	g.Expect(docker).To(Equal("docker.io/org/app"))
+	g.Expect(CacheKey("ghcr.io", "/org/app")).To(Equal(ghcr))
+
+	c := newAuthCache(g)
+	ghcrAuth := &cloneableAuth{config: authn.AuthConfig{Password: "ghcr"}}
+	dockerAuth := &cloneableAuth{config: authn.AuthConfig{Password: "docker"}}
+	g.Expect(cacheObject[authn.Authenticator](c, ghcrAuth, ghcr, time.Now().Add(time.Hour))).To(Succeed())
+	g.Expect(cacheObject[authn.Authenticator](c, dockerAuth, docker, time.Now().Add(time.Hour))).To(Succeed())
+
+	for key, password := range map[string]string{ghcr: "ghcr", docker: "docker"} {
+		auth, exists, err := getObjectFromCache(c, key)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(exists).To(BeTrue())
+		config, err := auth.Authorization()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(config.Password).To(Equal(password))
+	}
+}
+
+func TestGetOrFetchAuth(t *testing.T) {
+	g := NewWithT(t)
+	start := time.Now()
+	clockOpt, fc := withFakeClock(start)
+	c := newAuthCache(g, clockOpt)
+
+	var calls atomic.Int32
+	loaderErr := errors.New("401 Unauthorized")
+	loader := func() (authn.Authenticator, time.Time, error) {
+		calls.Add(1)
+		return nil, time.Time{}, loaderErr
+	}
+
+	_, err := getOrFetchAuth(c, "registry", 100*time.Millisecond, loader)
+	g.Expect(err).To(MatchError(loaderErr))
+	g.Expect(errors.Is(err, errCachedAuthFailure)).To(BeFalse())
+	g.Expect(calls.Load()).To(Equal(int32(1)))
+
+	// the failure is cached within the negative TTL
+	_, err = getOrFetchAuth(c, "registry", 100*time.Millisecond, loader)
+	g.Expect(err).To(MatchError(loaderErr))
+	g.Expect(errors.Is(err, errCachedAuthFailure)).To(BeTrue())
+	g.Expect(calls.Load()).To(Equal(int32(1)))
+
+	_, exists, err := getAuthFromCache(c, "registry")
+	g.Expect(exists).To(BeTrue())
+	g.Expect(err).To(MatchError(errCachedAuthFailure))
+
+	// the loader is called again once the failure expired
+	fc.Set(start.Add(150 * time.Millisecond))
+	_, exists, err = getAuthFromCache(c, "registry")
+	g.Expect(exists).To(BeFalse())
+	g.Expect(err).ToNot(HaveOccurred())
+
+	_, err = getOrFetchAuth(c, "registry", 100*time.Millisecond, loader)
+	g.Expect(err).To(MatchError(loaderErr))
+	g.Expect(calls.Load()).To(Equal(int32(2)))
+}
+
+// fakeCacheMetrics counts the calls to its methods.
+type fakeCacheMetrics struct {
+	hits, misses, sets map[string]int
+}
+
+func newFakeCacheMetrics() *fakeCacheMetrics {
+	return &fakeCacheMetrics{
+		hits:   make(map[string]int),
+		misses: make(map[string]int),
+		sets:   make(map[string]int),
+	}
+}
+
+func (m *fakeCacheMetrics) IncHit(key string)  { m.hits[key]++ }
+func (m *fakeCacheMetrics) IncMiss(key string) { m.misses[key]++ }
+func (m *fakeCacheMetrics) IncSet(key string)  { m.sets[key]++ }
+
+func TestCacheMetrics(t *testing.T) {
+	g := NewWithT(t)
+	c := newAuthCache(g)
+	metrics := newFakeCacheMetrics()
+
+	_, exists, err := getObjectFromCacheWithMetrics(c, "registry", metrics)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeFalse())
+	g.Expect(metrics.misses).To(Equal(map[string]int{"registry": 1}))
+
+	err = cacheObjectWithMetrics[authn.Authenticator](c, authn.Anonymous, "registry", time.Now().Add(time.Hour), metrics)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(metrics.sets).To(Equal(map[string]int{"registry": 1}))
+
+	_, exists, err = getObjectFromCacheWithMetrics(c, "registry", metrics)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeTrue())
+	g.Expect(metrics.hits).To(Equal(map[string]int{"registry": 1}))
+	g.Expect(metrics.misses).To(Equal(map[string]int{"registry": 1}))
+
+	// no metrics collector
+	_, exists, err = getObjectFromCacheWithMetrics(c, "registry", nil)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeTrue())
+	g.Expect(cacheObjectWithMetrics[authn.Authenticator](c, authn.Anonymous, "other", time.Now().Add(time.Hour), nil)).To(Succeed())
+	g.Expect(metrics.hits).To(Equal(map[string]int{"registry": 1}))
+	g.Expect(metrics.sets).To(Equal(map[string]int{"registry": 1}))
+}
+
+// cancellingStore is a store cancelling a context on each operation,
+// before running it.
+type cancellingStore struct {
+	cache.Expirable[cache.StoreObject[authn.Authenticator]]
+	cancel context.CancelFunc
+}
+
+func (s *cancellingStore) GetByKey(key string) (cache.StoreObject[authn.Authenticator], bool, error) {
+	s.cancel()
+	return s.Expirable.GetByKey(key)
+}
+
+func (s *cancellingStore) Set(obj cache.StoreObject[authn.Authenticator]) error {
+	s.cancel()
+	return s.Expirable.Set(obj)
+}
+
+func TestCacheHelpersContext(t *testing.T) {
+	t.Run("cancelled context", func(t *testing.T) {
+		g := NewWithT(t)
+		c := newAuthCache(g)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, _, err := getObjectFromCacheContext(ctx, c, "registry")
+		g.Expect(err).To(MatchError(context.Canceled))
+		err = cacheObjectContext[authn.Authenticator](ctx, c, authn.Anonymous, "registry", time.Now().Add(time.Hour))
+		g.Expect(err).To(MatchError(context.Canceled))
+
+		// the store is not called
+		_, exists, err := getObjectFromCache(c, "registry")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(exists).To(BeFalse())
+	})
+
+	t.Run("context cancelled during the call", func(t *testing.T) {
+		g := NewWithT(t)
+		c := newAuthCache(g)
+		ctx, cancel := context.WithCancel(context.Background())
+		store := &cancellingStore{Expirable: c, cancel: cancel}
+
+		// the write is not interrupted, and its result is returned
+		err := cacheObjectContext[authn.Authenticator](ctx, store, authn.Anonymous, "registry", time.Now().Add(time.Hour))
+		g.Expect(err).ToNot(HaveOccurred())
+		auth, exists, err := getObjectFromCache(c, "registry")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(exists).To(BeTrue())
+		g.Expect(auth).To(Equal(authn.Anonymous))
+
+		// the context is done from then on
+		_, _, err = getObjectFromCacheContext(ctx, store, "registry")
+		g.Expect(err).To(MatchError(context.Canceled))
+
+		// so is the lookup
+		ctx, cancel = context.WithCancel(context.Background())
+		store = &cancellingStore{Expirable: c, cancel: cancel}
+		auth, exists, err = getObjectFromCacheContext(ctx, store, "registry")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(exists).To(BeTrue())
+		g.Expect(auth).To(Equal(authn.Anonymous))
+		g.Expect(ctx.Err()).To(MatchError(context.Canceled))
+	})
+
+	t.Run("store responds", func(t *testing.T) {
+		g := NewWithT(t)
+		c := newAuthCache(g)
+		ctx := context.Background()
+
+		err := cacheObjectContext[authn.Authenticator](ctx, c, authn.Anonymous, "registry", time.Now().Add(time.Hour))
+		g.Expect(err).ToNot(HaveOccurred())
+		auth, exists, err := getObjectFromCacheContext(ctx, c, "registry")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(exists).To(BeTrue())
+		g.Expect(auth).To(Equal(authn.Anonymous))
+	})
+}
+
+func TestCacheObjectWithTokenExpiry(t *testing.T) {
+	g := NewWithT(t)
+	c := newAuthCache(g)
+	auth := &cloneableAuth{config: authn.AuthConfig{Password: "pass"}}
+
+	issuedAt := time.Now().Truncate(time.Second)
+	token := TokenResponse{ExpiresIn: 3600, IssuedAt: issuedAt}
+	g.Expect(tokenExpiresAt(time.Now(), token, 30*time.Second)).To(Equal(issuedAt.Add(59*time.Minute + 30*time.Second)))
+
+	err := CacheObjectWithTokenExpiry[authn.Authenticator](c, auth, "registry", token, 30*time.Second)
+	g.Expect(err).ToNot(HaveOccurred())
+	obj, exists, err := c.GetByKey("registry")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeTrue())
+	expiresAt, err := c.GetExpiration(obj)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(expiresAt).To(Equal(issuedAt.Add(59*time.Minute + 30*time.Second)))
+
+	// the current time is used when the issue time is unknown
+	g.Expect(tokenExpiresAt(issuedAt, TokenResponse{ExpiresIn: 3600}, 30*time.Second)).To(Equal(issuedAt.Add(59*time.Minute + 30*time.Second)))
+}
+
+// fakeJWT returns an unsigned JWT with the given claims.
+func fakeJWT(claims string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString([]byte(claims)) + ".sig"
+}
+
+func TestCacheObjectWithACRToken(t *testing.T) {
+	g := NewWithT(t)
+	c := newAuthCache(g)
+	auth := &cloneableAuth{config: authn.AuthConfig{Password: "pass"}}
+
+	exp := time.Now().Add(3 * time.Hour).Truncate(time.Second)
+	token := fakeJWT(fmt.Sprintf(`{"aud":"registry.azurecr.io","exp":%d}`, exp.Unix()))
+	err := cacheObjectWithACRToken[authn.Authenticator](c, auth, "registry", token, time.Minute)
+	g.Expect(err).ToNot(HaveOccurred())
+	obj, exists, err := c.GetByKey("registry")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeTrue())
+	expiresAt, err := c.GetExpiration(obj)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(expiresAt).To(Equal(exp.Add(-time.Minute)))
+
+	tests := []struct {
+		name    string
+		token   string
+		want    time.Time
+		wantErr string
+	}{
+		{name: "expires_on claim", token: fakeJWT(`{"expires_on":"1700000000"}`), want: time.Unix(1700000000, 0)},
+		{name: "exp over expires_on", token: fakeJWT(`{"exp":1700000000,"expires_on":1800000000}`), want: time.Unix(1700000000, 0)},
+		{name: "not a JWT", token: "opaque", wantErr: "not a JWT"},
+		{name: "invalid encoding", token: "a.!!.c", wantErr: "failed to decode"},
+		{name: "missing claim", token: fakeJWT(`{"aud":"registry"}`), wantErr: "missing exp claim"},
+		{name: "invalid claim", token: fakeJWT(`{"exp":1.5}`), wantErr: "failed to parse ACR token expiration"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			got, err := acrTokenExpiresAt(tt.token, 0)
+			if tt.wantErr != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tt.wantErr)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(got).To(Equal(tt.want))
+		})
+	}
+
+	err = cacheObjectWithACRToken[authn.Authenticator](c, auth, "other", "opaque", 0)
+	g.Expect(err).To(HaveOccurred())
+	_, exists, err = c.GetByKey("other")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeFalse())
+}
+
+func TestCacheObjectWithECRToken(t *testing.T) {
+	g := NewWithT(t)
+	start := time.Now().Truncate(time.Second)
+	clockOpt, _ := withFakeClock(start)
+	c := newAuthCache(g, clockOpt)
+	auth := &cloneableAuth{config: authn.AuthConfig{Password: "pass"}}
+
+	g.Expect(ecrTokenExpiresAt(start, start.Add(time.Hour), 5*time.Minute)).To(Equal(start.Add(55 * time.Minute)))
+	// the token lifetime is used when the expiration is unknown
+	g.Expect(ecrTokenExpiresAt(start, time.Time{}, 5*time.Minute)).To(Equal(start.Add(12*time.Hour - 5*time.Minute)))
+
+	err := cacheObjectWithECRToken[authn.Authenticator](c, auth, "registry", time.Time{}, 5*time.Minute)
+	g.Expect(err).ToNot(HaveOccurred())
+	obj, exists, err := c.GetByKey("registry")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeTrue())
+	expiresAt, err := c.GetExpiration(obj)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(expiresAt).To(Equal(start.Add(12*time.Hour - 5*time.Minute)))
+
+	// a token expiring within the margin is fetched again
+	err = cacheObjectWithECRToken[authn.Authenticator](c, auth, "near-expiry", time.Now().Add(time.Minute), 5*time.Minute)
+	g.Expect(err).ToNot(HaveOccurred())
+	var calls int
+	_, err = getOrFetchObject[authn.Authenticator](c, "near-expiry", func() (authn.Authenticator, time.Time, error) {
+		calls++
+		return &cloneableAuth{config: authn.AuthConfig{Password: "new"}}, time.Now().Add(ecrTokenLifetime), nil
+	})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(calls).To(Equal(1))
+}
+
+func TestPrefetchCredentials(t *testing.T) {
+	g := NewWithT(t)
+	c, err := cache.New(20, cache.StoreObjectKeyFunc,
+		cache.WithCleanupInterval[cache.StoreObject[authn.Authenticator]](1*time.Second))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	cached := []string{CacheKey("ghcr.io", "a"), CacheKey("ghcr.io", "b")}
+	for _, key := range cached {
+		err := cacheObject[authn.Authenticator](c, authn.Anonymous, key, time.Now().Add(time.Hour))
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+	missing := []string{CacheKey("docker.io", "a"), CacheKey("docker.io", "b"), CacheKey("docker.io", "c")}
+	failing := CacheKey("quay.io", "a")
+
+	var (
+		mu     sync.Mutex
+		loaded []string
+	)
+	loader := func(ctx context.Context, key string) (authn.Authenticator, time.Time, error) {
+		mu.Lock()
+		loaded = append(loaded, key)
+		mu.Unlock()
+		if key == failing {
+			return nil, time.Time{}, errors.New("401 Unauthorized")
+		}
+		return authn.Anonymous, time.Now().Add(time.Hour), nil
+	}
+
+	keys := append(append(append([]string{}, cached...), missing...), failing)
+	err = PrefetchCredentials(context.Background(), c, keys, loader)
+	g.Expect(err).To(MatchError(ContainSubstring("failed to prefetch credentials for quay.io/a: 401 Unauthorized")))
+	g.Expect(loaded).To(ConsistOf(append(missing, failing)))
+
+	for _, key := range append(cached, missing...) {
+		_, exists, err := getObjectFromCache(c, key)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(exists).To(BeTrue(), "credentials for %s not cached", key)
+	}
+	_, exists, err := getObjectFromCache(c, failing)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeFalse())
+}
+
+func TestGetObjectTTL(t *testing.T) {
+	g := NewWithT(t)
+	start := time.Now()
+	clockOpt, fc := withFakeClock(start)
+	c := newAuthCache(g, clockOpt)
+	auth := &cloneableAuth{config: authn.AuthConfig{Password: "pass"}}
+
+	err := cacheObject[authn.Authenticator](c, auth, "registry", start.Add(10*time.Minute))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	ttl, ok := getObjectTTL(c, "registry")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(ttl).To(Equal(10 * time.Minute))
+
+	fc.Set(start.Add(4 * time.Minute))
+	ttl, ok = getObjectTTL(c, "registry")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(ttl).To(Equal(6 * time.Minute))
+
+	fc.Set(start.Add(10 * time.Minute))
+	_, ok = getObjectTTL(c, "registry")
+	g.Expect(ok).To(BeFalse())
+
+	_, ok = getObjectTTL(c, "missing")
+	g.Expect(ok).To(BeFalse())
+}
+
+func TestCacheObject_Anonymous(t *testing.T) {
+	g := NewWithT(t)
+	c := newAuthCache(g)
+
+	err := cacheObject[authn.Authenticator](c, authn.Anonymous, "registry", time.Now().Add(time.Minute))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	auth, exists, err := getObjectFromCache(c, "registry")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeTrue())
+	g.Expect(auth).To(BeIdenticalTo(authn.Anonymous))
+
+	ttl, ok := getObjectTTL(c, "registry")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(ttl).To(BeNumerically("~", anonymousTTL, time.Second))
+
+	// credentials keep the given expiration
+	err = cacheObject[authn.Authenticator](c, &cloneableAuth{}, "other", time.Now().Add(time.Minute))
+	g.Expect(err).ToNot(HaveOccurred())
+	ttl, ok = getObjectTTL(c, "other")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(ttl).To(BeNumerically("<=", time.Minute))
+}
+
+// unlistableStore is a store which cannot list its keys.
+type unlistableStore struct {
+	cache.Expirable[cache.StoreObject[authn.Authenticator]]
+}
+
+func (unlistableStore) ListKeys() ([]string, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestInvalidateByPrefix(t *testing.T) {
+	g := NewWithT(t)
+	c := newAuthCache(g)
+
+	keys := []string{
+		CacheKey("ghcr.io", "org/a"),
+		CacheKey("ghcr.io", "org/b"),
+		CacheKey("docker.io", "org/a"),
+		CacheKey("docker.io", "org/b"),
+	}
+	for _, key := range keys {
+		err := cacheObject[authn.Authenticator](c, &cloneableAuth{}, key, time.Now().Add(time.Hour))
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+
+	removed, err := InvalidateByPrefix(c, "ghcr.io/")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(removed).To(Equal(2))
+
+	for i, key := range keys {
+		_, exists, err := getObjectFromCache(c, key)
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(exists).To(Equal(i >= 2), "unexpected presence of %s", key)
+	}
+
+	removed, err = InvalidateByPrefix(c, "ghcr.io/")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(removed).To(BeZero())
+
+	_, err = InvalidateByPrefix[authn.Authenticator](unlistableStore{c}, "docker.io/")
+	g.Expect(err).To(MatchError(ContainSubstring("failed to list cache keys")))
+}
+
+func TestGetCacheStats(t *testing.T) {
+	g := NewWithT(t)
+	start := time.Now()
+	clockOpt, fc := withFakeClock(start)
+	c, err := cache.New(10, cache.StoreObjectKeyFunc,
+		cache.WithCleanupInterval[cache.StoreObject[authn.Authenticator]](time.Hour),
+		cache.WithExpiredRetention[cache.StoreObject[authn.Authenticator]](time.Hour),
+		clockOpt)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	stats, err := GetCacheStats[authn.Authenticator](c)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(stats).To(Equal(CacheStats{}))
+
+	auths := []authn.Authenticator{
+		&authn.Basic{Username: "user", Password: "pass"},
+		&authn.Bearer{Token: "token"},
+		// the credentials are not fetched
+		&countingAuth{},
+	}
+	for i, ttl := range []time.Duration{time.Minute, time.Hour, 2 * time.Hour} {
+		err := cacheObject(c, auths[i], fmt.Sprintf("key%d", i), start.Add(ttl))
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+
+	stats, err = GetCacheStats[authn.Authenticator](c)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(stats).To(Equal(CacheStats{Entries: 3, ApproxBytes: 3*len("key0") + len("userpass") + len("token") + authOverhead}))
+	g.Expect(auths[2].(*countingAuth).calls).To(Equal(0))
+
+	fc.Set(start.Add(90 * time.Minute))
+	stats, err = GetCacheStats[authn.Authenticator](c)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(stats.Entries).To(Equal(3))
+	g.Expect(stats.Expired).To(Equal(2))
+
+	err = c.Delete(cache.StoreObject[authn.Authenticator]{Key: "key2"})
+	g.Expect(err).ToNot(HaveOccurred())
+	stats, err = GetCacheStats[authn.Authenticator](c)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(stats.Entries).To(Equal(2))
+
+	_, err = GetCacheStats[authn.Authenticator](unlistableStore{c})
+	g.Expect(err).To(MatchError(ErrStatsUnsupported))
+}
+
+func TestCacheObject_WithJitter(t *testing.T) {
+	g := NewWithT(t)
+	start := time.Now()
+	clockOpt, _ := withFakeClock(start)
+	c, err := cache.New(20, cache.StoreObjectKeyFunc,
+		cache.WithCleanupInterval[cache.StoreObject[authn.Authenticator]](1*time.Second),
+		clockOpt)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	expiresAt := start.Add(time.Hour)
+	expirations := func(seed uint64) []time.Time {
+		rng := rand.New(rand.NewPCG(seed, seed))
+		var res []time.Time
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("registry-%d", i)
+			err := cacheObject[authn.Authenticator](c, &cloneableAuth{}, key, expiresAt, withJitter(0.1, rng))
+			g.Expect(err).ToNot(HaveOccurred())
+			obj, _, err := c.GetByKey(key)
+			g.Expect(err).ToNot(HaveOccurred())
+			exp, err := c.GetExpiration(obj)
+			g.Expect(err).ToNot(HaveOccurred())
+			res = append(res, exp)
+		}
+		return res
+	}
+
+	got := expirations(42)
+	distinct := make(map[time.Time]bool)
+	for _, exp := range got {
+		g.Expect(exp).To(BeTemporally("~", expiresAt, 6*time.Minute))
+		distinct[exp] = true
+	}
+	g.Expect(len(distinct)).To(BeNumerically(">", 1))
+
+	// the same seed gives the same expirations
+	g.Expect(expirations(42)).To(Equal(got))
+
+	// no jitter by default
+	err = cacheObject[authn.Authenticator](c, &cloneableAuth{}, "registry", expiresAt)
+	g.Expect(err).ToNot(HaveOccurred())
+	obj, _, err := c.GetByKey("registry")
+	g.Expect(err).ToNot(HaveOccurred())
+	exp, err := c.GetExpiration(obj)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exp).To(Equal(expiresAt))
+}
+
+func TestCacheObject_ExpirableLRU(t *testing.T) {
+	g := NewWithT(t)
+	lru, err := cache.NewExpirableLRU[cache.StoreObject[authn.Authenticator]](newAuthCache(g), 2, cache.StoreObjectKeyFunc)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	expiresAt := time.Now().Add(time.Hour)
+	for _, key := range []string{"registry/a", "registry/b"} {
+		auth := &cloneableAuth{config: authn.AuthConfig{Username: key}}
+		g.Expect(cacheObject[authn.Authenticator](lru, auth, key, expiresAt)).To(Succeed())
+	}
+	_, found, err := getObjectFromCache(lru, "registry/a")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(found).To(BeTrue())
+
+	auth := &cloneableAuth{config: authn.AuthConfig{Username: "registry/c"}}
+	g.Expect(cacheObject[authn.Authenticator](lru, auth, "registry/c", expiresAt)).To(Succeed())
+
+	_, found, err = getObjectFromCache(lru, "registry/b")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(found).To(BeFalse())
+	ttl, ok := getObjectTTL(lru, "registry/c")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(ttl).To(BeNumerically(">", 59*time.Minute))
+}
+
+func TestGetObjectsFromCache(t *testing.T) {
+	g := NewWithT(t)
+	c := newAuthCache(g)
+	for _, key := range []string{"ghcr.io", "docker.io"} {
+		auth := &cloneableAuth{config: authn.AuthConfig{Password: key}}
+		err := cacheObject[authn.Authenticator](c, auth, key, time.Now().Add(time.Hour))
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+
+	objs, errs := getObjectsFromCache(c, []string{"ghcr.io", "quay.io", "docker.io", "gcr.io"})
+	g.Expect(objs).To(HaveLen(2))
+	for _, key := range []string{"ghcr.io", "docker.io"} {
+		g.Expect(objs).To(HaveKey(key))
+		config, err := objs[key].Authorization()
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(config.Password).To(Equal(key))
+	}
+	g.Expect(errs).To(HaveLen(2))
+	g.Expect(errs["quay.io"]).To(MatchError(cache.ErrNotFound))
+	g.Expect(errs["gcr.io"]).To(MatchError(cache.ErrNotFound))
+
+	objs, errs = getObjectsFromCache(c, nil)
+	g.Expect(objs).To(BeEmpty())
+	g.Expect(errs).To(BeEmpty())
+}
+
+func TestSharedObjectCache(t *testing.T) {
+	g := NewWithT(t)
+	c := newAuthCache(g)
+	expiresAt := time.Now().Add(time.Hour)
+
+	basic := &authn.Basic{Username: "user", Password: "pass"}
+	err := cacheSharedObject(c, basic, "docker.io", expiresAt)
+	g.Expect(err).ToNot(HaveOccurred())
+	token := &cloneableAuth{config: authn.AuthConfig{RegistryToken: "token"}}
+	err = cacheSharedObject(c, token, "ecr", expiresAt)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	gotBasic, exists, err := getSharedObjectFromCache[*authn.Basic](c, "docker.io")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeTrue())
+	g.Expect(gotBasic).To(Equal(basic))
+
+	gotToken, exists, err := getSharedObjectFromCache[*cloneableAuth](c, "ecr")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeTrue())
+	g.Expect(gotToken.config.RegistryToken).To(Equal("token"))
+	g.Expect(gotToken).ToNot(BeIdenticalTo(token))
+
+	_, exists, err = getSharedObjectFromCache[*authn.Basic](c, "ecr")
+	g.Expect(err).To(MatchError(ContainSubstring("are of type *login.cloneableAuth, not *authn.Basic")))
+	g.Expect(exists).To(BeFalse())
+
+	_, exists, err = getSharedObjectFromCache[*authn.Basic](c, "missing")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeFalse())
+}
+
+func TestGetObjectFromCacheOrEvict(t *testing.T) {
+	g := NewWithT(t)
+	start := time.Now()
+	clockOpt, fc := withFakeClock(start)
+	c := newAuthCache(g, clockOpt)
+	for _, key := range []string{"short", "long"} {
+		ttl := time.Minute
+		if key == "long" {
+			ttl = time.Hour
+		}
+		err := cacheObject[authn.Authenticator](c, &cloneableAuth{}, key, start.Add(ttl))
+		g.Expect(err).ToNot(HaveOccurred())
+	}
+
+	_, exists, err := getObjectFromCacheOrEvict(c, "short")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeTrue())
+
+	fc.Set(start.Add(2 * time.Minute))
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, exists, err := getObjectFromCacheOrEvict(c, "short")
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(exists).To(BeFalse())
+		}()
+	}
+	wg.Wait()
+	keys, err := c.ListKeys()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(keys).To(ConsistOf("long"))
+
+	_, exists, err = getObjectFromCacheOrEvict(c, "long")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeTrue())
+
+	// stores without atomic removal are only read
+	_, exists, err = getObjectFromCacheOrEvict[authn.Authenticator](unlistableStore{c}, "missing")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeFalse())
+}
+
+func TestGetObjectFromCacheWithStatus(t *testing.T) {
+	g := NewWithT(t)
+	start := time.Now()
+	clockOpt, fc := withFakeClock(start)
+	c, err := cache.New(5, cache.StoreObjectKeyFunc,
+		cache.WithCleanupInterval[cache.StoreObject[authn.Authenticator]](1*time.Hour),
+		clockOpt)
+	g.Expect(err).ToNot(HaveOccurred())
+	auth := &cloneableAuth{config: authn.AuthConfig{Password: "pass"}}
+
+	expiresAt := start.Add(10 * time.Minute)
+	err = cacheObject[authn.Authenticator](c, auth, "registry", expiresAt)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	obj, status, err := getObjectFromCacheWithStatus(c, "registry")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(status).To(Equal(cacheHit))
+	g.Expect(obj).To(Equal(auth))
+	g.Expect(obj).ToNot(BeIdenticalTo(auth))
+
+	fc.Set(expiresAt)
+	_, status, err = getObjectFromCacheWithStatus(c, "registry")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(status).To(Equal(cacheHit))
+
+	fc.Set(expiresAt.Add(time.Second))
+	obj, status, err = getObjectFromCacheWithStatus(c, "registry")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(status).To(Equal(cacheExpired))
+	g.Expect(obj).To(Equal(auth))
+
+	_, status, err = getObjectFromCacheWithStatus(c, "missing")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(status).To(Equal(cacheMiss))
+
+	g.Expect(c.Delete(cache.StoreObject[authn.Authenticator]{Key: "registry"})).To(Succeed())
+	_, status, err = getObjectFromCacheWithStatus(c, "registry")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(status).To(Equal(cacheMiss))
+
+	// stores not retaining expired objects only report hits and misses
+	lru, err := cache.NewExpirableLRU[cache.StoreObject[authn.Authenticator]](c, 5, cache.StoreObjectKeyFunc)
+	g.Expect(err).ToNot(HaveOccurred())
+	err = cacheObject[authn.Authenticator](lru, auth, "lru", start.Add(time.Hour))
+	g.Expect(err).ToNot(HaveOccurred())
+	_, status, err = getObjectFromCacheWithStatus[authn.Authenticator](lru, "lru")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(status).To(Equal(cacheHit))
+}
+
+func TestClock_ExpiryBoundaries(t *testing.T) {
+	g := NewWithT(t)
+	start := time.Now()
+	clockOpt, fc := withFakeClock(start)
+	c, err := cache.New(5, cache.StoreObjectKeyFunc,
+		cache.WithCleanupInterval[cache.StoreObject[authn.Authenticator]](1*time.Hour),
+		clockOpt)
+	g.Expect(err).ToNot(HaveOccurred())
+	auth := &cloneableAuth{config: authn.AuthConfig{Password: "pass"}}
+	expiresAt := start.Add(10 * time.Minute)
+	err = cacheObject[authn.Authenticator](c, auth, "registry", expiresAt)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// the object is stale from the start of the refresh window
+	fc.Set(expiresAt.Add(-time.Minute - time.Nanosecond))
+	_, _, stale, err := getObjectFromCacheWithFreshness(c, "registry", time.Minute)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(stale).To(BeFalse())
+	fc.Set(expiresAt.Add(-time.Minute))
+	_, _, stale, err = getObjectFromCacheWithFreshness(c, "registry", time.Minute)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(stale).To(BeTrue())
+
+	// the object has time left until its expiration time
+	fc.Set(expiresAt.Add(-time.Nanosecond))
+	ttl, ok := getObjectTTL(c, "registry")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(ttl).To(Equal(time.Nanosecond))
+	fc.Set(expiresAt)
+	_, ok = getObjectTTL(c, "registry")
+	g.Expect(ok).To(BeFalse())
+
+	// the object expires after its expiration time
+	_, status, err := getObjectFromCacheWithStatus(c, "registry")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(status).To(Equal(cacheHit))
+	fc.Set(expiresAt.Add(time.Nanosecond))
+	_, status, err = getObjectFromCacheWithStatus(c, "registry")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(status).To(Equal(cacheExpired))
+
+	// anonymous access is cached for at least anonymousTTL from now
+	err = cacheObject[authn.Authenticator](c, authn.Anonymous, "anonymous", start)
+	g.Expect(err).ToNot(HaveOccurred())
+	ttl, ok = getObjectTTL(c, "anonymous")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(ttl).To(Equal(anonymousTTL))
+}
+
+func TestCacheObject_WithMaxTTL(t *testing.T) {
+	g := NewWithT(t)
+	start := time.Now()
+	clockOpt, _ := withFakeClock(start)
+	c := newAuthCache(g, clockOpt)
+	auth := &cloneableAuth{config: authn.AuthConfig{Password: "pass"}}
+
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+		maxTTL    time.Duration
+		wantTTL   time.Duration
+	}{
+		{name: "clamped", expiresIn: 48 * time.Hour, maxTTL: time.Hour, wantTTL: time.Hour},
+		{name: "within the maximum", expiresIn: 30 * time.Minute, maxTTL: time.Hour, wantTTL: 30 * time.Minute},
+		{name: "no maximum", expiresIn: 48 * time.Hour, wantTTL: 48 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewWithT(t)
+			err := cacheObject[authn.Authenticator](c, auth, tt.name, start.Add(tt.expiresIn), withMaxTTL(tt.maxTTL))
+			g.Expect(err).ToNot(HaveOccurred())
+			ttl, ok := getObjectTTL(c, tt.name)
+			g.Expect(ok).To(BeTrue())
+			g.Expect(ttl).To(Equal(tt.wantTTL))
+		})
+	}
+}
+
+// failingExpirationStore is a store failing to set expirations.
+func TestCacheObject_WithCachePredicate(t *testing.T) {
+	g := NewWithT(t)
+	c := newAuthCache(g)
+
+	var checked []authn.Authenticator
+	notStatic := withCachePredicate(func(auth authn.Authenticator) bool {
+		checked = append(checked, auth)
+		_, static := auth.(*authn.Basic)
+		return !static
+	})
+	expiresAt := time.Now().Add(time.Hour)
+
+	basic := &authn.Basic{Username: "user", Password: "pass"}
+	err := cacheObject[authn.Authenticator](c, basic, "static", expiresAt, notStatic)
+	g.Expect(err).ToNot(HaveOccurred())
+	bearer := &authn.Bearer{Token: "token"}
+	err = cacheObject[authn.Authenticator](c, bearer, "token", expiresAt, notStatic)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(checked).To(Equal([]authn.Authenticator{basic, bearer}))
+
+	_, exists, err := c.GetByKey("static")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeFalse())
+	_, exists, err = c.GetByKey("token")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeTrue())
+
+	// everything is cached by default
+	err = cacheObject[authn.Authenticator](c, basic, "static", expiresAt)
+	g.Expect(err).ToNot(HaveOccurred())
+	_, exists, err = c.GetByKey("static")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeTrue())
+}
+
+type failingExpirationStore struct {
+	*cache.Cache[cache.StoreObject[authn.Authenticator]]
+}
+
+func (s failingExpirationStore) SetExpiration(cache.StoreObject[authn.Authenticator], time.Time) error {
+	return errors.New("expiration not supported")
+}
+
+func TestCacheObject_Errors(t *testing.T) {
+	g := NewWithT(t)
+	c := newAuthCache(g)
+	auth := &cloneableAuth{config: authn.AuthConfig{Password: "pass"}}
+
+	store := failingExpirationStore{c}
+	err := cacheObject[authn.Authenticator](store, auth, "registry", time.Now().Add(time.Hour))
+	var cacheErr *CacheObjectError
+	g.Expect(errors.As(err, &cacheErr)).To(BeTrue())
+	g.Expect(cacheErr.Key).To(Equal("registry"))
+	g.Expect(cacheErr.Step).To(Equal("SetExpiration"))
+	g.Expect(err).To(MatchError("SetExpiration failed: expiration not supported"))
+
+	// the object was removed
+	_, exists, err := getObjectFromCache(c, "registry")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeFalse())
+
+	g.Expect(c.Close()).To(Succeed())
+	err = cacheObject[authn.Authenticator](c, auth, "registry", time.Now().Add(time.Hour))
+	g.Expect(errors.As(err, &cacheErr)).To(BeTrue())
+	g.Expect(cacheErr.Step).To(Equal("Set"))
+	g.Expect(err).To(MatchError(cache.ErrCacheClosed))
+}
@@ -18,9 +18,11 @@ package login
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
@@ -70,8 +72,11 @@ type ProviderOptions struct {
 	// AzureAutoLogin enables automatic attempt to get credentials for images in
 	// ACR.
 	AzureAutoLogin bool
-	// Cache is a cache for storing auth configurations.
+	// Cache is a cache for storing auth configurations. It can be wrapped
+	// with cache.NewExpirableLRU to bound its number of entries.
 	Cache cache.Expirable[cache.StoreObject[authn.Authenticator]]
+	// CacheMetrics optionally collects the hits, misses and sets of Cache.
+	CacheMetrics CacheMetrics
 }
 
 // Manager is a login manager for various registry providers.
@@ -109,12 +114,18 @@ func (m *Manager) WithACRClient(c *azure.Client) *Manager {
 	return m
 }
 
+// loginTokenMargin brings forward the expiration of the cached provider
+// tokens, to account for clock skew and for the latency of the requests
+// using them.
+const loginTokenMargin = 5 * time.Minute
+
 // Login performs authentication against a registry and returns the Authenticator.
 // For generic registry provider, it is no-op.
 func (m *Manager) Login(ctx context.Context, url string, ref name.Reference, opts ProviderOptions) (authn.Authenticator, error) {
 	log := log.FromContext(ctx)
+	key := loginCacheKey(url, ref)
 	if opts.Cache != nil {
-		auth, exists, err := getObjectFromCache(opts.Cache, url)
+		auth, exists, err := getObjectFromCacheWithMetrics(opts.Cache, key, opts.CacheMetrics)
 		if err != nil {
 			log.Error(err, "failed to get auth object from cache")
 		}
@@ -130,7 +141,7 @@ func (m *Manager) Login(ctx context.Context, url string, ref name.Reference, opt
 			return nil, err
 		}
 		if opts.Cache != nil {
-			err := cacheObject(opts.Cache, auth, url, expiresAt)
+			err := cacheObjectWithECRToken(opts.Cache, auth, key, expiresAt, loginTokenMargin, withMetrics(opts.CacheMetrics))
 			if err != nil {
 				log.Error(err, "failed to cache auth object")
 			}
@@ -142,7 +153,7 @@ func (m *Manager) Login(ctx context.Context, url string, ref name.Reference, opt
 			return nil, err
 		}
 		if opts.Cache != nil {
-			err := cacheObject(opts.Cache, auth, url, expiresAt)
+			err := cacheObjectWithMetrics(opts.Cache, auth, key, expiresAt, opts.CacheMetrics)
 			if err != nil {
 				log.Error(err, "failed to cache auth object")
 			}
@@ -154,7 +165,7 @@ func (m *Manager) Login(ctx context.Context, url string, ref name.Reference, opt
 			return nil, err
 		}
 		if opts.Cache != nil {
-			err := cacheObject(opts.Cache, auth, url, expiresAt)
+			err := cacheACRLogin(opts.Cache, auth, key, expiresAt, opts.CacheMetrics)
 			if err != nil {
 				log.Error(err, "failed to cache auth object")
 			}
@@ -164,6 +175,34 @@ func (m *Manager) Login(ctx context.Context, url string, ref name.Reference, opt
 	return nil, nil
 }
 
+// loginCacheKey returns the cache key of the credentials for the
+// provided registry URL, following the same rules as
+// ImageRegistryProvider to tell repository root addresses apart.
+func loginCacheKey(url string, ref name.Reference) string {
+	addr := strings.TrimSuffix(url, "/")
+	if strings.ContainsRune(addr, '/') {
+		return CacheKey(ref.Context().RegistryStr(), ref.Context().RepositoryStr())
+	}
+	return CacheKey(addr, "")
+}
+
+// cacheACRLogin caches the ACR credentials auth until their token expires,
+// see cacheObjectWithACRToken, or until expiresAt if the expiration cannot
+// be read from the token.
+func cacheACRLogin(store cache.Expirable[cache.StoreObject[authn.Authenticator]], auth authn.Authenticator, key string,
+	expiresAt time.Time, metrics CacheMetrics) error {
+	config, err := auth.Authorization()
+	if err != nil {
+		return err
+	}
+	err = cacheObjectWithACRToken(store, auth, key, config.Password, loginTokenMargin, withMetrics(metrics))
+	var cacheErr *CacheObjectError
+	if err == nil || errors.As(err, &cacheErr) {
+		return err
+	}
+	return cacheObjectWithMetrics(store, auth, key, expiresAt, metrics)
+}
+
 // OIDCLogin attempts to get an Authenticator for the provided URL endpoint.
 //
 // If you want to construct an Authenticator based on an image reference,
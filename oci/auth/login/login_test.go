@@ -168,17 +168,19 @@ func TestLogin(t *testing.T) {
 
 func TestLogin_WithCache(t *testing.T) {
 	timestamp := time.Now().Add(10 * time.Second).Unix()
+	ecrTimestamp := time.Now().Add(time.Hour).Unix()
 	tests := []struct {
-		name         string
-		responseBody string
-		statusCode   int
-		providerOpts ProviderOptions
-		beforeFunc   func(serverURL string, mgr *Manager, image *string)
-		wantErr      bool
+		name          string
+		responseBody  string
+		statusCode    int
+		providerOpts  ProviderOptions
+		beforeFunc    func(serverURL string, mgr *Manager, image *string)
+		wantErr       bool
+		wantExpiresAt time.Time
 	}{
 		{
 			name:         "ecr",
-			responseBody: fmt.Sprintf(`{"authorizationData": [{"authorizationToken": "c29tZS1rZXk6c29tZS1zZWNyZXQ=","expiresAt": %d}]}`, timestamp),
+			responseBody: fmt.Sprintf(`{"authorizationData": [{"authorizationToken": "c29tZS1rZXk6c29tZS1zZWNyZXQ=","expiresAt": %d}]}`, ecrTimestamp),
 			providerOpts: ProviderOptions{AwsAutoLogin: true},
 			beforeFunc: func(serverURL string, mgr *Manager, image *string) {
 				// Create ECR client and configure the manager.
@@ -195,6 +197,8 @@ func TestLogin_WithCache(t *testing.T) {
 
 				*image = "012345678901.dkr.ecr.us-east-1.amazonaws.com/foo:v1"
 			},
+			// the expiration is brought forward by the margin
+			wantExpiresAt: time.Unix(ecrTimestamp, 0).Add(-loginTokenMargin),
 		},
 		{
 			name:         "gcr",
@@ -207,6 +211,7 @@ func TestLogin_WithCache(t *testing.T) {
 
 				*image = "gcr.io/foo/bar:v1"
 			},
+			wantExpiresAt: time.Unix(timestamp, 0),
 		},
 		{
 			name:         "acr",
@@ -261,17 +266,45 @@ func TestLogin_WithCache(t *testing.T) {
 			if tt.wantErr {
 				g.Expect(err).To(HaveOccurred())
 			} else {
-				auth, exists, err := getObjectFromCache(cache, image)
+				key := CacheKey(ref.Context().RegistryStr(), ref.Context().RepositoryStr())
+				auth, exists, err := getObjectFromCache(cache, key)
 				g.Expect(err).ToNot(HaveOccurred())
 				g.Expect(exists).To(BeTrue())
 				g.Expect(auth).ToNot(BeNil())
-				obj, _, err := cache.GetByKey(image)
+				obj, _, err := cache.GetByKey(key)
 				g.Expect(err).ToNot(HaveOccurred())
 				expiration, err := cache.GetExpiration(obj)
 				g.Expect(err).ToNot(HaveOccurred())
 				g.Expect(expiration).ToNot(BeZero())
-				g.Expect(expiration).To(BeTemporally("~", time.Unix(timestamp, 0), 1*time.Second))
+				g.Expect(expiration).To(BeTemporally("~", tt.wantExpiresAt, 1*time.Second))
 			}
 		})
 	}
 }
+
+func TestCacheACRLogin(t *testing.T) {
+	g := NewWithT(t)
+	c := newAuthCache(g)
+	metrics := newFakeCacheMetrics()
+	fallback := time.Now().Add(10 * time.Minute).Truncate(time.Second)
+
+	// the expiration is read from the token
+	exp := time.Now().Add(3 * time.Hour).Truncate(time.Second)
+	auth := authn.FromConfig(authn.AuthConfig{
+		Username: "00000000-0000-0000-0000-000000000000",
+		Password: fakeJWT(fmt.Sprintf(`{"exp":%d}`, exp.Unix())),
+	})
+	g.Expect(cacheACRLogin(c, auth, "jwt", fallback, metrics)).To(Succeed())
+	ttl, ok := getObjectTTL(c, "jwt")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(time.Now().Add(ttl)).To(BeTemporally("~", exp.Add(-loginTokenMargin), time.Second))
+
+	// or is the one of the client for the opaque tokens
+	auth = authn.FromConfig(authn.AuthConfig{Username: "user", Password: "opaque"})
+	g.Expect(cacheACRLogin(c, auth, "opaque", fallback, metrics)).To(Succeed())
+	ttl, ok = getObjectTTL(c, "opaque")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(time.Now().Add(ttl)).To(BeTemporally("~", fallback, time.Second))
+
+	g.Expect(metrics.sets).To(Equal(map[string]int{"jwt": 1, "opaque": 1}))
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package logintest provides utilities for testing code using the
+// credentials cache of the login package.
+package logintest
+
+import (
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// StaticAuthenticator is an authn.Authenticator returning a fixed
+// username and password. It implements cache.Cloner, so that the cache
+// helpers return copies of it like they do for real credentials.
+type StaticAuthenticator struct {
+	Username string
+	Password string
+}
+
+var _ authn.Authenticator = &StaticAuthenticator{}
+
+// Authorization returns the username and password.
+func (a *StaticAuthenticator) Authorization() (*authn.AuthConfig, error) {
+	return &authn.AuthConfig{
+		Username: a.Username,
+		Password: a.Password,
+	}, nil
+}
+
+// Clone returns a copy of the authenticator.
+func (a *StaticAuthenticator) Clone() authn.Authenticator {
+	c := *a
+	return &c
+}
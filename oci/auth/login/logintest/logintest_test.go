@@ -0,0 +1,59 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logintest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	. "github.com/onsi/gomega"
+
+	"github.com/fluxcd/pkg/cache"
+)
+
+func TestStaticAuthenticator_Authorization(t *testing.T) {
+	g := NewWithT(t)
+
+	auth := &StaticAuthenticator{Username: "user", Password: "pass"}
+	config, err := auth.Authorization()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(config).To(Equal(&authn.AuthConfig{Username: "user", Password: "pass"}))
+
+	// the config can be modified without changing the authenticator
+	config.Password = "other"
+	config, err = auth.Authorization()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(config.Password).To(Equal("pass"))
+}
+
+func TestStaticAuthenticator_Clone(t *testing.T) {
+	g := NewWithT(t)
+
+	c, err := cache.New(1, cache.StoreObjectKeyFunc,
+		cache.WithCleanupInterval[cache.StoreObject[authn.Authenticator]](time.Hour))
+	g.Expect(err).ToNot(HaveOccurred())
+	auth := &StaticAuthenticator{Username: "user", Password: "pass"}
+	g.Expect(c.Set(cache.StoreObject[authn.Authenticator]{Object: auth, Key: "registry"})).To(Succeed())
+
+	obj, exists, err := c.GetByKey("registry")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeTrue())
+	clone := obj.Clone().Object
+	g.Expect(clone).To(Equal(auth))
+	g.Expect(clone).ToNot(BeIdenticalTo(auth))
+}
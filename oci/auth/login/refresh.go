@@ -0,0 +1,111 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+
+	"github.com/fluxcd/pkg/cache"
+)
+
+// RefreshAhead renews the credentials of a cache before they expire, so
+// that the lookups of frequently used credentials never miss.
+//
+// The credentials expiring within the lead time are fetched again with
+// the loader. When the loader fails, the cached credentials are kept
+// until they expire, and renewing them is retried on the next pass.
+type RefreshAhead struct {
+	store    cache.Expirable[cache.StoreObject[authn.Authenticator]]
+	leadTime time.Duration
+	loader   func(ctx context.Context, key string) (authn.Authenticator, time.Time, error)
+
+	// OnError is called with the error of each pass of Start which
+	// failed to renew some credentials, if not nil.
+	OnError func(err error)
+}
+
+// NewRefreshAhead returns a RefreshAhead renewing the credentials of
+// store with loader when they expire within leadTime.
+func NewRefreshAhead(store cache.Expirable[cache.StoreObject[authn.Authenticator]], leadTime time.Duration,
+	loader func(ctx context.Context, key string) (authn.Authenticator, time.Time, error)) *RefreshAhead {
+	return &RefreshAhead{
+		store:    store,
+		leadTime: leadTime,
+		loader:   loader,
+	}
+}
+
+// Start renews the credentials every interval in a goroutine until ctx
+// is done. The returned channel is closed once the goroutine returned.
+func (r *RefreshAhead) Start(ctx context.Context, interval time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.Refresh(ctx); err != nil && r.OnError != nil {
+					r.OnError(err)
+				}
+			}
+		}
+	}()
+	return done
+}
+
+// Refresh renews once the credentials expiring within the lead time.
+// Cached authentication failures are not renewed. The errors of all the
+// keys are returned joined together.
+func (r *RefreshAhead) Refresh(ctx context.Context) error {
+	keys, err := r.store.ListKeys()
+	if err != nil {
+		return fmt.Errorf("failed to list cache keys: %w", err)
+	}
+
+	var errs []error
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+		auth, exists, stale, err := getObjectFromCacheWithFreshness(r.store, key, r.leadTime)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to get credentials for %s from cache: %w", key, err))
+			continue
+		}
+		if _, failed := auth.(*authError); !exists || !stale || failed {
+			continue
+		}
+		auth, expiresAt, err := r.loader(ctx, key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to refresh credentials for %s: %w", key, err))
+			continue
+		}
+		if err := cacheObject(r.store, auth, key, expiresAt); err != nil {
+			errs = append(errs, fmt.Errorf("failed to cache credentials for %s: %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2024 The Flux authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package login
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	. "github.com/onsi/gomega"
+)
+
+func TestRefreshAhead_Refresh(t *testing.T) {
+	g := NewWithT(t)
+	start := time.Now()
+	expiresAt := start.Add(time.Hour)
+	clockOpt, fc := withFakeClock(start)
+	c := newAuthCache(g, clockOpt)
+
+	err := cacheObject[authn.Authenticator](c, &cloneableAuth{config: authn.AuthConfig{Password: "old"}}, "registry", expiresAt)
+	g.Expect(err).ToNot(HaveOccurred())
+	err = cacheAuthError(c, "failed", errors.New("denied"), time.Hour)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	var (
+		calls   int
+		loadErr error
+	)
+	r := NewRefreshAhead(c, 5*time.Minute, func(_ context.Context, key string) (authn.Authenticator, time.Time, error) {
+		calls++
+		if loadErr != nil {
+			return nil, time.Time{}, loadErr
+		}
+		return &cloneableAuth{config: authn.AuthConfig{Password: "new"}}, expiresAt.Add(time.Hour), nil
+	})
+	password := func() string {
+		auth, exists, err := getObjectFromCache(c, "registry")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(exists).To(BeTrue())
+		config, err := auth.Authorization()
+		g.Expect(err).ToNot(HaveOccurred())
+		return config.Password
+	}
+
+	// far from expiry
+	g.Expect(r.Refresh(context.Background())).To(Succeed())
+	g.Expect(calls).To(Equal(0))
+
+	// within the lead time, the loader fails
+	fc.Set(expiresAt.Add(-time.Minute))
+	loadErr = errors.New("registry unavailable")
+	err = r.Refresh(context.Background())
+	g.Expect(err).To(MatchError(loadErr))
+	g.Expect(err.Error()).To(ContainSubstring("failed to refresh credentials for registry"))
+	g.Expect(calls).To(Equal(1))
+	g.Expect(password()).To(Equal("old"))
+
+	// within the lead time, the loader succeeds
+	loadErr = nil
+	g.Expect(r.Refresh(context.Background())).To(Succeed())
+	g.Expect(calls).To(Equal(2))
+	g.Expect(password()).To(Equal("new"))
+
+	ttl, ok := getObjectTTL(c, "registry")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(ttl).To(Equal(time.Hour + time.Minute))
+}
+
+func TestRefreshAhead_Start(t *testing.T) {
+	g := NewWithT(t)
+	c := newAuthCache(g)
+
+	err := cacheObject[authn.Authenticator](c, &cloneableAuth{}, "registry", time.Now().Add(time.Minute))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	var calls atomic.Int32
+	r := NewRefreshAhead(c, time.Hour, func(context.Context, string) (authn.Authenticator, time.Time, error) {
+		calls.Add(1)
+		return nil, time.Time{}, errors.New("registry unavailable")
+	})
+	var failures atomic.Int32
+	r.OnError = func(error) { failures.Add(1) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := r.Start(ctx, 10*time.Millisecond)
+	g.Eventually(calls.Load).Should(BeNumerically(">=", 2))
+	g.Expect(failures.Load()).To(BeNumerically(">=", 1))
+
+	cancel()
+	g.Eventually(done).Should(BeClosed())
+	_, exists, err := getObjectFromCache(c, "registry")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(exists).To(BeTrue())
+}